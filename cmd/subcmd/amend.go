@@ -0,0 +1,121 @@
+package subcmd
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dypflying/go-qcow2lib/qcow2"
+	"github.com/spf13/cobra"
+)
+
+type AmendOptions struct {
+	Format  string
+	Options []string
+}
+
+func newAmendCmd() *cobra.Command {
+
+	var opts AmendOptions
+	var cmd = &cobra.Command{
+		Use:   "amend",
+		Short: "change the options of an existing image",
+		Long: "qcow2_utils amend [-f format] <-o key=value[,key=value...]> <filename>\n" +
+			"supported options: compat=0.10|1.1, refcount-bits=n, data-file-raw=on|off, backing=file, backing-fmt=format",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 || len(opts.Options) == 0 {
+				cmd.Help()
+				os.Exit(1)
+			}
+			amendOpts, err := parseAmendOptions(opts.Options)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+			if err = execAmend(args[0], opts.Format, amendOpts); err != nil {
+				fmt.Printf("amend failed, err: %v\n", err)
+				os.Exit(1)
+			}
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.Format, "format", "f", "", "specify the file format")
+	flags.StringArrayVarP(&opts.Options, "options", "o", nil, "comma separated key=value options to change")
+
+	return cmd
+}
+
+func parseAmendOptions(options []string) (map[string]any, error) {
+
+	amendOpts := make(map[string]any)
+	for _, opt := range options {
+		for _, kv := range strings.Split(opt, ",") {
+			key, value, found := strings.Cut(kv, "=")
+			if !found {
+				return nil, fmt.Errorf("invalid option %s, expect key=value", kv)
+			}
+			switch key {
+			case qcow2.OPT_REFCOUNT_BITS:
+				bits, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid refcount-bits %s", value)
+				}
+				amendOpts[key] = bits
+			case qcow2.OPT_DATAFILE_RAW:
+				switch value {
+				case "on", "true":
+					amendOpts[key] = true
+				case "off", "false":
+					amendOpts[key] = false
+				default:
+					return nil, fmt.Errorf("invalid data-file-raw %s, expect on or off", value)
+				}
+			default:
+				amendOpts[key] = value
+			}
+		}
+	}
+	return amendOpts, nil
+}
+
+func execAmend(filename string, format string, options map[string]any) error {
+
+	var root *qcow2.BdrvChild
+	var err error
+
+	if format == "" {
+		if format, err = qcow2.Blk_Probe(filename); err != nil {
+			return err
+		}
+	}
+	//the backing file is not needed and may be the one being replaced
+	if root, err = qcow2.Blk_Open(filename, map[string]any{qcow2.OPT_FMT: format},
+		qcow2.BDRV_O_RDWR|qcow2.BDRV_O_NO_BACKING); err != nil {
+		return err
+	}
+	defer qcow2.Blk_Close(root)
+
+	return qcow2.Blk_Amend(root, options)
+}
@@ -0,0 +1,81 @@
+package subcmd
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dypflying/go-qcow2lib/qcow2"
+	"github.com/spf13/cobra"
+)
+
+type ChecksumOptions struct {
+	Format  string
+	Workers int
+}
+
+func newChecksumCmd() *cobra.Command {
+
+	var opts ChecksumOptions
+	var cmd = &cobra.Command{
+		Use:   "checksum",
+		Short: "print a checksum of the guest content, independent of the format and layout",
+		Long:  "qcow2_utils checksum [-f format] [-m workers] <filename>",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				cmd.Help()
+				os.Exit(1)
+			}
+			if opts.Format != "" {
+				if _, ok := qcow2.Supported_Types[opts.Format]; !ok {
+					fmt.Printf("file format %s is not supported\n", opts.Format)
+					os.Exit(1)
+				}
+			}
+			sum, err := execChecksum(args[0], opts.Format, opts.Workers)
+			if err != nil {
+				fmt.Printf("checksum failed, err: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("%s  %s\n", sum, args[0])
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.Format, "format", "f", "", "specify the file format")
+	flags.IntVarP(&opts.Workers, "workers", "m", qcow2.DEFAULT_CHECKSUM_WORKERS, "specify the number of concurrent hash workers")
+
+	return cmd
+}
+
+func execChecksum(filename string, format string, workers int) (string, error) {
+
+	var root *qcow2.BdrvChild
+	var err error
+
+	if root, err = openImage(filename, format); err != nil {
+		return "", err
+	}
+	defer qcow2.Blk_Close(root)
+
+	return qcow2.Blk_Checksum(root, workers)
+}
@@ -44,6 +44,12 @@ func NewCommand() *cobra.Command {
 		newCreateCmd(),
 		newInfoCmd(),
 		newDdCmd(),
+		newConvertCmd(),
+		newCompareCmd(),
+		newChecksumCmd(),
+		newMapCmd(),
+		newMeasureCmd(),
+		newAmendCmd(),
 	)
 	return cmd
 }
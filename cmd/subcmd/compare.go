@@ -0,0 +1,105 @@
+package subcmd
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dypflying/go-qcow2lib/qcow2"
+	"github.com/spf13/cobra"
+)
+
+type CompareOptions struct {
+	Format1 string
+	Format2 string
+	Strict  bool
+}
+
+func newCompareCmd() *cobra.Command {
+
+	var opts CompareOptions
+	var cmd = &cobra.Command{
+		Use:   "compare",
+		Short: "check if two images have the same guest content",
+		Long:  "qcow2_utils compare [-f format1] [-F format2] [-s] <file1> <file2>",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				cmd.Help()
+				os.Exit(2)
+			}
+			for _, format := range []string{opts.Format1, opts.Format2} {
+				if format == "" {
+					continue
+				}
+				if _, ok := qcow2.Supported_Types[format]; !ok {
+					fmt.Printf("file format %s is not supported\n", format)
+					os.Exit(2)
+				}
+			}
+			offset, same, err := execCompare(args[0], opts.Format1, args[1], opts.Format2, opts.Strict)
+			if err != nil {
+				fmt.Printf("compare failed, err: %v\n", err)
+				os.Exit(2)
+			}
+			if !same {
+				fmt.Printf("Content mismatch at offset %d!\n", offset)
+				os.Exit(1)
+			}
+			fmt.Println("Images are identical.")
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.Format1, "format1", "f", "", "specify the format of the first file")
+	flags.StringVarP(&opts.Format2, "format2", "F", "", "specify the format of the second file")
+	flags.BoolVarP(&opts.Strict, "strict", "s", false, "the sizes and the allocation state must match as well")
+
+	return cmd
+}
+
+func openImage(filename string, format string) (*qcow2.BdrvChild, error) {
+
+	var err error
+	if format == "" {
+		if format, err = qcow2.Blk_Probe(filename); err != nil {
+			return nil, err
+		}
+	}
+	return qcow2.Blk_Open(filename, map[string]any{qcow2.OPT_FMT: format}, 0)
+}
+
+func execCompare(file1 string, format1 string, file2 string, format2 string, strict bool) (uint64, bool, error) {
+
+	var root1, root2 *qcow2.BdrvChild
+	var err error
+
+	if root1, err = openImage(file1, format1); err != nil {
+		return 0, false, err
+	}
+	defer qcow2.Blk_Close(root1)
+	if root2, err = openImage(file2, format2); err != nil {
+		return 0, false, err
+	}
+	defer qcow2.Blk_Close(root2)
+
+	return qcow2.Blk_Compare(root1, root2, strict)
+}
@@ -0,0 +1,170 @@
+package subcmd
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dypflying/go-qcow2lib/qcow2"
+	"github.com/spf13/cobra"
+)
+
+type ConvertOptions struct {
+	InputFormat  string
+	OutputFormat string
+	BackingPath  string
+	Workers      int
+	Progress     bool
+	SubCluster   bool
+	CopyRange    bool
+	L2CacheSize  string
+	SrcCache     string
+	DstCache     string
+	//read ahead of the sequential reads of a qcow2 input
+	DataCacheSize string
+	dataCacheSize uint64
+}
+
+func newConvertCmd() *cobra.Command {
+
+	var opts ConvertOptions
+	var cmd = &cobra.Command{
+		Use:   "convert",
+		Short: "convert an image to another format, skipping zero and unallocated ranges",
+		Long:  "qcow2_utils convert [-f inputformat] [-O outputformat] [-B backingfile] [-m workers] [-p] [-C] [-T srccache] [-t cache] [--enable-subcluster] [--l2-cache-size=size] [--data-cache-size=size] <inputfile> <outputfile>",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var l2CacheSize uint64
+			var ok bool
+			if len(args) != 2 {
+				cmd.Help()
+				os.Exit(1)
+			}
+			if opts.InputFormat != "" {
+				if _, ok := qcow2.Supported_Types[opts.InputFormat]; !ok {
+					fmt.Printf("input file format %s is not supported\n", opts.InputFormat)
+					os.Exit(1)
+				}
+			}
+			if _, ok := qcow2.Supported_Types[opts.OutputFormat]; !ok {
+				fmt.Printf("output file format %s is not supported\n", opts.OutputFormat)
+				os.Exit(1)
+			}
+			if opts.BackingPath != "" && opts.OutputFormat != QCOW2_FORMAT {
+				fmt.Printf("backing file is only supported by the qcow2 format\n")
+				os.Exit(1)
+			}
+			if opts.L2CacheSize != "" {
+				if l2CacheSize, ok = str2Int(opts.L2CacheSize); !ok {
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			if opts.DataCacheSize != "" {
+				if opts.dataCacheSize, ok = str2Bytes(opts.DataCacheSize); !ok {
+					fmt.Printf("invalid data cache size %s\n", opts.DataCacheSize)
+					os.Exit(1)
+				}
+			}
+			if err := execConvert(args[0], args[1], opts, l2CacheSize); err != nil {
+				fmt.Printf("convert finished with err: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println("convert finished successfully")
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.InputFormat, "inputformat", "f", "", "specify the input file format")
+	flags.StringVarP(&opts.OutputFormat, "outputformat", "O", QCOW2_FORMAT, "specify the output file format")
+	flags.StringVarP(&opts.BackingPath, "backing", "B", "", "keep the specified backing file in the output, only the differences are copied")
+	flags.IntVarP(&opts.Workers, "workers", "m", qcow2.DEFAULT_CONVERT_WORKERS, "specify the number of concurrent copy workers")
+	flags.BoolVarP(&opts.Progress, "progress", "p", false, "show the progress")
+	flags.BoolVarP(&opts.CopyRange, "copy-range", "C", false, "copy the data with copy_file_range, falling back to reading and writing it where it's not supported")
+	flags.BoolVarP(&opts.SubCluster, "enable-subcluster", "", false, "")
+	flags.StringVarP(&opts.L2CacheSize, "l2-cache-size", "", "", "specify the l2 cache size")
+	flags.StringVarP(&opts.DataCacheSize, "data-cache-size", "", "", "read ahead of the sequential reads of a qcow2 input into a cache of the specified size, valid unit is 'k', 'm', 'g'")
+	flags.StringVarP(&opts.SrcCache, "source-cache", "T", "writeback", "specify the cache mode of the input file: writeback, writethrough, none, directsync or unsafe")
+	flags.StringVarP(&opts.DstCache, "cache", "t", "writeback", "specify the cache mode of the output file: writeback, writethrough, none, directsync or unsafe")
+
+	return cmd
+}
+
+func execConvert(inputFile string, outputFile string, opts ConvertOptions, l2CacheSize uint64) (err error) {
+
+	var inRoot, outRoot *qcow2.BdrvChild
+	var size uint64
+	var inputFormat = opts.InputFormat
+
+	if _, err = os.Stat(outputFile); err == nil {
+		return fmt.Errorf("%s exists", outputFile)
+	}
+	if inputFormat == "" {
+		if inputFormat, err = qcow2.Blk_Probe(inputFile); err != nil {
+			return err
+		}
+	}
+	if inRoot, err = qcow2.Blk_Open(inputFile,
+		map[string]any{qcow2.OPT_FMT: inputFormat, qcow2.OPT_L2CACHESIZE: l2CacheSize, qcow2.OPT_CACHE: opts.SrcCache,
+			qcow2.OPT_DATA_CACHE_SIZE: opts.dataCacheSize}, 0); err != nil {
+		return err
+	}
+	defer qcow2.Blk_Close(inRoot)
+	if size, err = qcow2.Blk_Getlength(inRoot); err != nil {
+		return err
+	}
+
+	createOpts := make(map[string]any)
+	createOpts[qcow2.OPT_SIZE] = size
+	createOpts[qcow2.OPT_FMT] = opts.OutputFormat
+	createOpts[qcow2.OPT_FILENAME] = outputFile
+	if opts.OutputFormat == QCOW2_FORMAT {
+		createOpts[qcow2.OPT_SUBCLUSTER] = opts.SubCluster
+		createOpts[qcow2.OPT_BACKING] = opts.BackingPath
+	}
+	if err = qcow2.Blk_Create(outputFile, createOpts); err != nil {
+		return err
+	}
+	if outRoot, err = qcow2.Blk_Open(outputFile,
+		map[string]any{qcow2.OPT_FMT: opts.OutputFormat, qcow2.OPT_L2CACHESIZE: l2CacheSize, qcow2.OPT_CACHE: opts.DstCache},
+		qcow2.BDRV_O_RDWR); err != nil {
+		return err
+	}
+	defer qcow2.Blk_Close(outRoot)
+
+	convertOpts := &qcow2.ConvertOptions{
+		Workers:          opts.Workers,
+		TargetHasBacking: opts.BackingPath != "",
+		//a newly created image without backing file reads as zeroes
+		TargetIsZero: opts.BackingPath == "",
+		CopyRange:    opts.CopyRange,
+	}
+	if opts.Progress {
+		convertOpts.Progress = func(done uint64, total uint64) {
+			fmt.Printf("    (%.2f/100%%)\r", float64(done)*100/float64(total))
+		}
+	}
+	err = qcow2.Blk_Convert(inRoot, outRoot, convertOpts)
+	if opts.Progress {
+		fmt.Println()
+	}
+	return err
+}
@@ -21,8 +21,10 @@ SOFTWARE.
 
 import (
 	"fmt"
+	"io"
+	"math"
 	"os"
-	"time"
+	"strings"
 
 	"github.com/dypflying/go-qcow2lib/qcow2"
 	"github.com/spf13/cobra"
@@ -44,6 +46,20 @@ type DdOptions struct {
 	InputFormat  string
 	OutputFormat string
 	L2CacheSize  string
+	BlockSize    string
+	Count        uint64
+	Skip         uint64
+	Seek         uint64
+	Conv         string
+	SrcCache     string
+	DstCache     string
+	//read ahead of the sequential reads of a qcow2 input
+	DataCacheSize string
+	dataCacheSize uint64
+	//set if --count is given, otherwise copy till the end of input
+	hasCount bool
+	sparse   bool
+	notrunc  bool
 }
 
 func newDdCmd() *cobra.Command {
@@ -52,11 +68,12 @@ func newDdCmd() *cobra.Command {
 	var cmd = &cobra.Command{
 		Use:   "dd",
 		Short: "convert and copy from or to qcow2 files",
-		Long:  "qcow2_utils dd [-f inputformat] <-i inputfile> <-O outputformat> <-o outputfile> [--l2-cache-size=size]",
+		Long: "qcow2_utils dd [-f inputformat] <-i inputfile> [-O outputformat] <-o outputfile> [-T srccache] [-t cache] [--bs=size] [--count=n] " +
+			"[--skip=n] [--seek=n] [--conv=sparse,notrunc] [--l2-cache-size=size] [--data-cache-size=size]",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			var l2CacheSize uint64
+			var l2CacheSize, blockSize uint64
 			var ok bool
-			if opts.InputFile == "" || opts.OutputFile == "" || opts.OutputFormat == "" {
+			if opts.InputFile == "" || opts.OutputFile == "" {
 				cmd.Help()
 				os.Exit(1)
 			}
@@ -66,9 +83,11 @@ func newDdCmd() *cobra.Command {
 					os.Exit(1)
 				}
 			}
-			if _, ok := qcow2.Supported_Types[opts.OutputFormat]; !ok {
-				fmt.Printf("output file format %s is not supported\n", opts.OutputFormat)
-				os.Exit(1)
+			if opts.OutputFormat != "" {
+				if _, ok := qcow2.Supported_Types[opts.OutputFormat]; !ok {
+					fmt.Printf("output file format %s is not supported\n", opts.OutputFormat)
+					os.Exit(1)
+				}
 			}
 			if opts.L2CacheSize != "" {
 				if l2CacheSize, ok = str2Int(opts.L2CacheSize); !ok {
@@ -76,8 +95,42 @@ func newDdCmd() *cobra.Command {
 					os.Exit(1)
 				}
 			}
-			if err := runDD(opts, l2CacheSize); err != nil {
+			if opts.DataCacheSize != "" {
+				if opts.dataCacheSize, ok = str2Bytes(opts.DataCacheSize); !ok {
+					fmt.Printf("invalid data cache size %s\n", opts.DataCacheSize)
+					os.Exit(1)
+				}
+			}
+			if blockSize, ok = str2Bytes(opts.BlockSize); !ok {
+				fmt.Printf("invalid block size %s\n", opts.BlockSize)
+				os.Exit(1)
+			}
+			//skip, seek and count are in blocks, their byte offsets must fit in 64 bits
+			for _, n := range []struct {
+				name  string
+				value uint64
+			}{{"skip", opts.Skip}, {"seek", opts.Seek}, {"count", opts.Count}} {
+				if n.value > math.MaxUint64/blockSize {
+					fmt.Printf("invalid %s %d, too large for block size %s\n", n.name, n.value, opts.BlockSize)
+					os.Exit(1)
+				}
+			}
+			for _, conv := range strings.Split(opts.Conv, ",") {
+				switch strings.TrimSpace(conv) {
+				case "":
+				case "sparse":
+					opts.sparse = true
+				case "notrunc":
+					opts.notrunc = true
+				default:
+					fmt.Printf("invalid conversion %s\n", conv)
+					os.Exit(1)
+				}
+			}
+			opts.hasCount = cmd.Flags().Changed("count")
+			if err := runDD(opts, blockSize, l2CacheSize); err != nil {
 				fmt.Printf("dd finished with err: %v\n", err)
+				os.Exit(1)
 			} else {
 				fmt.Println("dd finished successfully")
 			}
@@ -89,85 +142,178 @@ func newDdCmd() *cobra.Command {
 	flags.StringVarP(&opts.InputFile, "inputfile", "i", "", "specify the input file name")
 	flags.StringVarP(&opts.OutputFile, "outputfile", "o", "", "specify the output file name")
 	flags.StringVarP(&opts.InputFormat, "inputformat", "f", "", "specify the input file format")
-	flags.StringVarP(&opts.OutputFormat, "outputformat", "O", "", "specify the output file format")
+	flags.StringVarP(&opts.OutputFormat, "outputformat", "O", "", "specify the output file format, required if the output file doesn't exist")
 	flags.StringVarP(&opts.L2CacheSize, "l2-cache-size", "", "", "specify the l2 cache size")
+	flags.StringVarP(&opts.DataCacheSize, "data-cache-size", "", "", "read ahead of the sequential reads of a qcow2 input into a cache of the specified size, valid unit is 'k', 'm', 'g'")
+	flags.StringVarP(&opts.SrcCache, "source-cache", "T", "writeback", "specify the cache mode of the input file: writeback, writethrough, none, directsync or unsafe")
+	flags.StringVarP(&opts.DstCache, "cache", "t", "writeback", "specify the cache mode of the output file: writeback, writethrough, none, directsync or unsafe")
+	flags.StringVarP(&opts.BlockSize, "bs", "", "512", "read and write up to the specified bytes at a time, valid unit is 'k', 'm', 'g'")
+	flags.Uint64VarP(&opts.Count, "count", "", 0, "copy only the specified number of input blocks")
+	flags.Uint64VarP(&opts.Skip, "skip", "", 0, "skip the specified number of blocks at start of input")
+	flags.Uint64VarP(&opts.Seek, "seek", "", 0, "skip the specified number of blocks at start of output")
+	flags.StringVarP(&opts.Conv, "conv", "", "", "comma separated list of 'sparse' (seek rather than write the output for all-zero blocks) "+
+		"and 'notrunc' (do not truncate the output file)")
 
 	return cmd
 }
 
-func runDD(opts DdOptions, l2CacheSize uint64) (err error) {
-	return execDD(opts.InputFile, opts.InputFormat, opts.OutputFile, opts.OutputFormat, l2CacheSize)
-}
-
-// begin to copy data from raw file to qcow2 file
-func execDD(inputFile string, inputFormat string, outputFile string, outputFormat string, l2CacheSize uint64) (err error) {
+func runDD(opts DdOptions, blockSize uint64, l2CacheSize uint64) (err error) {
 
 	var inRoot, outRoot *qcow2.BdrvChild
-	var size uint64
-	var outPos, inPos, blockCount uint64
-	var inRet, outRet uint64
-	buf := make([]uint8, BLOCK_SIZE)
+	var inSize, outSize, copySize uint64
+	var exists bool
+	var inputFormat = opts.InputFormat
+	var outputFormat = opts.OutputFormat
 
 	if inputFormat == "" {
-		if inputFormat, err = qcow2.Blk_Probe(inputFile); err != nil {
+		if inputFormat, err = qcow2.Blk_Probe(opts.InputFile); err != nil {
 			return err
 		}
 	}
-	if inRoot, err = qcow2.Blk_Open(inputFile,
-		map[string]any{qcow2.OPT_FMT: inputFormat, qcow2.OPT_L2CACHESIZE: l2CacheSize}, qcow2.BDRV_O_RDWR); err != nil {
+	if inRoot, err = qcow2.Blk_Open(opts.InputFile,
+		map[string]any{qcow2.OPT_FMT: inputFormat, qcow2.OPT_L2CACHESIZE: l2CacheSize, qcow2.OPT_CACHE: opts.SrcCache,
+			qcow2.OPT_DATA_CACHE_SIZE: opts.dataCacheSize}, 0); err != nil {
+		return err
+	}
+	defer qcow2.Blk_Close(inRoot)
+	if inSize, err = qcow2.Blk_Getlength(inRoot); err != nil {
 		return err
 	}
-	if size, err = qcow2.Blk_Getlength(inRoot); err != nil {
-		goto out
-	}
-
-	if _, err := os.Stat(outputFile); os.IsNotExist(err) {
-		if outputFormat == "qcow2" {
-			opts := make(map[string]any)
-			opts[qcow2.OPT_SIZE] = size
-			opts[qcow2.OPT_FMT] = outputFormat
-			opts[qcow2.OPT_FILENAME] = outputFile
-			opts[qcow2.OPT_SUBCLUSTER] = true
-			qcow2.Blk_Create(outputFile, opts)
-		} else if outputFormat == "raw" {
-			opts := make(map[string]any)
-			opts[qcow2.OPT_SIZE] = size
-			opts[qcow2.OPT_FMT] = outputFormat
-			opts[qcow2.OPT_FILENAME] = outputFile
-			qcow2.Blk_Create(outputFile, opts)
+	if opts.Skip*blockSize < inSize {
+		copySize = inSize - opts.Skip*blockSize
+	}
+	if opts.hasCount {
+		if copySize > opts.Count*blockSize {
+			copySize = opts.Count * blockSize
+		}
+	}
+
+	if opts.Seek*blockSize > math.MaxUint64-copySize {
+		return fmt.Errorf("seek %d plus the copied size %d is out of range", opts.Seek*blockSize, copySize)
+	}
+
+	if _, err = os.Stat(opts.OutputFile); err == nil {
+		exists = true
+		if outputFormat, err = probeOutput(opts.OutputFile, outputFormat); err != nil {
+			return err
+		}
+		//like dd, a raw output is truncated at the seek position,
+		//a qcow2 output has a fixed virtual size like a block device
+		if !opts.notrunc && outputFormat == RAW_FORMAT {
+			if err = os.Truncate(opts.OutputFile, int64(opts.Seek*blockSize)); err != nil {
+				return err
+			}
+		}
+	} else if os.IsNotExist(err) {
+		if outputFormat == "" {
+			return fmt.Errorf("output format must be specified for the new file %s", opts.OutputFile)
+		}
+		createOpts := make(map[string]any)
+		createOpts[qcow2.OPT_SIZE] = opts.Seek*blockSize + copySize
+		createOpts[qcow2.OPT_FMT] = outputFormat
+		createOpts[qcow2.OPT_FILENAME] = opts.OutputFile
+		if outputFormat == QCOW2_FORMAT {
+			createOpts[qcow2.OPT_SUBCLUSTER] = true
+		}
+		if err = qcow2.Blk_Create(opts.OutputFile, createOpts); err != nil {
+			return err
 		}
 	} else {
-		return fmt.Errorf("%s exists", outputFile)
+		return err
 	}
-	if outRoot, err = qcow2.Blk_Open(outputFile,
-		map[string]any{qcow2.OPT_FMT: outputFormat, qcow2.OPT_L2CACHESIZE: l2CacheSize},
+	if outRoot, err = qcow2.Blk_Open(opts.OutputFile,
+		map[string]any{qcow2.OPT_FMT: outputFormat, qcow2.OPT_L2CACHESIZE: l2CacheSize, qcow2.OPT_CACHE: opts.DstCache},
 		qcow2.BDRV_O_RDWR); err != nil {
 		return err
 	}
-	for outPos = 0; inPos < size; blockCount++ {
+	defer qcow2.Blk_Close(outRoot)
+	if outSize, err = qcow2.Blk_Getlength(outRoot); err != nil {
+		return err
+	}
 
-		if inPos+BLOCK_SIZE > size {
-			inRet, err = qcow2.Blk_Pread(inRoot, inPos, buf, size-inPos)
-		} else {
-			inRet, err = qcow2.Blk_Pread(inRoot, inPos, buf, BLOCK_SIZE)
+	err = execDD(inRoot, outRoot, outputFormat == RAW_FORMAT, opts.Skip*blockSize, opts.Seek*blockSize,
+		copySize, outSize, blockSize, opts.sparse)
+	if err == nil && exists && outputFormat == RAW_FORMAT {
+		err = qcow2.Blk_Flush(outRoot)
+	}
+	return err
+}
+
+// the format of an existing output, an empty file can only be raw
+func probeOutput(filename string, format string) (string, error) {
+	probed, err := qcow2.Blk_Probe(filename)
+	if err == io.EOF {
+		probed, err = RAW_FORMAT, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if format != "" && format != probed {
+		return "", fmt.Errorf("%s is a %s file, not %s", filename, probed, format)
+	}
+	return probed, nil
+}
+
+// copy bytes from inPos of input to outPos of output, block by block
+func execDD(inRoot *qcow2.BdrvChild, outRoot *qcow2.BdrvChild, growable bool, inPos uint64, outPos uint64,
+	bytes uint64, outSize uint64, blockSize uint64, sparse bool) (err error) {
+
+	var n, written uint64
+	var fullIn, partialIn, fullOut, partialOut uint64
+	buf := make([]uint8, blockSize)
+	zeroes := make([]uint8, blockSize)
+
+	for bytes > 0 {
+		n = blockSize
+		if bytes < blockSize {
+			n = bytes
 		}
-		if err != nil {
+		if _, err = qcow2.Blk_Pread(inRoot, inPos, buf, n); err != nil {
 			goto out
 		}
-		inPos += inRet
+		if n == blockSize {
+			fullIn++
+		} else {
+			partialIn++
+		}
+		inPos += n
+		bytes -= n
 
-		outRet, err = qcow2.Blk_Pwrite(outRoot, outPos, buf, inRet, 0)
-		if err != nil {
+		//a qcow2 output can't grow beyond its virtual size
+		written = n
+		if !growable && outPos+n > outSize {
+			written = 0
+			if outPos < outSize {
+				written = outSize - outPos
+			}
+		}
+		if written > 0 && !(sparse && string(buf[:written]) == string(zeroes[:written])) {
+			if _, err = qcow2.Blk_Pwrite(outRoot, outPos, buf, written, 0); err != nil {
+				goto out
+			}
+		}
+		outPos += written
+		if written == blockSize {
+			fullOut++
+		} else if written > 0 {
+			partialOut++
+		}
+		if written < n {
+			err = qcow2.ERR_ENOSPC
 			goto out
 		}
-		outPos += outRet
-		time.Sleep(time.Duration(1) * time.Microsecond)
 	}
-
-	//close input and outout
-	qcow2.Blk_Close(inRoot)
-	qcow2.Blk_Close(outRoot)
+	//blocks skipped at the end still count for the size of a raw output
+	if sparse && growable && outPos > outSize {
+		if outSize, err = qcow2.Blk_Getlength(outRoot); err != nil {
+			goto out
+		}
+		if outPos > outSize {
+			_, err = qcow2.Blk_Pwrite_Zeroes(outRoot, outPos-1, 1, 0)
+		}
+	}
 
 out:
+	fmt.Printf("%d+%d records in\n%d+%d records out\n", fullIn, partialIn, fullOut, partialOut)
 	return err
 }
@@ -0,0 +1,122 @@
+package subcmd
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/dypflying/go-qcow2lib/qcow2"
+	"github.com/spf13/cobra"
+)
+
+type MapOptions struct {
+	Format string
+	Output string
+	Start  string
+	Length string
+}
+
+func newMapCmd() *cobra.Command {
+
+	var opts MapOptions
+	var cmd = &cobra.Command{
+		Use:   "map",
+		Short: "print the allocation map of an image and its backing chain",
+		Long:  "qcow2_utils map [-f format] [--output=human|json] [--start-offset=offset] [--max-length=length] <filename>",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var start, length uint64 = 0, ^uint64(0)
+			var ok bool
+			if len(args) != 1 {
+				cmd.Help()
+				os.Exit(1)
+			}
+			if opts.Format != "" {
+				if _, ok := qcow2.Supported_Types[opts.Format]; !ok {
+					fmt.Printf("file format %s is not supported\n", opts.Format)
+					os.Exit(1)
+				}
+			}
+			if opts.Output != "human" && opts.Output != "json" {
+				fmt.Printf("output format %s is not supported\n", opts.Output)
+				os.Exit(1)
+			}
+			if opts.Start != "" {
+				if start, ok = str2Bytes(opts.Start); !ok && opts.Start != "0" {
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			if opts.Length != "" {
+				if length, ok = str2Bytes(opts.Length); !ok {
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			if err := execMap(args[0], opts.Format, opts.Output, start, length); err != nil {
+				fmt.Printf("map failed, err: %v\n", err)
+				os.Exit(1)
+			}
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.Format, "format", "f", "", "specify the file format")
+	flags.StringVarP(&opts.Output, "output", "", "human", "specify the output format, 'human' or 'json'")
+	flags.StringVarP(&opts.Start, "start-offset", "s", "", "the offset to start the map at")
+	flags.StringVarP(&opts.Length, "max-length", "l", "", "the maximum length to map")
+
+	return cmd
+}
+
+func execMap(filename string, format string, output string, start uint64, length uint64) error {
+
+	var root *qcow2.BdrvChild
+	var entries []*qcow2.MapEntry
+	var err error
+
+	if root, err = openImage(filename, format); err != nil {
+		return err
+	}
+	defer qcow2.Blk_Close(root)
+
+	if entries, err = qcow2.Blk_Map(root, start, length); err != nil {
+		return err
+	}
+	if output == "json" {
+		var bytes []byte
+		if bytes, err = json.MarshalIndent(entries, "", "  "); err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+		return nil
+	}
+
+	//like qemu-img, only the extents with data mapped to a file are listed
+	fmt.Printf("%-16s%-16s%-16s%s\n", "Offset", "Length", "Mapped to", "File")
+	for _, entry := range entries {
+		if entry.Data && entry.Offset != nil {
+			fmt.Printf("%#-16x%#-16x%#-16x%s\n", entry.Start, entry.Length, *entry.Offset, entry.Filename)
+		}
+	}
+	return nil
+}
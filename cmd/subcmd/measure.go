@@ -0,0 +1,142 @@
+package subcmd
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/dypflying/go-qcow2lib/qcow2"
+	"github.com/spf13/cobra"
+)
+
+type MeasureOptions struct {
+	InputFormat  string
+	OutputFormat string
+	Size         string
+	BackingPath  string
+	SubCluster   bool
+	ClusterSize  string
+	RefcountBits uint64
+	Output       string
+
+	clusterSize uint64
+}
+
+func newMeasureCmd() *cobra.Command {
+
+	var opts MeasureOptions
+	var cmd = &cobra.Command{
+		Use:   "measure",
+		Short: "measure the host space needed by a new image",
+		Long: "qcow2_utils measure [-f inputformat] [-O outputformat] [-b backingfile] [--enable-subcluster] " +
+			"[--cluster-size=size] [--refcount-bits=n] [--output=human|json] <--size size | filename>",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var size uint64
+			var ok bool
+			if (len(args) == 1) == (opts.Size != "") || len(args) > 1 {
+				cmd.Help()
+				os.Exit(1)
+			}
+			if opts.Size != "" {
+				if size, ok = str2Int(opts.Size); !ok {
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			if opts.ClusterSize != "" {
+				if opts.clusterSize, ok = str2Bytes(opts.ClusterSize); !ok {
+					fmt.Printf("invalid cluster size %s\n", opts.ClusterSize)
+					os.Exit(1)
+				}
+			}
+			if _, ok := qcow2.Supported_Types[opts.OutputFormat]; !ok {
+				fmt.Printf("output file format %s is not supported\n", opts.OutputFormat)
+				os.Exit(1)
+			}
+			if opts.Output != "human" && opts.Output != "json" {
+				fmt.Printf("output format %s is not supported\n", opts.Output)
+				os.Exit(1)
+			}
+			var filename string
+			if len(args) == 1 {
+				filename = args[0]
+			}
+			if err := execMeasure(filename, size, opts); err != nil {
+				fmt.Printf("measure failed, err: %v\n", err)
+				os.Exit(1)
+			}
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.InputFormat, "inputformat", "f", "", "specify the input file format")
+	flags.StringVarP(&opts.OutputFormat, "outputformat", "O", QCOW2_FORMAT, "specify the format of the new image")
+	flags.StringVarP(&opts.Size, "size", "s", "", "specify the size of the new image without input file, valid unit is 'k', 'm', 'g', 't'")
+	flags.StringVarP(&opts.BackingPath, "backing", "b", "", "the new image will have a backing file")
+	flags.BoolVarP(&opts.SubCluster, "enable-subcluster", "", false, "")
+	flags.StringVarP(&opts.ClusterSize, "cluster-size", "", "", "specify the cluster size of the new image, valid unit is 'k', 'm'")
+	flags.Uint64VarP(&opts.RefcountBits, "refcount-bits", "", 0, "specify the refcount width of the new image")
+	flags.StringVarP(&opts.Output, "output", "", "human", "specify the output format, 'human' or 'json'")
+
+	return cmd
+}
+
+func execMeasure(filename string, size uint64, opts MeasureOptions) error {
+
+	var root *qcow2.BdrvChild
+	var info *qcow2.BlockMeasureInfo
+	var err error
+
+	measureOpts := make(map[string]any)
+	measureOpts[qcow2.OPT_FMT] = opts.OutputFormat
+	measureOpts[qcow2.OPT_SUBCLUSTER] = opts.SubCluster
+	measureOpts[qcow2.OPT_BACKING] = opts.BackingPath
+	if opts.clusterSize > 0 {
+		measureOpts[qcow2.OPT_CLUSTER_SIZE] = opts.clusterSize
+	}
+	if opts.RefcountBits > 0 {
+		measureOpts[qcow2.OPT_REFCOUNT_BITS] = opts.RefcountBits
+	}
+	if filename != "" {
+		if root, err = openImage(filename, opts.InputFormat); err != nil {
+			return err
+		}
+		defer qcow2.Blk_Close(root)
+	} else {
+		measureOpts[qcow2.OPT_SIZE] = size
+	}
+
+	if info, err = qcow2.Blk_Measure(root, measureOpts); err != nil {
+		return err
+	}
+	if opts.Output == "json" {
+		var bytes []byte
+		if bytes, err = json.MarshalIndent(info, "", "  "); err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+		return nil
+	}
+	fmt.Printf("required size: %d\nfully allocated size: %d\n", info.Required, info.FullyAllocated)
+	return nil
+}
@@ -56,3 +56,12 @@ func str2Int(sizeStr string) (uint64, bool) {
 	}
 	return ret, true
 }
+
+// like str2Int, but a plain number of bytes is also accepted
+func str2Bytes(sizeStr string) (uint64, bool) {
+	sizeStr = strings.TrimSpace(sizeStr)
+	if val, err := strconv.ParseUint(sizeStr, 10, 64); err == nil {
+		return val, val > 0
+	}
+	return str2Int(sizeStr)
+}
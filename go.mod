@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/spf13/cobra v1.7.0
 	github.com/stretchr/testify v1.8.2
+	golang.org/x/sys v0.30.0
 )
 
 require (
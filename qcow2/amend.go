@@ -0,0 +1,491 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+/*
+ * Change the options of an open qcow2 image in place. The supported options
+ * are OPT_COMPAT ("0.10" or "1.1"), OPT_REFCOUNT_BITS, OPT_DATAFILE_RAW,
+ * OPT_BACKING and OPT_BACKING_FMT. The image is drained while it is amended.
+ * A new backing file is only opened on the next open of the image.
+ */
+func Blk_Amend(child *BdrvChild, options map[string]any) error {
+
+	var err error
+	var s *BDRVQcow2State
+	var compat, backingFile, backingFormat string
+	var refcountBits uint64
+	var dataFileRaw, hasBacking, hasBackingFormat bool
+	var upgraded, backingChanged bool
+	bs := child_bs(child)
+
+	if bs == nil {
+		return Err_NullObject
+	}
+	if bs.Drv == nil || bs.Drv.FormatName != TYPE_QCOW2_NAME {
+		return ERR_ENOTSUP
+	}
+	if bs.OpenFlags&BDRV_O_RDWR == 0 {
+		return Err_NoWritePerm
+	}
+	s = bs.opaque.(*BDRVQcow2State)
+
+	for key, val := range options {
+		switch key {
+		case OPT_FMT, OPT_FILENAME:
+		case OPT_COMPAT:
+			compat = val.(string)
+			if compat != "0.10" && compat != "1.1" {
+				return fmt.Errorf("invalid compat level: %s", compat)
+			}
+		case OPT_REFCOUNT_BITS:
+			refcountBits = interface2uint64(val)
+			if refcountBits == 0 || refcountBits > 64 || refcountBits&(refcountBits-1) != 0 {
+				return fmt.Errorf("refcount width must be a power of two and may not exceed 64 bits")
+			}
+		case OPT_DATAFILE_RAW:
+			dataFileRaw = val.(bool)
+		case OPT_BACKING:
+			backingFile = val.(string)
+			hasBacking = true
+		case OPT_BACKING_FMT:
+			backingFormat = val.(string)
+			hasBackingFormat = true
+		default:
+			return fmt.Errorf("option %s can not be amended", key)
+		}
+	}
+	if hasBacking && backingFile != "" {
+		if _, err = os.Stat(backingFile); err != nil {
+			return err
+		}
+		if backingFile, err = filepath.Abs(backingFile); err != nil {
+			return err
+		}
+	}
+
+	bdrv_drained_begin(bs)
+	defer bdrv_drained_end(bs)
+	s.Qlock()
+	defer s.Qunlock()
+
+	//the state the image ends up in
+	version := s.QcowVersion
+	switch compat {
+	case "0.10":
+		version = QCOW2_VERSION2
+	case "1.1":
+		version = QCOW2_VERSION3
+	}
+	refcountOrder := s.RefcountOrder
+	if refcountBits > 0 {
+		refcountOrder = uint32(bits.TrailingZeros64(refcountBits))
+	}
+	oldBackingFile, oldBackingFormat := bs.backingFile, s.BackingFormat
+	if !hasBacking {
+		backingFile = oldBackingFile
+	} else if !hasBackingFormat && backingFile != oldBackingFile {
+		//the format of the old backing file is meaningless for a new one
+		hasBackingFormat = true
+	}
+	if !hasBackingFormat {
+		backingFormat = oldBackingFormat
+	}
+	_, hasDataFileRaw := options[OPT_DATAFILE_RAW]
+	if !hasDataFileRaw {
+		dataFileRaw = data_file_is_raw(bs)
+	}
+
+	//check everything first, so that a bad combination changes nothing
+	if err = qcow2_amend_check(bs, version, refcountOrder, backingFile, backingFormat,
+		hasDataFileRaw, dataFileRaw); err != nil {
+		return err
+	}
+
+	//upgrade first and downgrade last, so that the steps in between work on a
+	//version 3 image. The header only changes are done before the rewriting
+	//ones, and are undone if a later step fails.
+	if version == QCOW2_VERSION3 && s.QcowVersion == QCOW2_VERSION2 {
+		s.QcowVersion = QCOW2_VERSION3
+		if err = qcow2_update_header(bs); err != nil {
+			s.QcowVersion = QCOW2_VERSION2
+			return err
+		}
+		upgraded = true
+	}
+
+	//a backing file is removed before the data file becomes raw
+	if backingFile != oldBackingFile || backingFormat != oldBackingFormat {
+		bs.backingFile, s.BackingFormat = backingFile, backingFormat
+		if err = qcow2_update_header(bs); err != nil {
+			bs.backingFile, s.BackingFormat = oldBackingFile, oldBackingFormat
+			goto fail
+		}
+		backingChanged = true
+	}
+
+	if refcountOrder != s.RefcountOrder {
+		if err = qcow2_change_refcount_order(bs, refcountOrder); err != nil {
+			goto fail
+		}
+	}
+
+	if dataFileRaw != data_file_is_raw(bs) {
+		if err = qcow2_amend_data_file_raw(bs, dataFileRaw); err != nil {
+			goto fail
+		}
+	}
+
+	if version == QCOW2_VERSION2 && s.QcowVersion != QCOW2_VERSION2 {
+		if err = qcow2_downgrade(bs); err != nil {
+			goto fail
+		}
+	}
+	return nil
+
+fail:
+	//the rewritten refcounts and zero clusters read the same as before
+	if upgraded && s.RefcountOrder == QCOW2_REFCOUNT_ORDER {
+		s.QcowVersion = QCOW2_VERSION2
+	} else {
+		upgraded = false
+	}
+	if backingChanged {
+		bs.backingFile, s.BackingFormat = oldBackingFile, oldBackingFormat
+	}
+	if upgraded || backingChanged {
+		qcow2_update_header(bs)
+	}
+	return err
+}
+
+// check the options of Blk_Amend against each other and the image
+func qcow2_amend_check(bs *BlockDriverState, version int, refcountOrder uint32,
+	backingFile string, backingFormat string, hasDataFileRaw bool, dataFileRaw bool) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var err error
+	var refcount uint64
+
+	if version == QCOW2_VERSION2 {
+		if refcountOrder != QCOW2_REFCOUNT_ORDER {
+			return fmt.Errorf("different refcount widths than 16 bits require compatibility level 1.1 or above")
+		}
+		if s.IncompatibleFeatures&(QCOW2_INCOMPAT_EXTL2|QCOW2_INCOMPAT_DATA_FILE) > 0 {
+			return fmt.Errorf("subcluster and external data file require compatibility level 1.1 or above")
+		}
+	}
+	if backingFormat != "" && backingFile == "" {
+		return fmt.Errorf("a backing format requires a backing file")
+	}
+	if hasDataFileRaw && !has_data_file(bs) {
+		return fmt.Errorf("data-file-raw requires an external data file")
+	}
+	if dataFileRaw && has_data_file(bs) && backingFile != "" {
+		return fmt.Errorf("a raw external data file can not have a backing file")
+	}
+
+	//the refcounts must fit into a narrower width
+	if refcountOrder < s.RefcountOrder {
+		newMax := uint64(1)<<(uint64(1)<<refcountOrder) - 1
+		coveredClusters := uint64(s.MaxRefcountTableIndex+1) << s.RefcountBlockBits
+		for i := uint64(0); i < coveredClusters; i++ {
+			if refcount, err = qcow2_get_refcount(bs, i); err != nil {
+				return err
+			}
+			if refcount > newMax {
+				return fmt.Errorf("cluster %d has refcount %d, which exceeds the new refcount width: %w",
+					i, refcount, ERR_EINVAL)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * Downgrade the image to version 2. Version 2 knows neither zero clusters
+ * nor any of the feature bits, so the zero clusters are turned into data
+ * clusters (or unallocated ones, if nothing is behind them) first.
+ */
+func qcow2_downgrade(bs *BlockDriverState) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var err error
+
+	if err = qcow2_expand_zero_clusters(bs); err != nil {
+		return err
+	}
+	if err = qcow2_flush_caches(bs); err != nil {
+		return err
+	}
+
+	version := s.QcowVersion
+	incompat, compat, autoclear := s.IncompatibleFeatures, s.CompatibleFeatures, s.AutoclearFeatures
+	s.QcowVersion = QCOW2_VERSION2
+	s.IncompatibleFeatures, s.CompatibleFeatures, s.AutoclearFeatures = 0, 0, 0
+	if err = qcow2_update_header(bs); err != nil {
+		s.QcowVersion = version
+		s.IncompatibleFeatures, s.CompatibleFeatures, s.AutoclearFeatures = incompat, compat, autoclear
+		return err
+	}
+	return nil
+}
+
+func qcow2_expand_zero_clusters(bs *BlockDriverState) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var l2Slice unsafe.Pointer
+	var err error
+	sliceSize := uint64(s.L2SliceSize) * l2_entry_size(s)
+	nSlices := uint64(s.L2Size) / uint64(s.L2SliceSize)
+
+	for l1Index := uint32(0); l1Index < s.L1Size; l1Index++ {
+		l2Offset := s.L1Table[l1Index] & L1E_OFFSET_MASK
+		if l2Offset == 0 {
+			continue
+		}
+		for slice := uint64(0); slice < nSlices; slice++ {
+			if l2Slice, err = qcow2_cache_get(bs, s.L2TableCache, l2Offset+slice*sliceSize); err != nil {
+				return err
+			}
+			for i := uint32(0); i < uint32(s.L2SliceSize); i++ {
+				l2Entry := get_l2_entry(s, l2Slice, i)
+				switch qcow2_get_cluster_type(bs, l2Entry) {
+				case QCOW2_CLUSTER_ZERO_PLAIN:
+					if bs.backingFile == "" {
+						//reads as zeroes without the flag as well
+						l2Entry = 0
+						break
+					}
+					var offset uint64
+					if offset, err = qcow2_alloc_clusters(bs, uint64(s.ClusterSize)); err != nil {
+						goto fail
+					}
+					if err = bdrv_pwrite_zeroes(s.DataFile, offset, uint64(s.ClusterSize), 0); err != nil {
+						qcow2_free_clusters(bs, offset, uint64(s.ClusterSize), QCOW2_DISCARD_ALWAYS)
+						goto fail
+					}
+					l2Entry = offset | QCOW_OFLAG_COPIED
+				case QCOW2_CLUSTER_ZERO_ALLOC:
+					if err = bdrv_pwrite_zeroes(s.DataFile, l2Entry&L2E_OFFSET_MASK, uint64(s.ClusterSize), 0); err != nil {
+						goto fail
+					}
+					l2Entry &^= QCOW_OFLAG_ZERO
+				default:
+					continue
+				}
+				//the new clusters must be referenced before they are used
+				qcow2_cache_set_dependency(bs, s.L2TableCache, s.RefcountBlockCache)
+				qcow2_cache_entry_mark_dirty(s.L2TableCache, l2Slice)
+				set_l2_entry(s, l2Slice, i, l2Entry)
+			}
+			qcow2_cache_put(s.L2TableCache, l2Slice)
+		}
+	}
+	return nil
+
+fail:
+	qcow2_cache_put(s.L2TableCache, l2Slice)
+	return err
+}
+
+/*
+ * Rewrite the refcount structure with a new refcount width.
+ * The new refcount table and blocks are written to a new area at the end of
+ * the image file, which is not referenced by anything until the header is
+ * switched over to the new table, so a failure at any point before leaves
+ * the image as it was. The clusters of the old structure are free in the new
+ * one.
+ */
+func qcow2_change_refcount_order(bs *BlockDriverState, refcountOrder uint32) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var err error
+	var fileLength, nbClusters, refcount, blockCount, areaSize uint64
+	var refcounts []uint64
+	clusterSize := uint64(s.ClusterSize)
+	newMax := uint64(1)<<(uint64(1)<<refcountOrder) - 1
+	if refcountOrder == 6 {
+		newMax = ^uint64(0)
+	}
+
+	if err = qcow2_flush_caches(bs); err != nil {
+		return err
+	}
+	if fileLength, err = bdrv_getlength(bs.current.bs); err != nil {
+		return err
+	}
+	nbClusters = size_to_clusters(s, fileLength)
+	coveredClusters := uint64(s.MaxRefcountTableIndex+1) << s.RefcountBlockBits
+
+	//collect the current refcounts
+	refcounts = make([]uint64, nbClusters)
+	for i := uint64(0); i < coveredClusters; i++ {
+		if refcount, err = qcow2_get_refcount(bs, i); err != nil {
+			return err
+		}
+		if refcount == 0 {
+			continue
+		}
+		if i >= uint64(len(refcounts)) {
+			refcounts = append(refcounts, make([]uint64, i+1-uint64(len(refcounts)))...)
+		}
+		if refcount > newMax {
+			return fmt.Errorf("cluster %d has refcount %d, which exceeds the new refcount width: %w",
+				i, refcount, ERR_EINVAL)
+		}
+		refcounts[i] = refcount
+	}
+	//the old structure is not part of the new one
+	tableClusters := size_to_clusters(s, uint64(s.RefcountTableSize)*REFTABLE_ENTRY_SIZE)
+	for i := uint64(0); i < tableClusters; i++ {
+		refcounts[(s.RefcountTableOffset>>s.ClusterBits)+i] = 0
+	}
+	for i := uint32(0); i < s.RefcountTableSize; i++ {
+		if offset := s.RefcountTable[i] & REFT_OFFSET_MASK; offset > 0 && offset>>s.ClusterBits < uint64(len(refcounts)) {
+			refcounts[offset>>s.ClusterBits] = 0
+		}
+	}
+
+	//the new structure is placed at the end of the file
+	nbClusters = uint64(len(refcounts))
+	areaOffset := nbClusters << s.ClusterBits
+	if areaSize, err = qcow2_refcount_metadata_size(nbClusters, clusterSize, int(refcountOrder),
+		false, &blockCount); err != nil {
+		return err
+	}
+	areaClusters := areaSize >> s.ClusterBits
+	refcounts = append(refcounts, make([]uint64, areaClusters)...)
+	for i := nbClusters; i < nbClusters+areaClusters; i++ {
+		refcounts[i] = 1
+	}
+	newTableClusters := areaClusters - blockCount
+	newTableOffset := areaOffset + blockCount*clusterSize
+	newTableSize := uint32(newTableClusters * clusterSize / REFTABLE_ENTRY_SIZE)
+	newTable := make([]uint64, newTableSize)
+	refcountsPerBlock := clusterSize * 8 >> refcountOrder
+	setRefcount := set_refcount_funcs[refcountOrder]
+
+	block := make([]byte, clusterSize)
+	for i := uint64(0); i < blockCount; i++ {
+		memset(unsafe.Pointer(&block[0]), int(clusterSize))
+		for j := uint64(0); j < refcountsPerBlock && i*refcountsPerBlock+j < uint64(len(refcounts)); j++ {
+			setRefcount(unsafe.Pointer(&block[0]), j, refcounts[i*refcountsPerBlock+j])
+		}
+		newTable[i] = areaOffset + i*clusterSize
+		if err = bdrv_pwrite(bs.current, newTable[i], unsafe.Pointer(&block[0]), clusterSize); err != nil {
+			return err
+		}
+	}
+	tableBuf := make([]uint64, newTableSize)
+	for i := range newTable {
+		tableBuf[i] = cpu_to_be64(newTable[i])
+	}
+	if err = bdrv_pwrite(bs.current, newTableOffset, unsafe.Pointer(&tableBuf[0]),
+		uint64(newTableSize)*REFTABLE_ENTRY_SIZE); err != nil {
+		return err
+	}
+	if err = bdrv_flush(bs.current.bs); err != nil {
+		return err
+	}
+
+	//switch over
+	if err = qcow2_cache_empty(bs, s.RefcountBlockCache); err != nil {
+		return err
+	}
+	oldOrder, oldTable := s.RefcountOrder, s.RefcountTable
+	oldTableOffset, oldTableSize := s.RefcountTableOffset, s.RefcountTableSize
+	qcow2_set_refcount_order(s, refcountOrder)
+	s.RefcountTable, s.RefcountTableOffset, s.RefcountTableSize = newTable, newTableOffset, newTableSize
+	if err = qcow2_update_header(bs); err != nil {
+		qcow2_set_refcount_order(s, oldOrder)
+		s.RefcountTable, s.RefcountTableOffset, s.RefcountTableSize = oldTable, oldTableOffset, oldTableSize
+		return err
+	}
+	update_max_refcount_table_index(s)
+	s.FreeClusterIndex = 0
+	s.FreeMap = nil
+	return nil
+}
+
+/*
+ * Set or clear the raw flag of the external data file. With the flag set the
+ * data file must read like the guest disk on its own, so everything the
+ * image doesn't map to the data file is zeroed there first.
+ */
+func qcow2_amend_data_file_raw(bs *BlockDriverState, raw bool) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var err error
+	var size, length, ret, pnum uint64
+
+	if raw {
+		if size, err = bdrv_getlength(bs); err != nil {
+			return err
+		}
+		//the block status takes the lock itself
+		s.Qunlock()
+		for offset := uint64(0); offset < size; offset += pnum {
+			if ret, err = bdrv_block_status(bs, false, offset, size-offset, &pnum, nil, nil); err != nil {
+				break
+			}
+			if ret&BDRV_BLOCK_DATA == 0 {
+				if err = bdrv_pwrite_zeroes(s.DataFile, offset, pnum, 0); err != nil {
+					break
+				}
+			}
+		}
+		s.Qlock()
+		if err != nil {
+			return err
+		}
+		if length, err = bdrv_getlength(s.DataFile.bs); err != nil {
+			return err
+		}
+		if length < size {
+			zero := []byte{0}
+			if err = bdrv_pwrite(s.DataFile, size-1, unsafe.Pointer(&zero[0]), 1); err != nil {
+				return err
+			}
+		}
+		if err = bdrv_flush(s.DataFile.bs); err != nil {
+			return err
+		}
+	}
+
+	autoclear := s.AutoclearFeatures
+	if raw {
+		s.AutoclearFeatures |= QCOW2_AUTOCLEAR_DATA_FILE_RAW
+	} else {
+		s.AutoclearFeatures &^= QCOW2_AUTOCLEAR_DATA_FILE_RAW
+	}
+	if err = qcow2_update_header(bs); err != nil {
+		s.AutoclearFeatures = autoclear
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func prepare_amend_image(t *testing.T, filename string, options map[string]any) *BdrvChild {
+	os.Remove(filename)
+	createOpts := map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 4 * 1024 * 1024}
+	for k, v := range options {
+		createOpts[k] = v
+	}
+	err := Blk_Create(filename, createOpts)
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	return root
+}
+
+func Test_amend_refcount_bits(t *testing.T) {
+	var filename = "/tmp/amend_refcount.qcow2"
+	root := prepare_amend_image(t, filename, nil)
+	data := bytes.Repeat([]byte("amend"), 40000)
+	_, err := Blk_Pwrite(root, 65536, data, uint64(len(data)), 0)
+	assert.Nil(t, err)
+
+	for _, refcountBits := range []int{1, 64, 16} {
+		err = Blk_Amend(root, map[string]any{OPT_REFCOUNT_BITS: refcountBits})
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(refcountBits), root.bs.opaque.(*BDRVQcow2State).RefcountBits)
+	}
+	err = Blk_Amend(root, map[string]any{OPT_REFCOUNT_BITS: 8})
+	assert.Nil(t, err)
+	Blk_Close(root)
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), root.bs.current.header.RefcountOrder)
+	buf := make([]byte, len(data))
+	_, err = Blk_Pread(root, 65536, buf, uint64(len(buf)))
+	assert.Nil(t, err)
+	assert.Equal(t, data, buf)
+
+	//allocations keep working with the new refcount structure
+	_, err = Blk_Pwrite(root, 3*1024*1024, data[:1000], 1000, 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pread(root, 3*1024*1024, buf[:1000], 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, data[:1000], buf[:1000])
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_amend_compat(t *testing.T) {
+	var basefile = "/tmp/amend_compat_base.qcow2"
+	var filename = "/tmp/amend_compat.qcow2"
+	base := prepare_amend_image(t, basefile, nil)
+	_, err := Blk_Pwrite(base, 0, bytes.Repeat([]byte{0xaa}, 2*65536), 2*65536, 0)
+	assert.Nil(t, err)
+	Blk_Close(base)
+
+	root := prepare_amend_image(t, filename, map[string]any{OPT_BACKING: basefile})
+	_, err = Blk_Pwrite(root, 2*65536, []byte("data"), 4, 0)
+	assert.Nil(t, err)
+	//a plain zero cluster over the backing file and an allocated one
+	_, err = Blk_Pwrite_Zeroes(root, 0, 65536, 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(root, 65536, []byte("data"), 4, 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite_Zeroes(root, 65536, 65536, 0)
+	assert.Nil(t, err)
+
+	err = Blk_Amend(root, map[string]any{OPT_COMPAT: "0.10"})
+	assert.Nil(t, err)
+	Blk_Close(root)
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(QCOW2_VERSION2), root.bs.current.header.Version)
+	buf := make([]byte, 3*65536)
+	_, err = Blk_Pread(root, 0, buf, uint64(len(buf)))
+	assert.Nil(t, err)
+	assert.True(t, buffer_is_zero(buf, 2*65536))
+	assert.Equal(t, "data", string(buf[2*65536:2*65536+4]))
+
+	err = Blk_Amend(root, map[string]any{OPT_COMPAT: "1.1"})
+	assert.Nil(t, err)
+	Blk_Close(root)
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(QCOW2_VERSION3), root.bs.current.header.Version)
+	assert.Equal(t, basefile, root.bs.backingFile)
+	Blk_Close(root)
+	os.Remove(basefile)
+	os.Remove(filename)
+}
+
+func Test_amend_backing(t *testing.T) {
+	var basefile = "/tmp/amend_backing_base.raw"
+	var filename = "/tmp/amend_backing.qcow2"
+	os.Remove(basefile)
+	err := Blk_Create(basefile, map[string]any{OPT_FMT: "raw", OPT_SIZE: 4 * 1024 * 1024})
+	assert.Nil(t, err)
+	base, err := Blk_Open(basefile, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(base, 0, []byte("raw backing"), 11, 0)
+	assert.Nil(t, err)
+	Blk_Close(base)
+
+	root := prepare_amend_image(t, filename, nil)
+	err = Blk_Amend(root, map[string]any{OPT_BACKING_FMT: "raw"})
+	assert.NotNil(t, err)
+	err = Blk_Amend(root, map[string]any{OPT_BACKING: basefile, OPT_BACKING_FMT: "raw"})
+	assert.Nil(t, err)
+	Blk_Close(root)
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "raw", root.bs.opaque.(*BDRVQcow2State).BackingFormat)
+	buf := make([]byte, 11)
+	_, err = Blk_Pread(root, 0, buf, 11)
+	assert.Nil(t, err)
+	assert.Equal(t, "raw backing", string(buf))
+	Blk_Close(root)
+	os.Remove(basefile)
+	os.Remove(filename)
+}
+
+func Test_amend_data_file_raw(t *testing.T) {
+	var filename = "/tmp/amend_datafile.qcow2"
+	var datafile = "/tmp/amend_datafile.raw"
+	os.Remove(datafile)
+	root := prepare_amend_image(t, filename, map[string]any{OPT_DATAFILE: datafile})
+	_, err := Blk_Pwrite(root, 65536, []byte("data"), 4, 0)
+	assert.Nil(t, err)
+
+	err = Blk_Amend(root, map[string]any{OPT_DATAFILE_RAW: false})
+	assert.Nil(t, err)
+	assert.False(t, data_file_is_raw(root.bs))
+	err = Blk_Amend(root, map[string]any{OPT_DATAFILE_RAW: true})
+	assert.Nil(t, err)
+	Blk_Close(root)
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, 0)
+	assert.Nil(t, err)
+	assert.True(t, data_file_is_raw(root.bs))
+	Blk_Close(root)
+
+	//the data file reads like the guest disk
+	raw, err := os.ReadFile(datafile)
+	assert.Nil(t, err)
+	assert.Equal(t, 4*1024*1024, len(raw))
+	assert.Equal(t, "data", string(raw[65536:65540]))
+	os.Remove(filename)
+	os.Remove(datafile)
+}
+
+func Test_amend_invalid(t *testing.T) {
+	var filename = "/tmp/amend_invalid.qcow2"
+	var basefile = "/tmp/amend_invalid_base.qcow2"
+	base := prepare_amend_image(t, basefile, nil)
+	Blk_Close(base)
+	root := prepare_amend_image(t, filename, nil)
+	s := root.bs.opaque.(*BDRVQcow2State)
+
+	//every combination is refused before anything is changed
+	for _, options := range []map[string]any{
+		{OPT_REFCOUNT_BITS: 8, OPT_COMPAT: "0.10"},
+		{OPT_BACKING: basefile, OPT_REFCOUNT_BITS: 8, OPT_DATAFILE_RAW: true},
+		{OPT_REFCOUNT_BITS: 64, OPT_BACKING: "", OPT_BACKING_FMT: "qcow2"},
+	} {
+		err := Blk_Amend(root, options)
+		assert.NotNil(t, err, "%v", options)
+		assert.Equal(t, uint32(16), s.RefcountBits)
+		assert.Equal(t, QCOW2_VERSION3, s.QcowVersion)
+		assert.Equal(t, "", root.bs.backingFile)
+	}
+	Blk_Close(root)
+
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(QCOW2_VERSION3), root.bs.current.header.Version)
+	assert.Equal(t, uint32(QCOW2_REFCOUNT_ORDER), root.bs.current.header.RefcountOrder)
+	assert.Equal(t, uint64(0), root.bs.current.header.BackingFileOffset)
+	Blk_Close(root)
+	os.Remove(basefile)
+	os.Remove(filename)
+}
@@ -22,6 +22,7 @@ SOFTWARE.
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"math"
 	"os"
 	"unsafe"
@@ -59,36 +60,136 @@ func Blk_Probe(filename string) (string, error) {
 }
 
 /* this function return root BdrvChild
-* default cache model is 'writeback',
-* to use cache model 'none', set flags |= (BDRV_O_NOCACHE|BDRV_REQ_FUA)
+* default cache model is 'writeback', the others can be chosen by OPT_CACHE,
+* or by the flags returned by Blk_Parse_Cache_Mode:
+* to use cache model 'none', set flags |= BDRV_O_NOCACHE
 * to use cache model 'writethrough', set flags |= BDRV_REQ_FUA
+* to use cache model 'directsync', set flags |= (BDRV_O_NOCACHE|BDRV_REQ_FUA)
+* to use cache model 'unsafe', set flags |= BDRV_O_NO_FLUSH
+* the file I/O is synchronous unless OPT_AIO or flags |= BDRV_O_IO_URING
+* selects io_uring
+* the writes of zeroed buffers are written as zeroes with OPT_DETECT_ZEROES,
+* detect-zeroes=unmap requires flags |= BDRV_O_UNMAP
  */
 func Blk_Open(filename string, options map[string]any, flags int) (*BdrvChild, error) {
 
 	var child *BdrvChild
 	var err error
 	var format string
+	var detectZeroes int
 
 	if val, ok := options[OPT_FMT]; !ok {
 		return nil, Err_IncompleteParameters
 	} else {
 		format = val.(string)
 	}
+	if val, ok := options[OPT_CACHE]; ok {
+		var cacheFlags int
+		if cacheFlags, err = Blk_Parse_Cache_Mode(val.(string)); err != nil {
+			return nil, err
+		}
+		flags = flags&^(BDRV_O_CACHE_MASK|BDRV_REQ_FUA) | cacheFlags
+	}
+	if val, ok := options[OPT_AIO]; ok {
+		var aioFlags int
+		if aioFlags, err = Blk_Parse_Aio(val.(string)); err != nil {
+			return nil, err
+		}
+		flags = flags&^(BDRV_O_NATIVE_AIO|BDRV_O_IO_URING) | aioFlags
+	}
+	if val, ok := options[OPT_DETECT_ZEROES]; ok {
+		if detectZeroes, err = Blk_Parse_Detect_Zeroes(val.(string)); err != nil {
+			return nil, err
+		}
+		if detectZeroes == BDRV_DETECT_ZEROES_UNMAP && flags&BDRV_O_UNMAP == 0 {
+			return nil, Err_DetectZeroesUnmap
+		}
+	}
 
 	if child, err = bdrv_open_child(filename, format, options, flags); err != nil {
 		return nil, err
 	} else {
 		bdrv_set_perm(child, PERM_ALL)
+		child.bs.DetectZeroes = detectZeroes
 	}
 
 	return child, err
 }
 
-func Blk_Close(child *BdrvChild) {
-	if child == nil || child.bs == nil {
-		return
+/*
+ * Translate a cache mode into the open flags:
+ * writeback - the host page cache is used, data is durable after a flush
+ * writethrough - the host page cache is used, every write is durable
+ * none - the host page cache is bypassed (O_DIRECT), data is durable after a flush
+ * directsync - the host page cache is bypassed, every write is durable
+ * unsafe - the host page cache is used, flushes are ignored
+ */
+func Blk_Parse_Cache_Mode(mode string) (int, error) {
+	switch mode {
+	case "writeback", "":
+		return 0, nil
+	case "writethrough":
+		return BDRV_REQ_FUA, nil
+	case "none", "off":
+		return BDRV_O_NOCACHE, nil
+	case "directsync":
+		return BDRV_O_NOCACHE | BDRV_REQ_FUA, nil
+	case "unsafe":
+		return BDRV_O_NO_FLUSH, nil
+	}
+	return 0, fmt.Errorf("invalid cache mode: %s", mode)
+}
+
+/*
+ * Translate an aio mode into the open flags:
+ * threads - synchronous positional I/O from the calling goroutines
+ * io_uring - the file I/O is submitted to an io_uring, falls back to
+ *            threads where io_uring isn't available
+ */
+func Blk_Parse_Aio(mode string) (int, error) {
+	switch mode {
+	case "threads", "":
+		return 0, nil
+	case "io_uring":
+		return BDRV_O_IO_URING, nil
+	}
+	return 0, fmt.Errorf("invalid aio mode: %s", mode)
+}
+
+/*
+ * Translate a detect-zeroes mode:
+ * off - the zeroed buffers are written as they are
+ * on - the writes of zeroed buffers are turned into zero writes
+ * unmap - the zero writes may deallocate the range as well
+ */
+func Blk_Parse_Detect_Zeroes(mode string) (int, error) {
+	switch mode {
+	case "off", "":
+		return BDRV_DETECT_ZEROES_OFF, nil
+	case "on":
+		return BDRV_DETECT_ZEROES_ON, nil
+	case "unmap":
+		return BDRV_DETECT_ZEROES_UNMAP, nil
+	}
+	return 0, fmt.Errorf("invalid detect-zeroes mode: %s", mode)
+}
+
+/*
+ * Set the memory shared by the L2 and refcount block caches of all the open
+ * qcow2 images, the least recently used tables of any image are dropped
+ * beyond it. The tables in use are never dropped, so it may be exceeded
+ * briefly by the requests in flight
+ */
+func Blk_Set_Cache_Budget(bytes uint64) {
+	qcow2_cache_manager_set_budget(bytes)
+}
+
+// the image is closed even if its last flush fails, the error is returned
+func Blk_Close(child *BdrvChild) error {
+	if child == nil || child.GetBS() == nil {
+		return nil
 	}
-	bdrv_close(child.bs)
+	return bdrv_close(child.GetBS())
 }
 
 func Blk_Pread(root *BdrvChild, offset uint64, buf []uint8, bytes uint64) (uint64, error) {
@@ -136,7 +237,7 @@ func Blk_Pwrite(root *BdrvChild, offset uint64, buf []uint8,
 	bytes uint64, flags BdrvRequestFlags) (uint64, error) {
 
 	Assert(root != nil)
-	bs := root.bs
+	bs := root.GetBS()
 	var qiov QEMUIOVector
 	var err error
 	if root == nil {
@@ -156,7 +257,7 @@ func Blk_Pwrite_Zeroes(root *BdrvChild, offset uint64,
 	bytes uint64, flags BdrvRequestFlags) (uint64, error) {
 
 	Assert(root != nil)
-	bs := root.bs
+	bs := root.GetBS()
 	var qiov QEMUIOVector
 	var err error
 	if root == nil {
@@ -165,6 +266,9 @@ func Blk_Pwrite_Zeroes(root *BdrvChild, offset uint64,
 	if (bs.OpenFlags & BDRV_REQ_FUA) > 0 {
 		flags |= BDRV_REQ_FUA
 	}
+	if bs.OpenFlags&BDRV_O_UNMAP == 0 {
+		flags &= ^BDRV_REQ_MAY_UNMAP
+	}
 	qemu_iovec_init_buf(&qiov, nil, bytes)
 	if err = bdrv_pwritev_part(root, offset, bytes, &qiov, 0, flags|BDRV_REQ_ZERO_WRITE); err != nil {
 		return 0, err
@@ -172,6 +276,28 @@ func Blk_Pwrite_Zeroes(root *BdrvChild, offset uint64,
 	return bytes, nil
 }
 
+/*
+ * Copy bytes of src at srcOffset to dst at dstOffset with copy_file_range,
+ * where both of them keep their data in files on the same file system.
+ * ERR_ENOTSUP where it can't be done that way, the caller reads and writes
+ * the data instead
+ */
+func Blk_Copy_Range(src *BdrvChild, srcOffset uint64, dst *BdrvChild, dstOffset uint64, bytes uint64) error {
+
+	var err error
+	if src == nil || src.bs == nil || dst == nil || dst.bs == nil {
+		return Err_NullObject
+	}
+	if err = bdrv_copy_range(src, srcOffset, dst, dstOffset, bytes, 0, 0); err != nil {
+		return err
+	}
+	//the copy is as durable as a write once flushed
+	if dst.bs.OpenFlags&BDRV_REQ_FUA > 0 {
+		return bdrv_flush(dst.bs)
+	}
+	return nil
+}
+
 // Write the object to the file in the bigendian manner, return -1 if error occurs
 func Blk_Pwrite_Object(child *BdrvChild, offset uint64, object any, size uint64) (uint64, error) {
 
@@ -198,7 +324,7 @@ func Blk_Pwrite_Object(child *BdrvChild, offset uint64, object any, size uint64)
 */
 func Blk_Getlength(child *BdrvChild) (uint64, error) {
 
-	bs := child.bs
+	bs := child.GetBS()
 	//equal to has_variable_length
 	if bs.Drv != nil && bs.Drv.bdrv_getlength != nil {
 		return bs.Drv.bdrv_getlength(bs)
@@ -216,14 +342,36 @@ func Blk_Discard(child *BdrvChild, offset uint64, bytes uint64) error {
 
 func Blk_Flush(child *BdrvChild) error {
 	Assert(child != nil)
-	return bdrv_flush(child.bs)
+	return bdrv_flush(child.GetBS())
 }
 
 func Blk_Info(child *BdrvChild, detail bool, pretty bool) string {
-	bs := child.bs
+	bs := child.GetBS()
 	return bs.Info(detail, pretty)
 }
 
+/*
+ * Measure the host space a new image needs, options are the create options of
+ * the new image with OPT_FMT as its format. If src is not nil, the new image
+ * holds the content of src and the virtual size defaults to the size of src.
+ */
+func Blk_Measure(src *BdrvChild, options map[string]any) (*BlockMeasureInfo, error) {
+
+	var in *BlockDriverState
+	format := TYPE_QCOW2_NAME
+	if val, ok := options[OPT_FMT]; ok {
+		format = val.(string)
+	}
+	drv := get_driver(format)
+	if drv == nil || drv.bdrv_measure == nil {
+		return nil, Err_NoDriverFound
+	}
+	if src != nil {
+		in = src.bs
+	}
+	return drv.bdrv_measure(options, in)
+}
+
 func get_driver(fmt string) *BlockDriver {
 	switch fmt {
 	case "raw":
@@ -1,8 +1,12 @@
 package qcow2
 
 import (
+	"bytes"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -45,13 +49,13 @@ func Test_block_simple(t *testing.T) {
 	//check cache
 	cluster1Ref, err := qcow2_get_refcount(bs, 0)
 	assert.Nil(t, err)
-	assert.Equal(t, cluster1Ref, uint16(1))
+	assert.Equal(t, cluster1Ref, uint64(1))
 	cluster4Ref, err := qcow2_get_refcount(bs, 3)
 	assert.Nil(t, err)
-	assert.Equal(t, cluster4Ref, uint16(1))
+	assert.Equal(t, cluster4Ref, uint64(1))
 	cluster5Ref, err := qcow2_get_refcount(bs, 4)
 	assert.Nil(t, err)
-	assert.Equal(t, cluster5Ref, uint16(0))
+	assert.Equal(t, cluster5Ref, uint64(0))
 	Blk_Close(root)
 
 }
@@ -417,3 +421,322 @@ func Test_data_file(t *testing.T) {
 	os.Remove(filename)
 	os.Remove(datafile)
 }
+
+func Test_block_cache_modes(t *testing.T) {
+	var filename = "/tmp/cache_modes.qcow2"
+	data := []byte("written through all the cache modes")
+
+	_, err := Blk_Parse_Cache_Mode("sometimes")
+	assert.NotNil(t, err)
+
+	for _, mode := range []string{"writeback", "writethrough", "none", "directsync", "unsafe"} {
+		os.Remove(filename)
+		err = Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 4 * 1024 * 1024})
+		assert.Nil(t, err)
+		root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_CACHE: mode}, BDRV_O_RDWR)
+		assert.Nil(t, err)
+		cacheFlags, _ := Blk_Parse_Cache_Mode(mode)
+		assert.Equal(t, cacheFlags, root.bs.OpenFlags&(BDRV_O_CACHE_MASK|BDRV_REQ_FUA))
+
+		file := root.bs.current.bs
+		//the O_DSYNC descriptor waits for the first FUA write
+		assert.Nil(t, file.opaque.(*BDRVRawState).DsyncFile)
+		if cacheFlags&BDRV_O_NOCACHE > 0 {
+			assert.Equal(t, uint32(DIRECT_IO_ALIGNMENT), file.RequestAlignment)
+			assert.Equal(t, uint64(DIRECT_IO_ALIGNMENT), bdrv_opt_mem_align(root.bs))
+		} else {
+			assert.Equal(t, uint32(DEFAULT_ALIGNMENT), file.RequestAlignment)
+		}
+
+		//misaligned offsets, lengths and buffers
+		buf := make([]byte, len(data)+1)
+		copy(buf[1:], data)
+		_, err = Blk_Pwrite(root, 1000, buf[1:], uint64(len(data)), 0)
+		assert.Nil(t, err)
+		_, err = Blk_Pwrite(root, 3*65536-7, buf[1:], uint64(len(data)), BDRV_REQ_FUA)
+		assert.Nil(t, err)
+		err = Blk_Flush(root)
+		assert.Nil(t, err)
+		Blk_Close(root)
+
+		root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_CACHE: mode}, 0)
+		assert.Nil(t, err)
+		_, err = Blk_Pread(root, 1000, buf[1:], uint64(len(data)))
+		assert.Nil(t, err)
+		assert.Equal(t, data, buf[1:])
+		_, err = Blk_Pread(root, 3*65536-7, buf[1:], uint64(len(data)))
+		assert.Nil(t, err)
+		assert.Equal(t, data, buf[1:])
+		Blk_Close(root)
+	}
+	os.Remove(filename)
+}
+
+func Test_block_io_uring(t *testing.T) {
+	var filename = "/tmp/io_uring.qcow2"
+	data := []byte("submitted to the io_uring")
+
+	_, err := Blk_Parse_Aio("native")
+	assert.NotNil(t, err)
+
+	for _, cache := range []string{"writeback", "none"} {
+		os.Remove(filename)
+		err = Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 4 * 1024 * 1024})
+		assert.Nil(t, err)
+		root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_CACHE: cache, OPT_AIO: "io_uring"}, BDRV_O_RDWR)
+		assert.Nil(t, err)
+		assert.Equal(t, BDRV_O_IO_URING, root.bs.OpenFlags&BDRV_O_IO_URING)
+
+		_, err = Blk_Pwrite(root, 1000, data, uint64(len(data)), 0)
+		assert.Nil(t, err)
+		_, err = Blk_Pwrite(root, 2*65536+3, data, uint64(len(data)), BDRV_REQ_FUA)
+		assert.Nil(t, err)
+		err = Blk_Flush(root)
+		assert.Nil(t, err)
+		Blk_Close(root)
+
+		root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_CACHE: cache, OPT_AIO: "io_uring"}, 0)
+		assert.Nil(t, err)
+		buf := make([]byte, len(data))
+		_, err = Blk_Pread(root, 1000, buf, uint64(len(buf)))
+		assert.Nil(t, err)
+		assert.Equal(t, data, buf)
+		_, err = Blk_Pread(root, 2*65536+3, buf, uint64(len(buf)))
+		assert.Nil(t, err)
+		assert.Equal(t, data, buf)
+		//beyond the end of the file reads as zeroes
+		_, err = Blk_Pread(root, 3*1024*1024, buf, uint64(len(buf)))
+		assert.Nil(t, err)
+		assert.Equal(t, make([]byte, len(buf)), buf)
+		Blk_Close(root)
+	}
+	os.Remove(filename)
+}
+
+func Test_block_serialising_writes(t *testing.T) {
+	var filename = "/tmp/serialising.raw"
+	os.Remove(filename)
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "raw", OPT_SIZE: 65536})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+
+	//a serialising request in flight on the first sector
+	var req BdrvTrackedRequest
+	tracked_request_begin(&req, root.bs, 100, 10)
+	bdrv_make_request_serialising(&req, 512)
+	assert.Equal(t, uint64(0), req.overlapOffset)
+	assert.Equal(t, uint64(512), req.overlapBytes)
+
+	write := func(offset uint64) chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := Blk_Pwrite(root, offset, []byte{1, 2, 3}, 3, 0)
+			done <- err
+		}()
+		return done
+	}
+
+	//other sectors go ahead
+	select {
+	case err = <-write(2048 + 7):
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("a write to another sector was held back")
+	}
+
+	//the same sector waits for the request to complete
+	blocked := write(300)
+	select {
+	case <-blocked:
+		t.Fatal("an overlapping write didn't wait")
+	case <-time.After(100 * time.Millisecond):
+	}
+	tracked_request_end(&req)
+	assert.Nil(t, <-blocked)
+
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_block_unaligned_writes_stress(t *testing.T) {
+	var filename = "/tmp/unaligned_stress.raw"
+	const writers = 16
+	const sectors = 2048
+	os.Remove(filename)
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "raw", OPT_SIZE: sectors * 512})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+
+	//every writer owns a few bytes of each sector and writes them once,
+	//each write is a read-modify-write of the whole sector
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := []byte{byte(i + 1), byte(i + 1)}
+			for s := 0; s < sectors; s++ {
+				Blk_Pwrite(root, uint64(s*512+i*2), data, 2, 0)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	buf := make([]byte, sectors*512)
+	_, err = Blk_Pread(root, 0, buf, uint64(len(buf)))
+	assert.Nil(t, err)
+	for s := 0; s < sectors; s++ {
+		for i := 0; i < writers; i++ {
+			assert.Equal(t, []byte{byte(i + 1), byte(i + 1)}, buf[s*512+i*2:s*512+i*2+2])
+		}
+	}
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_block_zero_writes_stress(t *testing.T) {
+	var filename = "/tmp/zero_writes_stress.raw"
+	const chunk = 65536
+	const chunks = 128
+	const rounds = 4
+	os.Remove(filename)
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "raw", OPT_SIZE: chunks * chunk})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+
+	//an aligned zero write waits for a serialising request on its sector
+	var req BdrvTrackedRequest
+	tracked_request_begin(&req, root.bs, 100, 10)
+	bdrv_make_request_serialising(&req, 512)
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := Blk_Pwrite_Zeroes(root, 0, 512, 0)
+		blocked <- err
+	}()
+	select {
+	case <-blocked:
+		t.Fatal("an overlapping zero write didn't wait")
+	case <-time.After(100 * time.Millisecond):
+	}
+	tracked_request_end(&req)
+	assert.Nil(t, <-blocked)
+
+	//the first and the last sector of each chunk are zeroed while the chunk
+	//is written but for a few bytes of them. the read-modify-write of those
+	//sectors must not bring back their old content
+	ones := bytes.Repeat([]byte{0xff}, chunks*chunk)
+	data := bytes.Repeat([]byte{0xaa}, chunk-200)
+	for r := 0; r < rounds; r++ {
+		_, err = Blk_Pwrite(root, 0, ones, uint64(len(ones)), 0)
+		assert.Nil(t, err)
+		var wg sync.WaitGroup
+		for c := 0; c < chunks; c++ {
+			var written atomic.Bool
+			wg.Add(2)
+			go func(c int) {
+				defer wg.Done()
+				Blk_Pwrite(root, uint64(c*chunk+100), data, uint64(len(data)), 0)
+				written.Store(true)
+			}(c)
+			go func(c int) {
+				defer wg.Done()
+				//at least once, and until the write is done
+				for zeroed := false; !zeroed || !written.Load(); zeroed = true {
+					Blk_Pwrite_Zeroes(root, uint64(c*chunk), 512, 0)
+					Blk_Pwrite_Zeroes(root, uint64(c*chunk+chunk-512), 512, 0)
+				}
+			}(c)
+		}
+		wg.Wait()
+
+		buf := make([]byte, chunks*chunk)
+		_, err = Blk_Pread(root, 0, buf, uint64(len(buf)))
+		assert.Nil(t, err)
+		for c := 0; c < chunks; c++ {
+			if !buffer_is_zero(buf[c*chunk:], 100) || !buffer_is_zero(buf[c*chunk+chunk-100:], 100) {
+				t.Fatalf("round %d: chunk %d has old data around the write", r, c)
+			}
+		}
+	}
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_block_detect_zeroes(t *testing.T) {
+	var filename = "/tmp/test_detect_zeroes.qcow2"
+	os.Remove(filename)
+
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 1048576, OPT_SUBCLUSTER: true})
+	assert.Nil(t, err)
+	_, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_DETECT_ZEROES: "yes"}, BDRV_O_RDWR)
+	assert.NotNil(t, err)
+	_, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_DETECT_ZEROES: "unmap"}, BDRV_O_RDWR)
+	assert.Equal(t, Err_DetectZeroesUnmap, err)
+
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_DETECT_ZEROES: "on"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	bs := root.bs
+	s := bs.opaque.(*BDRVQcow2State)
+	scType := func(offset uint64) QCow2SubclusterType {
+		var bytes uint32 = uint32(s.SubclusterSize)
+		var host uint64
+		var scType QCow2SubclusterType
+		err := qcow2_get_host_offset(bs, offset, &bytes, &host, &scType)
+		assert.Nil(t, err)
+		return scType
+	}
+	data := bytes.Repeat([]byte{0x5a}, 2*65536)
+	_, err = Blk_Pwrite(root, 0, data, uint64(len(data)), 0)
+	assert.Nil(t, err)
+	fileLength, err := Blk_Getlength(bs.current)
+	assert.Nil(t, err)
+
+	//a zeroed cluster is kept allocated as zeroes
+	zeroes := make([]byte, 65536)
+	_, err = Blk_Pwrite(root, 0, zeroes, 65536, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, QCow2SubclusterType(QCOW2_SUBCLUSTER_ZERO_ALLOC), scType(0))
+
+	//only the subclusters covered as a whole turn into zeroes
+	_, err = Blk_Pwrite(root, 65536+1000, zeroes, 8192, 0)
+	assert.Nil(t, err)
+	copy(data[65536+1000:], zeroes[:8192])
+	assert.Equal(t, QCow2SubclusterType(QCOW2_SUBCLUSTER_NORMAL), scType(65536))
+	for offset := 65536 + s.SubclusterSize; offset < 65536+4*s.SubclusterSize; offset += s.SubclusterSize {
+		assert.Equal(t, QCow2SubclusterType(QCOW2_SUBCLUSTER_ZERO_ALLOC), scType(offset))
+	}
+	assert.Equal(t, QCow2SubclusterType(QCOW2_SUBCLUSTER_NORMAL), scType(65536+4*s.SubclusterSize))
+
+	//an unallocated cluster isn't allocated by zeroes
+	_, err = Blk_Pwrite(root, 4*65536, zeroes, 65536, 0)
+	assert.Nil(t, err)
+	assert.NotEqual(t, QCow2SubclusterType(QCOW2_SUBCLUSTER_NORMAL), scType(4*65536))
+	length, err := Blk_Getlength(bs.current)
+	assert.Nil(t, err)
+	assert.Equal(t, fileLength, length)
+
+	buf := make([]byte, 2*65536)
+	_, err = Blk_Pread(root, 0, buf, uint64(len(buf)))
+	assert.Nil(t, err)
+	assert.True(t, buffer_is_zero(buf, 65536))
+	assert.Equal(t, data[65536:], buf[65536:])
+	Blk_Close(root)
+
+	//with unmap the zeroed cluster is deallocated
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_DETECT_ZEROES: "unmap"},
+		BDRV_O_RDWR|BDRV_O_UNMAP)
+	assert.Nil(t, err)
+	bs = root.bs
+	s = bs.opaque.(*BDRVQcow2State)
+	_, err = Blk_Pwrite(root, 65536, zeroes, 65536, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, QCow2SubclusterType(QCOW2_SUBCLUSTER_ZERO_PLAIN), scType(65536))
+	_, err = Blk_Pread(root, 0, buf, uint64(len(buf)))
+	assert.Nil(t, err)
+	assert.True(t, buffer_is_zero(buf, uint64(len(buf))))
+	Blk_Close(root)
+	os.Remove(filename)
+}
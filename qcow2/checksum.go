@@ -0,0 +1,118 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"unsafe"
+)
+
+/*
+ * Compute a checksum of the guest content which doesn't depend on the format,
+ * the layout or the backing chain of the image.
+ * The content is split into chunks of CHECKSUM_CHUNK_SIZE bytes, the last one
+ * may be shorter, and each chunk is hashed with sha256. The result is the hex
+ * encoded sha256 of all the chunk digests in order. Chunks reading as zeroes
+ * are not read, the digest of a zero chunk is computed once.
+ */
+func Blk_Checksum(child *BdrvChild, workers int) (string, error) {
+
+	var err error
+	var size, offset uint64
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+
+	if child == nil || child.bs == nil {
+		return "", Err_NullObject
+	}
+	if workers <= 0 {
+		workers = DEFAULT_CHECKSUM_WORKERS
+	}
+	if size, err = Blk_Getlength(child); err != nil {
+		return "", err
+	}
+
+	zeroDigest := sha256.Sum256(make([]byte, CHECKSUM_CHUNK_SIZE))
+	digests := make([][sha256.Size]byte, CHECKSUM_CHUNKS_PER_BATCH)
+	buffers := make([][]byte, workers)
+	for i := range buffers {
+		buffers[i] = make([]byte, CHECKSUM_CHUNK_SIZE)
+	}
+	result := sha256.New()
+
+	//hash a batch of chunks in parallel, then fold the digests in order
+	for offset < size {
+		batch := min((size-offset+CHECKSUM_CHUNK_SIZE-1)/CHECKSUM_CHUNK_SIZE, CHECKSUM_CHUNKS_PER_BATCH)
+		next := make(chan uint64, batch)
+		for i := uint64(0); i < batch; i++ {
+			next <- i
+		}
+		close(next)
+
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(buf []byte) {
+				defer wg.Done()
+				for i := range next {
+					start := offset + i*CHECKSUM_CHUNK_SIZE
+					bytes := min(CHECKSUM_CHUNK_SIZE, size-start)
+					if e := checksum_chunk(child, start, bytes, buf, &zeroDigest, &digests[i]); e != nil {
+						errLock.Lock()
+						if err == nil {
+							err = e
+						}
+						errLock.Unlock()
+					}
+				}
+			}(buffers[w])
+		}
+		wg.Wait()
+		if err != nil {
+			return "", err
+		}
+		for i := uint64(0); i < batch; i++ {
+			result.Write(digests[i][:])
+		}
+		offset += batch * CHECKSUM_CHUNK_SIZE
+	}
+	return hex.EncodeToString(result.Sum(nil)), nil
+}
+
+func checksum_chunk(child *BdrvChild, offset uint64, bytes uint64, buf []byte,
+	zeroDigest *[sha256.Size]byte, digest *[sha256.Size]byte) error {
+
+	zero, err := bdrv_is_zero_fast(child.bs, offset, bytes)
+	if err != nil {
+		return err
+	}
+	if zero && bytes == CHECKSUM_CHUNK_SIZE {
+		*digest = *zeroDigest
+		return nil
+	}
+	if zero {
+		memset(unsafe.Pointer(&buf[0]), int(bytes))
+	} else if _, err = Blk_Pread(child, offset, buf, bytes); err != nil {
+		return err
+	}
+	*digest = sha256.Sum256(buf[:bytes])
+	return nil
+}
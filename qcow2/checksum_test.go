@@ -0,0 +1,70 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_checksum(t *testing.T) {
+	var err error
+	var rawfile = "/tmp/checksum.raw"
+	var basefile = "/tmp/checksum_base.qcow2"
+	var overlayfile = "/tmp/checksum_overlay.qcow2"
+	//not a multiple of the chunk size
+	var size = uint64(5*1024*1024 + 65536)
+	os.Remove(rawfile)
+	os.Remove(basefile)
+	os.Remove(overlayfile)
+
+	data := bytes.Repeat([]byte("checksum"), 8192)
+
+	//all data in the raw file
+	err = Blk_Create(rawfile, map[string]any{OPT_FMT: "raw", OPT_SIZE: size})
+	assert.Nil(t, err)
+	raw, err := Blk_Open(rawfile, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(raw, 0, data, uint64(len(data)), 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(raw, 5*1024*1024, data, 65536, 0)
+	assert.Nil(t, err)
+
+	//the same content spread over a backing chain
+	err = Blk_Create(basefile, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	base, err := Blk_Open(basefile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(base, 0, data, uint64(len(data)), 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(base, 3*1024*1024, data, uint64(len(data)), 0)
+	assert.Nil(t, err)
+	Blk_Close(base)
+	err = Blk_Create(overlayfile, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size, OPT_BACKING: basefile})
+	assert.Nil(t, err)
+	overlay, err := Blk_Open(overlayfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite_Zeroes(overlay, 3*1024*1024, uint64(len(data)), 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(overlay, 5*1024*1024, data, 65536, 0)
+	assert.Nil(t, err)
+
+	sum1, err := Blk_Checksum(raw, 3)
+	assert.Nil(t, err)
+	sum2, err := Blk_Checksum(overlay, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, sum1, sum2)
+
+	_, err = Blk_Pwrite(overlay, size-1, []byte{1}, 1, 0)
+	assert.Nil(t, err)
+	sum2, err = Blk_Checksum(overlay, 0)
+	assert.Nil(t, err)
+	assert.NotEqual(t, sum1, sum2)
+
+	Blk_Close(raw)
+	Blk_Close(overlay)
+	os.Remove(rawfile)
+	os.Remove(basefile)
+	os.Remove(overlayfile)
+}
@@ -0,0 +1,133 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ * Compare the guest content of two images, ranges that read as zeroes on both
+ * sides are skipped without reading them.
+ * It returns whether the images are identical and, if not, the offset of the
+ * first difference. If the sizes differ, the extra area of the larger image
+ * must read as zeroes. In strict mode a difference of the sizes or of the
+ * allocation state is a mismatch as well.
+ */
+func Blk_Compare(a *BdrvChild, b *BdrvChild, strict bool) (uint64, bool, error) {
+
+	var err error
+	var sizeA, sizeB, size, offset, bytes uint64
+	var pnumA, pnumB uint64
+	var retA, retB uint64
+	var bufA, bufB []byte
+	var pos uint64
+	var same bool
+
+	if a == nil || a.bs == nil || b == nil || b.bs == nil {
+		return 0, false, Err_NullObject
+	}
+	if sizeA, err = Blk_Getlength(a); err != nil {
+		return 0, false, err
+	}
+	if sizeB, err = Blk_Getlength(b); err != nil {
+		return 0, false, err
+	}
+	size = min(sizeA, sizeB)
+	if strict && sizeA != sizeB {
+		return size, false, nil
+	}
+
+	bufA = make([]byte, COMPARE_BUFFER_SIZE)
+	bufB = make([]byte, COMPARE_BUFFER_SIZE)
+
+	for offset < size {
+		bytes = min(size-offset, COMPARE_BUFFER_SIZE)
+		if retA, err = bdrv_block_status_above(a.bs, nil, offset, bytes, &pnumA, nil, nil); err != nil {
+			return 0, false, err
+		}
+		if retB, err = bdrv_block_status_above(b.bs, nil, offset, bytes, &pnumB, nil, nil); err != nil {
+			return 0, false, err
+		}
+		bytes = min(pnumA, pnumB)
+		if bytes == 0 {
+			break
+		}
+		if strict && retA&BDRV_BLOCK_ALLOCATED != retB&BDRV_BLOCK_ALLOCATED {
+			return offset, false, nil
+		}
+		if retA&BDRV_BLOCK_ZERO == 0 || retB&BDRV_BLOCK_ZERO == 0 {
+			if _, err = Blk_Pread(a, offset, bufA, bytes); err != nil {
+				return 0, false, err
+			}
+			if _, err = Blk_Pread(b, offset, bufB, bytes); err != nil {
+				return 0, false, err
+			}
+			if pos, same = compare_buffers(bufA, bufB, bytes); !same {
+				return offset + pos, false, nil
+			}
+		}
+		offset += bytes
+	}
+
+	//the rest of the larger image must read as zeroes
+	if sizeA > sizeB {
+		return compare_to_zero(a, size, sizeA, bufA)
+	} else if sizeB > sizeA {
+		return compare_to_zero(b, size, sizeB, bufB)
+	}
+	return 0, true, nil
+}
+
+// return the position of the first different byte
+func compare_buffers(a []byte, b []byte, bytes uint64) (uint64, bool) {
+	for i := uint64(0); i < bytes; i++ {
+		if a[i] != b[i] {
+			return i, false
+		}
+	}
+	return 0, true
+}
+
+func compare_to_zero(child *BdrvChild, offset uint64, end uint64, buf []byte) (uint64, bool, error) {
+
+	var err error
+	var ret, pnum uint64
+
+	for offset < end {
+		if ret, err = bdrv_block_status_above(child.bs, nil, offset,
+			min(end-offset, uint64(len(buf))), &pnum, nil, nil); err != nil {
+			return 0, false, err
+		}
+		if pnum == 0 {
+			break
+		}
+		if ret&BDRV_BLOCK_ZERO == 0 {
+			if _, err = Blk_Pread(child, offset, buf, pnum); err != nil {
+				return 0, false, err
+			}
+			if !buffer_is_zero(buf, pnum) {
+				for i := uint64(0); i < pnum; i++ {
+					if buf[i] != 0 {
+						return offset + i, false, nil
+					}
+				}
+			}
+		}
+		offset += pnum
+	}
+	return 0, true, nil
+}
@@ -0,0 +1,96 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_compare(t *testing.T) {
+	var err error
+	var rawfile = "/tmp/compare.raw"
+	var qcow2file = "/tmp/compare.qcow2"
+	var size = uint64(4 * 1024 * 1024)
+	os.Remove(rawfile)
+	os.Remove(qcow2file)
+
+	err = Blk_Create(rawfile, map[string]any{OPT_FMT: "raw", OPT_SIZE: size})
+	assert.Nil(t, err)
+	raw, err := Blk_Open(rawfile, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	err = Blk_Create(qcow2file, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	img, err := Blk_Open(qcow2file, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+
+	data := bytes.Repeat([]byte("compare"), 10000)
+	for _, root := range []*BdrvChild{raw, img} {
+		_, err = Blk_Pwrite(root, 1024*1024, data, uint64(len(data)), 0)
+		assert.Nil(t, err)
+	}
+
+	//same content, different layout
+	_, same, err := Blk_Compare(raw, img, false)
+	assert.Nil(t, err)
+	assert.True(t, same)
+
+	//every byte of a raw file is allocated
+	offset, same, err := Blk_Compare(raw, img, true)
+	assert.Nil(t, err)
+	assert.False(t, same)
+	assert.Equal(t, uint64(0), offset)
+
+	_, err = Blk_Pwrite(img, 1024*1024+5000, []byte("x"), 1, 0)
+	assert.Nil(t, err)
+	offset, same, err = Blk_Compare(raw, img, false)
+	assert.Nil(t, err)
+	assert.False(t, same)
+	assert.Equal(t, uint64(1024*1024+5000), offset)
+
+	Blk_Close(raw)
+	Blk_Close(img)
+	os.Remove(rawfile)
+	os.Remove(qcow2file)
+}
+
+func Test_compare_size(t *testing.T) {
+	var err error
+	var small = "/tmp/compare_small.qcow2"
+	var large = "/tmp/compare_large.qcow2"
+	os.Remove(small)
+	os.Remove(large)
+
+	err = Blk_Create(small, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 1024 * 1024})
+	assert.Nil(t, err)
+	err = Blk_Create(large, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 2 * 1024 * 1024})
+	assert.Nil(t, err)
+	a, err := Blk_Open(small, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	b, err := Blk_Open(large, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+
+	//the extra area reads as zeroes, even if it is allocated
+	_, err = Blk_Pwrite(b, 1536*1024, make([]byte, 512), 512, 0)
+	assert.Nil(t, err)
+	_, same, err := Blk_Compare(a, b, false)
+	assert.Nil(t, err)
+	assert.True(t, same)
+
+	_, same, err = Blk_Compare(a, b, true)
+	assert.Nil(t, err)
+	assert.False(t, same)
+
+	_, err = Blk_Pwrite(b, 1536*1024+100, []byte("tail"), 4, 0)
+	assert.Nil(t, err)
+	offset, same, err := Blk_Compare(a, b, false)
+	assert.Nil(t, err)
+	assert.False(t, same)
+	assert.Equal(t, uint64(1536*1024+100), offset)
+
+	Blk_Close(a)
+	Blk_Close(b)
+	os.Remove(small)
+	os.Remove(large)
+}
@@ -50,11 +50,33 @@ const (
 	QCOW2_VERSION2                  = 2
 	QCOW2_VERSION3                  = 3
 	QCOW2_REFCOUNT_ORDER            = 4
+	QCOW2_MAX_REFCOUNT_ORDER        = 6
+	MIN_CLUSTER_BITS                = 9
+	MAX_CLUSTER_BITS                = 21
 	QCOW2_CRYPT_METHOD              = 0
 	//	DEFAULT_ALIGNMENT               = 4096    //align to 4k
 	DEFAULT_ALIGNMENT    = DEFAULT_SECTOR_SIZE //align to sector
 	DEFAULT_MAX_TRANSFER = 1 << 31             //2G
 	DEFAULT_L2_CACHE     = 1024 * 1024         //default 1MiB for l2 cache
+	//the default l2 cache is bounded, an l2 cache entry can be a slice of an
+	//l2 table to cover more guest clusters with the same memory
+	MIN_L2_CACHE_ENTRY_SIZE = 512
+	MIN_L2_CACHE_TABLES     = 2
+	//O_DIRECT needs the buffers, offsets and lengths aligned to the logical
+	//block size of the device, 4k covers all the common ones
+	DIRECT_IO_ALIGNMENT           = 4096
+	LURING_QUEUE_DEPTH            = 128 //requests in flight on the io_uring of a file
+	QCOW2_DEFAULT_AIO_WORKERS     = 8
+	QCOW2_DEFAULT_AIO_QUEUE_DEPTH = 64
+	//memory shared by the metadata caches of all the open images
+	QCOW2_DEFAULT_CACHE_BUDGET = 64 * 1024 * 1024
+	//seconds between the runs of the background goroutine of an image
+	QCOW2_DEFAULT_CACHE_CLEAN_INTERVAL        = 600
+	QCOW2_DEFAULT_METADATA_WRITEBACK_INTERVAL = 5
+	//the sequential streams tracked by the data cache of an image, and the
+	//clusters first read ahead of one, doubled on every read continuing it
+	QCOW2_DATA_CACHE_STREAMS = 8
+	QCOW2_MIN_READAHEAD      = 2
 )
 
 // backing file offset
@@ -115,9 +137,10 @@ const (
 
 const ( //permission options
 	//used features
-	BDRV_O_RDWR   = 0x0002
-	BDRV_O_UNMAP  = 0x4000  /* execute guest UNMAP/TRIM operations */
-	BDRV_O_CREATE = 0x80000 /* create of non-exist */
+	BDRV_O_RDWR       = 0x0002
+	BDRV_O_UNMAP      = 0x4000  /* execute guest UNMAP/TRIM operations */
+	BDRV_O_CREATE     = 0x80000 /* create of non-exist */
+	BDRV_O_NO_BACKING = 0x0100  /* don't open the backing file */
 
 	//unused feratures
 	BDRV_O_NO_SHARE     = 0x0001 /* don't share permissions */
@@ -126,7 +149,6 @@ const ( //permission options
 	BDRV_O_TEMPORARY    = 0x0010 /* delete the file after use */
 	BDRV_O_NOCACHE      = 0x0020 /* do not use the host page cache */
 	BDRV_O_NATIVE_AIO   = 0x0080 /* use native AIO instead of the thread pool */
-	BDRV_O_NO_BACKING   = 0x0100 /* don't open the backing file */
 	BDRV_O_NO_FLUSH     = 0x0200 /* disable flushing on this disk */
 	BDRV_O_COPY_ON_READ = 0x0400 /* copy read backing sectors into image */
 	BDRV_O_INACTIVE     = 0x0800 /* consistency hint for migration handoff */
@@ -140,6 +162,13 @@ const ( //permission options
 	BDRV_O_CACHE_MASK = (BDRV_O_NOCACHE | BDRV_O_NO_FLUSH)
 )
 
+// detect-zeroes modes
+const (
+	BDRV_DETECT_ZEROES_OFF = iota
+	BDRV_DETECT_ZEROES_ON
+	BDRV_DETECT_ZEROES_UNMAP
+)
+
 const (
 	BDRV_SECTOR_BITS = 9
 	BDRV_SECTOR_SIZE = (1 << BDRV_SECTOR_BITS)
@@ -202,7 +231,36 @@ const (
 	OPT_BACKING     = "backing"
 	OPT_SUBCLUSTER  = "enable-subcluster"
 	OPT_L2CACHESIZE = "l2-cache-size"
-	OPT_DATAFILE    = "datafile"
+	//size of an l2 cache entry, a power of 2 between 512 and the cluster size
+	OPT_L2_CACHE_ENTRY_SIZE = "l2-cache-entry-size"
+	OPT_DATAFILE            = "datafile"
+	OPT_CACHE               = "cache"
+	OPT_AIO                 = "aio"
+	//number of goroutines running the tasks of the requests of an image,
+	//and the tasks queued to them before the submitter runs them itself
+	OPT_AIO_WORKERS     = "aio-workers"
+	OPT_AIO_QUEUE_DEPTH = "aio-queue-depth"
+	//seconds between dropping the cache entries unused since the last time,
+	//and between writing the dirty metadata back, 0 disables them
+	OPT_CACHE_CLEAN_INTERVAL        = "cache-clean-interval"
+	OPT_METADATA_WRITEBACK_INTERVAL = "metadata-writeback-interval"
+	//bytes of guest data read ahead of the sequential reads, 0 disables it
+	OPT_DATA_CACHE_SIZE = "data-cache-size"
+	//pass the discards of the clusters freed to the file, by the cause of
+	//freeing them, and keep the clusters discarded by the guest allocated
+	OPT_DISCARD_REQUEST  = "pass-discard-request"
+	OPT_DISCARD_SNAPSHOT = "pass-discard-snapshot"
+	OPT_DISCARD_OTHER    = "pass-discard-other"
+	OPT_DISCARD_NO_UNREF = "discard-no-unref"
+	//turn the writes of zeroed buffers into zero writes: off, on or unmap
+	OPT_DETECT_ZEROES = "detect-zeroes"
+	//amendable options
+	OPT_BACKING_FMT   = "backing-fmt"
+	OPT_COMPAT        = "compat"
+	OPT_DATAFILE_RAW  = "data-file-raw"
+	OPT_REFCOUNT_BITS = "refcount-bits"
+	//measure options
+	OPT_CLUSTER_SIZE = "cluster-size"
 )
 
 /* permission constants */
@@ -215,8 +273,34 @@ const (
 	PERM_WRITABLE = PERM_WRITE | PERM_RESIZE
 )
 
+// convert
+const (
+	DEFAULT_CONVERT_WORKERS = 8
+	DEFAULT_CONVERT_BUFFER  = uint64(2 * 1024 * 1024)
+	CONVERT_SPARSE_SIZE     = uint64(4096) //smallest run of zeroes skipped inside the data
+)
+
+// compare
+const (
+	COMPARE_BUFFER_SIZE = uint64(1024 * 1024)
+)
+
+// checksum
+const (
+	CHECKSUM_CHUNK_SIZE       = uint64(1024 * 1024) //changing it changes every checksum
+	DEFAULT_CHECKSUM_WORKERS  = 8
+	CHECKSUM_CHUNKS_PER_BATCH = 64
+)
+
 const Max_WRITE_ZEROS = uint64(65536)
 const MAX_BOUNCE_BUFFER = uint64(32768 << 9)
 
-//external data file magic number
-const QCOW2_EXT_MAGIC_DATA_FILE = uint32(0x44415441)
+//header extension magic numbers
+const (
+	QCOW2_EXT_MAGIC_END            = uint32(0)
+	QCOW2_EXT_MAGIC_BACKING_FORMAT = uint32(0xe2792aca)
+	QCOW2_EXT_MAGIC_DATA_FILE      = uint32(0x44415441)
+)
+
+// the header length of a version 2 image, without the version 3 fields
+const QCOW2_V2_HEADER_LENGTH = 72
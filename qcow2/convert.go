@@ -0,0 +1,222 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+type ConvertOptions struct {
+	//number of concurrent copy workers
+	Workers int
+	//bytes handled by a worker at a time, rounded up to the cluster size of the target
+	BufferSize uint64
+	//the target has its own backing file, so only what the top layer of the
+	//source allocates is copied, the rest is left to the backing file
+	TargetHasBacking bool
+	//the target is known to read as zeroes, e.g. it has just been created
+	TargetIsZero bool
+	//copy the data with copy_file_range where source and target are on the
+	//same file system, the zero runs inside the data are copied as well
+	CopyRange bool
+	//called after each finished chunk with the bytes done so far
+	Progress func(done uint64, total uint64)
+}
+
+type convertChunk struct {
+	offset uint64
+	bytes  uint64
+	err    error
+}
+
+/*
+ * Copy the guest content of src to dst. The source is walked by its block
+ * status: zero ranges are skipped when the target already reads as zeroes,
+ * otherwise they are written as zeroes; data is read and written in chunks
+ * by concurrent workers, where zero runs inside the data are treated like
+ * zero ranges. With CopyRange the data is copied within the file system,
+ * falling back to reading and writing it once that fails.
+ * Chunks are aligned to the cluster size of a qcow2 target, 64k at least,
+ * so that no two workers ever touch the same cluster of the target.
+ */
+func Blk_Convert(src *BdrvChild, dst *BdrvChild, opts *ConvertOptions) error {
+
+	var err error
+	var total, done uint64
+	var wg sync.WaitGroup
+	var copyRange atomic.Bool
+
+	if src == nil || src.bs == nil || dst == nil || dst.bs == nil {
+		return Err_NullObject
+	}
+	if opts == nil {
+		opts = &ConvertOptions{}
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DEFAULT_CONVERT_WORKERS
+	}
+	bufferSize := opts.BufferSize
+	if bufferSize == 0 {
+		bufferSize = DEFAULT_CONVERT_BUFFER
+	}
+	clusterSize := uint64(DEFAULT_CLUSTER_SIZE)
+	if dst.bs.Drv != nil && dst.bs.Drv.FormatName == TYPE_QCOW2_NAME {
+		clusterSize = max(clusterSize, uint64(dst.bs.opaque.(*BDRVQcow2State).ClusterSize))
+	}
+	bufferSize = round_up(bufferSize, clusterSize)
+	copyRange.Store(opts.CopyRange)
+
+	if total, err = Blk_Getlength(src); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	chunks := make(chan *convertChunk, workers)
+	results := make(chan *convertChunk, workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, bufferSize)
+			for chunk := range chunks {
+				chunk.err = convert_chunk(src, dst, chunk.offset, chunk.bytes, buf, opts, &copyRange)
+				results <- chunk
+			}
+		}()
+	}
+
+	go func() {
+		defer close(chunks)
+		for offset := uint64(0); offset < total; offset += bufferSize {
+			select {
+			case chunks <- &convertChunk{offset: offset, bytes: min(bufferSize, total-offset)}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for chunk := range results {
+		if chunk.err != nil {
+			if err == nil {
+				err = chunk.err
+			}
+			cancel()
+			continue
+		}
+		done += chunk.bytes
+		if opts.Progress != nil {
+			opts.Progress(done, total)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return bdrv_flush(dst.bs)
+}
+
+func convert_chunk(src *BdrvChild, dst *BdrvChild, offset uint64, bytes uint64,
+	buf []byte, opts *ConvertOptions, copyRange *atomic.Bool) error {
+
+	var err error
+	var ret, pnum uint64
+
+	for bytes > 0 {
+		if opts.TargetHasBacking {
+			ret, err = bdrv_block_status(src.bs, true, offset, bytes, &pnum, nil, nil)
+		} else {
+			ret, err = bdrv_block_status_above(src.bs, nil, offset, bytes, &pnum, nil, nil)
+		}
+		if err != nil {
+			return err
+		}
+		if pnum == 0 {
+			//beyond the end of the source, nothing to copy
+			return nil
+		}
+
+		if ret&BDRV_BLOCK_ZERO > 0 {
+			if !opts.TargetIsZero {
+				if _, err = Blk_Pwrite_Zeroes(dst, offset, pnum, 0); err != nil {
+					return err
+				}
+			}
+		} else if ret&BDRV_BLOCK_DATA > 0 {
+			if copyRange.Load() {
+				if err = Blk_Copy_Range(src, offset, dst, offset, pnum); err == nil {
+					offset += pnum
+					bytes -= pnum
+					continue
+				} else if err != ERR_ENOTSUP {
+					return err
+				}
+				//copied through memory from now on
+				copyRange.Store(false)
+			}
+			if _, err = Blk_Pread(src, offset, buf, pnum); err != nil {
+				return err
+			}
+			if err = convert_write_data(dst, offset, buf, pnum, opts.TargetIsZero); err != nil {
+				return err
+			}
+		}
+		//otherwise unallocated in the top layer, it is read from the backing file of the target
+
+		offset += pnum
+		bytes -= pnum
+	}
+	return nil
+}
+
+// write the data, skipping runs of zeroes if the target reads as zeroes anyway
+func convert_write_data(dst *BdrvChild, offset uint64, buf []byte, bytes uint64, targetIsZero bool) error {
+
+	var err error
+	var start, end uint64
+
+	for start < bytes {
+		zero := buffer_is_zero(buf[start:], min(CONVERT_SPARSE_SIZE, bytes-start))
+		for end = start; end < bytes; end += min(CONVERT_SPARSE_SIZE, bytes-end) {
+			if buffer_is_zero(buf[end:], min(CONVERT_SPARSE_SIZE, bytes-end)) != zero {
+				break
+			}
+		}
+		if !zero {
+			_, err = Blk_Pwrite(dst, offset+start, buf[start:], end-start, 0)
+		} else if !targetIsZero {
+			_, err = Blk_Pwrite_Zeroes(dst, offset+start, end-start, 0)
+		}
+		if err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
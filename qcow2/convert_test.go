@@ -0,0 +1,188 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func count_allocated(t *testing.T, root *BdrvChild, size uint64) uint64 {
+	var allocated uint64
+	for offset := uint64(0); offset < size; {
+		var pnum uint64
+		ret, err := bdrv_is_allocated(root.bs, offset, size-offset, &pnum)
+		assert.Nil(t, err)
+		if ret > 0 {
+			allocated += pnum
+		}
+		offset += pnum
+	}
+	return allocated
+}
+
+func Test_convert_raw_to_qcow2(t *testing.T) {
+	var err error
+	var rawfile = "/tmp/convert.raw"
+	var qcow2file = "/tmp/convert.qcow2"
+	var size = uint64(16 * 1024 * 1024)
+	os.Remove(rawfile)
+	os.Remove(qcow2file)
+
+	err = Blk_Create(rawfile, map[string]any{OPT_FMT: "raw", OPT_SIZE: size})
+	assert.Nil(t, err)
+	src, err := Blk_Open(rawfile, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	_, err = Blk_Pwrite(src, 0, data, uint64(len(data)), 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(src, 10*1024*1024+512, data[:1000], 1000, 0)
+	assert.Nil(t, err)
+
+	err = Blk_Create(qcow2file, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	dst, err := Blk_Open(qcow2file, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+
+	var progress uint64
+	err = Blk_Convert(src, dst, &ConvertOptions{
+		Workers:      4,
+		BufferSize:   1024 * 1024,
+		TargetIsZero: true,
+		Progress:     func(done uint64, total uint64) { progress = done },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, size, progress)
+
+	//content is the same
+	bufIn := make([]byte, size)
+	bufOut := make([]byte, size)
+	_, err = Blk_Pread(src, 0, bufIn, size)
+	assert.Nil(t, err)
+	_, err = Blk_Pread(dst, 0, bufOut, size)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(bufIn, bufOut))
+
+	//only the two clusters holding data are allocated
+	assert.Equal(t, uint64(2*DEFAULT_CLUSTER_SIZE), count_allocated(t, dst, size))
+
+	Blk_Close(src)
+	Blk_Close(dst)
+	os.Remove(rawfile)
+	os.Remove(qcow2file)
+}
+
+func Test_convert_with_backing(t *testing.T) {
+	var err error
+	var basefile = "/tmp/convert_base.qcow2"
+	var overlayfile = "/tmp/convert_overlay.qcow2"
+	var targetfile = "/tmp/convert_target.qcow2"
+	var size = uint64(4 * 1024 * 1024)
+	os.Remove(basefile)
+	os.Remove(overlayfile)
+	os.Remove(targetfile)
+
+	err = Blk_Create(basefile, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	base, err := Blk_Open(basefile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	baseData := bytes.Repeat([]byte{0x5a}, 1024*1024)
+	_, err = Blk_Pwrite(base, 0, baseData, uint64(len(baseData)), 0)
+	assert.Nil(t, err)
+	Blk_Close(base)
+
+	err = Blk_Create(overlayfile, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size, OPT_BACKING: basefile})
+	assert.Nil(t, err)
+	src, err := Blk_Open(overlayfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(src, 65536, []byte("overlay data"), 12, 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite_Zeroes(src, 3*65536, 65536, 0)
+	assert.Nil(t, err)
+
+	err = Blk_Create(targetfile, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size, OPT_BACKING: basefile})
+	assert.Nil(t, err)
+	dst, err := Blk_Open(targetfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+
+	err = Blk_Convert(src, dst, &ConvertOptions{TargetHasBacking: true})
+	assert.Nil(t, err)
+
+	bufIn := make([]byte, size)
+	bufOut := make([]byte, size)
+	_, err = Blk_Pread(src, 0, bufIn, size)
+	assert.Nil(t, err)
+	_, err = Blk_Pread(dst, 0, bufOut, size)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(bufIn, bufOut))
+
+	//the data of the backing file has not been copied
+	assert.Equal(t, uint64(2*DEFAULT_CLUSTER_SIZE), count_allocated(t, dst, size))
+
+	Blk_Close(src)
+	Blk_Close(dst)
+	os.Remove(basefile)
+	os.Remove(overlayfile)
+	os.Remove(targetfile)
+}
+
+func Test_convert_copy_range(t *testing.T) {
+	var srcfile = "/tmp/convert_copy_range.qcow2"
+	var size = uint64(4 * 1024 * 1024)
+	os.Remove(srcfile)
+
+	err := Blk_Create(srcfile, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	src, err := Blk_Open(srcfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 16384)
+	_, err = Blk_Pwrite(src, 0, data, uint64(len(data)), 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(src, 2*1024*1024+4096, data[:8192], 8192, 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite_Zeroes(src, 65536, 65536, 0)
+	assert.Nil(t, err)
+	bufIn := make([]byte, size)
+	_, err = Blk_Pread(src, 0, bufIn, size)
+	assert.Nil(t, err)
+
+	for _, format := range []string{"qcow2", "raw"} {
+		var dstfile = "/tmp/convert_copy_range." + format + ".out"
+		os.Remove(dstfile)
+		err = Blk_Create(dstfile, map[string]any{OPT_FMT: format, OPT_SIZE: size})
+		assert.Nil(t, err)
+		dst, err := Blk_Open(dstfile, map[string]any{OPT_FMT: format}, BDRV_O_RDWR)
+		assert.Nil(t, err)
+		err = Blk_Convert(src, dst, &ConvertOptions{Workers: 2, BufferSize: 1024 * 1024, TargetIsZero: true, CopyRange: true})
+		assert.Nil(t, err)
+
+		bufOut := make([]byte, size)
+		_, err = Blk_Pread(dst, 0, bufOut, size)
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(bufIn, bufOut))
+		Blk_Close(dst)
+		os.Remove(dstfile)
+	}
+
+	//only an unsupported copy falls back to memory, other errors are returned
+	var dstfile = "/tmp/convert_copy_range.raw.out"
+	os.Remove(dstfile)
+	err = Blk_Create(dstfile, map[string]any{OPT_FMT: "raw", OPT_SIZE: size})
+	assert.Nil(t, err)
+	dst, err := Blk_Open(dstfile, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	var copyRange atomic.Bool
+	copyRange.Store(true)
+	dst.perm &^= PERM_WRITABLE
+	err = convert_chunk(src, dst, 0, 65536, make([]byte, 65536), &ConvertOptions{TargetIsZero: true}, &copyRange)
+	assert.Equal(t, Err_NoWritePerm, err)
+	assert.True(t, copyRange.Load())
+	dst.perm |= PERM_WRITABLE
+	Blk_Close(dst)
+	os.Remove(dstfile)
+
+	Blk_Close(src)
+	os.Remove(srcfile)
+}
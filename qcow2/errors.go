@@ -33,6 +33,10 @@ var (
 	ERR_ENOSPC  = syscall.ENOSPC
 	ERR_EINVAL  = syscall.EINVAL
 	ERR_EAGAIN  = syscall.EAGAIN
+	ERR_EEXIST  = syscall.EEXIST
+	ERR_ENOSYS  = syscall.ENOSYS
+	ERR_ENXIO   = syscall.ENXIO
+	ERR_EBUSY   = syscall.EBUSY
 
 	Err_IdxOutOfRange        = fmt.Errorf("index is out of range")
 	Err_NoDriverFound        = fmt.Errorf("no driver found")
@@ -43,4 +47,5 @@ var (
 	Err_NoWritePerm          = fmt.Errorf("no write permission")
 	Err_NoReadPerm           = fmt.Errorf("no read permission")
 	Err_Misaligned           = fmt.Errorf("misaligned")
+	Err_DetectZeroesUnmap    = fmt.Errorf("detect-zeroes=unmap requires the image to be opened with unmap")
 )
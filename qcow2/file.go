@@ -21,39 +21,34 @@ SOFTWARE.
 
 import (
 	"context"
+	"io"
 	"os"
 	"unsafe"
 )
 
 /*
  * write the iov to the raw file, whose byte order follows the iov.
+ * the writes are positional so that concurrent requests don't share
+ * the file offset.
  */
 func pwritev(ctx context.Context, file *os.File, iov []iovec, iovcnt int, offset uint64) (uint64, error) {
 
+	if ret, err := sys_pwritev(file, iov[:iovcnt], offset); err != ERR_ENOSYS {
+		return ret, err
+	}
+
+	//no vectored syscall, fall back to one positional write per buffer
 	i := int(0)
 	ret := uint64(0)
 	var err error
 	var n int
 
-	file.Seek(int64(offset), 0)
 	for i < iovcnt {
 		buffer := unsafe.Slice((*byte)(iov[i].iov_base), iov[i].iov_len)
-		if n, err = file.Write(buffer); err != nil {
-			return ret, err
-		} else if n > 0 {
-			ret += uint64(n)
-		} else if n == 0 {
-			break
-		} else if err == ERR_EINTR {
-			continue
-		} else {
-			/* else it is some "other" error,
-			 * only return if there was no data processed. */
-			if n == 0 {
-				return ret, err
-			}
-			break
+		if n, err = file.WriteAt(buffer, int64(offset+ret)); err != nil {
+			return ret + uint64(n), err
 		}
+		ret += uint64(n)
 		i++
 	}
 	return ret, nil
@@ -61,37 +56,44 @@ func pwritev(ctx context.Context, file *os.File, iov []iovec, iovcnt int, offset
 
 /*
  * read the iov from the raw file, whose byte order follows the iov.
+ * the part beyond the end of the file reads as zeroes.
  */
 func preadv(ctx context.Context, file *os.File, iov []iovec, iovcnt int, offset uint64) (uint64, error) {
 
+	if ret, err := sys_preadv(file, iov[:iovcnt], offset); err != ERR_ENOSYS {
+		return ret, err
+	}
+
 	i := int(0)
 	ret := uint64(0)
 	var err error
 	var n int
 
-	file.Seek(int64(offset), 0)
 	for i < iovcnt {
-
 		buffer := unsafe.Slice((*byte)(iov[i].iov_base), iov[i].iov_len)
-
-		if n, err = file.Read(buffer); err != nil {
-			return ret, err
-		} else if n > 0 {
-			ret += uint64(n)
-		} else if n == 0 {
-			break
-		} else if err == ERR_EINTR {
-			continue
-		} else {
-			/* else it is some "other" error,
-			 * only return if there was no data processed. */
-			if n == 0 {
-				return ret, err
+		n, err = file.ReadAt(buffer, int64(offset))
+		if err != nil && err != io.EOF && n > 0 && past_eof(file, offset+uint64(n)) {
+			err = io.EOF
+		}
+		if err == io.EOF {
+			if n < len(buffer) {
+				memset(unsafe.Pointer(&buffer[n]), len(buffer)-n)
 			}
-			break
+		} else if err != nil {
+			return ret + uint64(n), err
 		}
+		ret += uint64(n)
+		offset += iov[i].iov_len
 		i++
-
 	}
 	return ret, nil
 }
+
+/*
+ * with O_DIRECT, reading on from an unaligned end of file fails instead
+ * of returning a short read.
+ */
+func past_eof(file *os.File, offset uint64) bool {
+	info, err := file.Stat()
+	return err == nil && offset >= uint64(info.Size())
+}
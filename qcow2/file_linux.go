@@ -0,0 +1,274 @@
+//go:build linux
+
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"io"
+	"math"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// bypass the host page cache
+const O_DIRECT = unix.O_DIRECT
+
+// the whence of lseek(2) for the next data and the next hole
+const (
+	SEEK_DATA = unix.SEEK_DATA
+	SEEK_HOLE = unix.SEEK_HOLE
+)
+
+// the modes of fallocate(2)
+const (
+	FALLOC_FL_KEEP_SIZE  = unix.FALLOC_FL_KEEP_SIZE
+	FALLOC_FL_PUNCH_HOLE = unix.FALLOC_FL_PUNCH_HOLE
+	FALLOC_FL_ZERO_RANGE = unix.FALLOC_FL_ZERO_RANGE
+)
+
+// set once the kernel turns out to lack preadv2/pwritev2
+var noVectoredIO atomic.Bool
+
+// set once the kernel turns out to lack copy_file_range
+var noCopyRange atomic.Bool
+
+/*
+ * fill vec with the buffers of iov, skipping the first skip bytes,
+ * and return the number of entries used.
+ */
+func iov_to_sys_iovec(vec []syscall.Iovec, iov []iovec, skip uint64) int {
+
+	cnt := 0
+	for i := 0; i < len(iov) && cnt < len(vec); i++ {
+		if skip >= iov[i].iov_len {
+			skip -= iov[i].iov_len
+			continue
+		}
+		vec[cnt].Base = (*byte)(unsafe.Add(iov[i].iov_base, skip))
+		vec[cnt].SetLen(int(iov[i].iov_len - skip))
+		skip = 0
+		cnt++
+	}
+	return cnt
+}
+
+// issues one vectored transfer on fd, returns the bytes done
+type rwv_func func(fd uintptr, vec []syscall.Iovec, offset uint64) (uintptr, syscall.Errno)
+
+/*
+ * positional vectored I/O through rw. a short transfer is resumed from
+ * where it stopped, so that the whole iov is done unless an error occurs
+ * or a read hits the end of the file. returns ERR_ENOSYS if rw is not
+ * available before any I/O is done.
+ */
+func file_rwv(file *os.File, iov []iovec, offset uint64, write bool, rw rwv_func) (uint64, error) {
+
+	var done uint64
+	var ioerr error
+
+	total := iov_size(iov, uint64(len(iov)))
+	rc, err := file.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	vec := make([]syscall.Iovec, min(len(iov), IOV_MAX))
+	err = rc.Control(func(fd uintptr) {
+		for done < total {
+			cnt := iov_to_sys_iovec(vec, iov, done)
+			n, errno := rw(fd, vec[:cnt], offset+done)
+			switch {
+			case errno == syscall.EINTR || errno == syscall.EAGAIN:
+				continue
+			case errno == syscall.ENOSYS && done == 0:
+				ioerr = ERR_ENOSYS
+				return
+			case errno != 0:
+				if !write && done > 0 && past_eof(file, offset+done) {
+					ioerr = io.EOF
+				} else {
+					ioerr = errno
+				}
+				return
+			case n == 0:
+				if write {
+					ioerr = io.ErrShortWrite
+				} else {
+					ioerr = io.EOF
+				}
+				return
+			}
+			done += uint64(n)
+		}
+	})
+	if err != nil {
+		return done, err
+	}
+	return done, ioerr
+}
+
+/*
+ * the part beyond the end of the file reads as zeroes.
+ */
+func file_preadv(file *os.File, iov []iovec, offset uint64, rw rwv_func) (uint64, error) {
+
+	done, err := file_rwv(file, iov, offset, false, rw)
+	if err == io.EOF {
+		iov_memset(iov, uint64(len(iov)), done, 0, iov_size(iov, uint64(len(iov)))-done)
+		err = nil
+	}
+	return done, err
+}
+
+// preadv2(2) or pwritev2(2) of the buffers of vec
+func sys_rwv(write bool) rwv_func {
+	return func(fd uintptr, vec []syscall.Iovec, offset uint64) (uintptr, syscall.Errno) {
+		var n int
+		var err error
+		bufs := make([][]byte, len(vec))
+		for i := range vec {
+			bufs[i] = unsafe.Slice(vec[i].Base, vec[i].Len)
+		}
+		if write {
+			n, err = unix.Pwritev2(int(fd), bufs, int64(offset), 0)
+		} else {
+			n, err = unix.Preadv2(int(fd), bufs, int64(offset), 0)
+		}
+		if err == nil {
+			return uintptr(n), 0
+		}
+		if err == unix.ENOSYS {
+			noVectoredIO.Store(true)
+		}
+		return 0, err.(syscall.Errno)
+	}
+}
+
+func sys_pwritev(file *os.File, iov []iovec, offset uint64) (uint64, error) {
+	if noVectoredIO.Load() {
+		return 0, ERR_ENOSYS
+	}
+	return file_rwv(file, iov, offset, true, sys_rwv(true))
+}
+
+func sys_preadv(file *os.File, iov []iovec, offset uint64) (uint64, error) {
+	if noVectoredIO.Load() {
+		return 0, ERR_ENOSYS
+	}
+	return file_preadv(file, iov, offset, sys_rwv(false))
+}
+
+/*
+ * the offset of the next data or hole (by whence) of the file at or after
+ * offset, ERR_ENXIO if there's no data after offset or it's past the end.
+ */
+func file_seek(file *os.File, offset uint64, whence int) (uint64, error) {
+
+	var off int64
+	var seekErr error
+
+	rc, err := file.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	if err = rc.Control(func(fd uintptr) {
+		off, seekErr = unix.Seek(int(fd), int64(offset), whence)
+	}); err != nil {
+		return 0, err
+	}
+	return uint64(off), seekErr
+}
+
+func file_fallocate(file *os.File, mode uint32, offset uint64, bytes uint64) error {
+
+	var fallocErr error
+
+	rc, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err = rc.Control(func(fd uintptr) {
+		for {
+			if fallocErr = unix.Fallocate(int(fd), mode, int64(offset), int64(bytes)); fallocErr != unix.EINTR {
+				return
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	return fallocErr
+}
+
+/*
+ * copy bytes from src to dst within the kernel, ERR_ENOTSUP where it can't
+ * be done, e.g. across file systems, or where no progress is made past the
+ * end of src, so the caller copies them through memory instead
+ */
+func file_copy_range(src *os.File, srcOffset uint64, dst *os.File, dstOffset uint64, bytes uint64) error {
+
+	var copyErr, dstErr error
+
+	if noCopyRange.Load() {
+		return ERR_ENOTSUP
+	}
+	srcConn, err := src.SyscallConn()
+	if err != nil {
+		return err
+	}
+	dstConn, err := dst.SyscallConn()
+	if err != nil {
+		return err
+	}
+	inOff, outOff := int64(srcOffset), int64(dstOffset)
+	if err = srcConn.Control(func(srcFd uintptr) {
+		dstErr = dstConn.Control(func(dstFd uintptr) {
+			for bytes > 0 {
+				n, err := unix.CopyFileRange(int(srcFd), &inOff, int(dstFd), &outOff, int(min(bytes, math.MaxInt32)), 0)
+				switch {
+				case err == unix.EINTR:
+					continue
+				case err == unix.ENOSYS:
+					noCopyRange.Store(true)
+					copyErr = ERR_ENOTSUP
+				case err == unix.EXDEV || err == unix.EINVAL || err == unix.EOPNOTSUPP:
+					copyErr = ERR_ENOTSUP
+				case err != nil:
+					copyErr = err
+				case n == 0:
+					copyErr = ERR_ENOTSUP
+				default:
+					bytes -= uint64(n)
+					continue
+				}
+				return
+			}
+		})
+	}); err != nil {
+		return err
+	}
+	if dstErr != nil {
+		return dstErr
+	}
+	return copyErr
+}
@@ -0,0 +1,60 @@
+//go:build !linux
+
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import "os"
+
+// O_DIRECT is linux only, elsewhere the page cache is used anyway
+const O_DIRECT = 0
+
+// fallocate(2) is linux only, the zeroes are written out elsewhere
+const (
+	FALLOC_FL_KEEP_SIZE  = 0x01
+	FALLOC_FL_PUNCH_HOLE = 0x02
+	FALLOC_FL_ZERO_RANGE = 0x10
+)
+
+// the data and holes of a file are only looked up on linux
+const (
+	SEEK_DATA = 3
+	SEEK_HOLE = 4
+)
+
+func sys_pwritev(file *os.File, iov []iovec, offset uint64) (uint64, error) {
+	return 0, ERR_ENOSYS
+}
+
+func sys_preadv(file *os.File, iov []iovec, offset uint64) (uint64, error) {
+	return 0, ERR_ENOSYS
+}
+
+func file_seek(file *os.File, offset uint64, whence int) (uint64, error) {
+	return 0, ERR_ENOTSUP
+}
+
+func file_fallocate(file *os.File, mode uint32, offset uint64, bytes uint64) error {
+	return ERR_ENOTSUP
+}
+
+func file_copy_range(src *os.File, srcOffset uint64, dst *os.File, dstOffset uint64, bytes uint64) error {
+	return ERR_ENOTSUP
+}
@@ -3,6 +3,7 @@ package qcow2
 import (
 	"context"
 	"os"
+	"sync"
 	"testing"
 	"unsafe"
 
@@ -61,3 +62,74 @@ func Test_Pwritev_Preadv(t *testing.T) {
 	assert.Equal(t, uint64(6789), val2_2)
 	file.Close()
 }
+
+func Test_Preadv_Beyond_EOF(t *testing.T) {
+	file, err := os.CreateTemp("", "preadv")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	_, err = file.Write([]byte{1, 2, 3, 4})
+	assert.Nil(t, err)
+
+	//more buffers than the kernel takes in one call, filled with garbage
+	bufs := make([][]byte, IOV_MAX+10)
+	iov := make([]iovec, len(bufs))
+	for i := range bufs {
+		bufs[i] = []byte{0xff, 0xff}
+		iov[i] = iovec{iov_base: unsafe.Pointer(&bufs[i][0]), iov_len: 2}
+	}
+	n, err := preadv(context.Background(), file, iov, len(iov), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), n)
+	assert.Equal(t, []byte{2, 3}, bufs[0])
+	assert.Equal(t, []byte{4, 0}, bufs[1])
+	assert.Equal(t, []byte{0, 0}, bufs[len(bufs)-1])
+}
+
+func Test_Pwritev_Preadv_Parallel(t *testing.T) {
+	const workers = 16
+	const chunk = 64 * 1024
+	file, err := os.CreateTemp("", "pwritev")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			wbuf := make([]byte, chunk)
+			rbuf := make([]byte, chunk)
+			for round := 0; round < 32 && errs[i] == nil; round++ {
+				for j := range wbuf {
+					wbuf[j] = byte(i + round)
+				}
+				//split the buffer in two iovecs to go through the vectored path
+				wiov := []iovec{
+					{iov_base: unsafe.Pointer(&wbuf[0]), iov_len: chunk / 2},
+					{iov_base: unsafe.Pointer(&wbuf[chunk/2]), iov_len: chunk / 2},
+				}
+				riov := []iovec{{iov_base: unsafe.Pointer(&rbuf[0]), iov_len: chunk}}
+				if _, errs[i] = pwritev(context.Background(), file, wiov, 2, uint64(i*chunk)); errs[i] != nil {
+					break
+				}
+				if _, errs[i] = preadv(context.Background(), file, riov, 1, uint64(i*chunk)); errs[i] != nil {
+					break
+				}
+				for j := range rbuf {
+					if rbuf[j] != byte(i+round) {
+						errs[i] = ERR_EIO
+						break
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < workers; i++ {
+		assert.Nil(t, errs[i])
+	}
+}
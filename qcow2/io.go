@@ -21,8 +21,10 @@ SOFTWARE.
 
 import (
 	"bytes"
+	"container/list"
 	"encoding/binary"
 	"math"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 )
@@ -33,19 +35,29 @@ func bdrv_flush(bs *BlockDriverState) error {
 		return Err_NoDriverFound
 	}
 
-	atomic.AddUint64(&bs.InFlight, 1)
-	defer atomic.AddUint64(&bs.InFlight, ^uint64(0))
+	var err error
+	bdrv_inc_in_flight(bs)
+	defer bdrv_dec_in_flight(bs)
 
 	if bs.Drv.bdrv_flush != nil {
 		return bs.Drv.bdrv_flush(bs)
 	}
+	/* Write back cached data to the OS even with cache=unsafe */
 	if bs.Drv.bdrv_flush_to_os != nil {
-		return bs.Drv.bdrv_flush_to_os(bs)
+		if err = bs.Drv.bdrv_flush_to_os(bs); err != nil {
+			return err
+		}
 	}
-	if bs.Drv.bdrv_flush_to_disk != nil {
-		return bs.Drv.bdrv_flush_to_disk(bs)
+	/* But don't actually force it to the disk with cache=unsafe */
+	if bs.OpenFlags&BDRV_O_NO_FLUSH == 0 && bs.Drv.bdrv_flush_to_disk != nil {
+		if err = bs.Drv.bdrv_flush_to_disk(bs); err != nil {
+			return err
+		}
+	}
+	/* Then the file the format driver has written to */
+	if bs.current != nil && bs.current.bs != nil && bs.current.bs != bs {
+		return bdrv_flush(bs.current.bs)
 	}
-
 	return nil
 }
 
@@ -73,8 +85,9 @@ func bdrv_pwritev_part(child *BdrvChild, offset uint64, bytes uint64,
 	if child.perm&PERM_WRITABLE == 0 {
 		return Err_NoWritePerm
 	}
-	bs := child.bs
+	bs := bdrv_enter_request(child)
 	var pad BdrvRequestPadding
+	var req BdrvTrackedRequest
 	var err error
 	padded := false
 	align := bs.RequestAlignment
@@ -82,43 +95,77 @@ func bdrv_pwritev_part(child *BdrvChild, offset uint64, bytes uint64,
 	/* If the request is misaligned then we can't make it efficient */
 	if flags&BDRV_REQ_NO_FALLBACK > 0 &&
 		!is_aligned(int(offset|bytes), int(align)) {
-		return Err_Misaligned
+		err = Err_Misaligned
+		goto out
 	}
 
 	if bytes == 0 && !is_aligned(int(offset), int(align)) {
-		return err
+		goto out
+	}
+
+	/*
+	 * a zeroed buffer is written as zeroes, the granularity of the zero
+	 * writes (the subclusters with extended l2) left partly covered by it
+	 * are written with the zeroes of the buffer
+	 */
+	if bs.DetectZeroes != BDRV_DETECT_ZEROES_OFF && bytes > 0 &&
+		flags&(BDRV_REQ_ZERO_WRITE|BDRV_REQ_WRITE_COMPRESSED) == 0 &&
+		qemu_iovec_is_zero(qiov, qiovOffset, bytes) {
+		flags |= BDRV_REQ_ZERO_WRITE
+		if bs.DetectZeroes == BDRV_DETECT_ZEROES_UNMAP {
+			flags |= BDRV_REQ_MAY_UNMAP
+		}
 	}
 
 	if flags&BDRV_REQ_ZERO_WRITE == 0 {
 		if err = bdrv_pad_request(bs, &qiov, &qiovOffset, &offset, &bytes, &pad,
 			&padded); err != nil {
-			return err
+			goto out
 		}
 	}
 
-	atomic.AddUint64(&bs.InFlight, 1)
+	tracked_request_begin(&req, bs, offset, bytes)
 
 	if flags&BDRV_REQ_ZERO_WRITE > 0 {
 		Assert(!padded)
-		err = bdrv_do_zero_pwritev(child, offset, bytes, flags)
-		goto out
+		err = bdrv_do_zero_pwritev(child, offset, bytes, flags, &req)
+		goto out_tracked
 	}
 
 	if padded {
-		//if the requests is queued already, won't use this feature
-		//bdrv_make_request_serialising(&req, align)
-		overlapOffset := offset & uint64(^(align - 1))
-		overlapBytes := round_up(offset+bytes, uint64(align)) - overlapOffset
-		bdrv_padding_rmw_read(child, overlapOffset, overlapBytes, &pad, false)
+		/*
+		 * Request padding
+		 *
+		 * The no-serialising flag of the padding read-modify-write
+		 * cycle can't be honoured, no other write to the same sectors
+		 * may come in between
+		 */
+		bdrv_make_request_serialising(&req, uint64(align))
+		if err = bdrv_padding_rmw_read(child, req.overlapOffset, req.overlapBytes,
+			&pad, false); err != nil {
+			goto out_padding
+		}
+	} else if flags&BDRV_REQ_SERIALISING > 0 {
+		bdrv_make_request_serialising(&req, uint64(align))
+	} else {
+		/*
+		 * A serialising request has waited already. Waiting again after
+		 * the read of the padding would wait for the requests started
+		 * meanwhile, which go ahead of it as it is waiting then, and
+		 * overwrite them with what it read before
+		 */
+		bdrv_wait_serialising_requests(&req)
 	}
 
 	err = bdrv_aligned_pwritev(child, offset, bytes, uint64(align),
-		qiov, qiovOffset, flags)
+		qiov, qiovOffset, flags&^BDRV_REQ_SERIALISING)
 
+out_padding:
 	bdrv_padding_destroy(&pad)
-
+out_tracked:
+	tracked_request_end(&req)
 out:
-	atomic.AddUint64(&bs.InFlight, ^uint64(0))
+	bdrv_dec_in_flight(bs)
 	return err
 }
 
@@ -134,8 +181,13 @@ func bdrv_pad_request(bs *BlockDriverState, qiov **QEMUIOVector, qiovOffset *uin
 		return nil
 	}
 
+	//the tail buffer is out of range if there is no tail
+	var tailBuf unsafe.Pointer
+	if pad.Tail > 0 {
+		tailBuf = unsafe.Pointer(&pad.Buf[pad.BufLen-pad.Tail])
+	}
 	if err = qemu_iovec_init_extended(&pad.LocalQiov, unsafe.Pointer(&pad.Buf[0]), pad.Head,
-		*qiov, *qiovOffset, *bytes, unsafe.Pointer(&pad.Buf[pad.BufLen-pad.Tail]), pad.Tail); err != nil {
+		*qiov, *qiovOffset, *bytes, tailBuf, pad.Tail); err != nil {
 		bdrv_padding_destroy(pad)
 		return err
 	}
@@ -151,9 +203,10 @@ func bdrv_pad_request(bs *BlockDriverState, qiov **QEMUIOVector, qiovOffset *uin
 	return nil
 }
 
-func bdrv_do_zero_pwritev(child *BdrvChild, offset uint64, bytes uint64, flags BdrvRequestFlags) error {
+func bdrv_do_zero_pwritev(child *BdrvChild, offset uint64, bytes uint64, flags BdrvRequestFlags,
+	req *BdrvTrackedRequest) error {
 
-	bs := child.bs
+	bs := req.bs
 	var localQiov QEMUIOVector
 	align := uint64(bs.RequestAlignment)
 	var err error
@@ -162,11 +215,19 @@ func bdrv_do_zero_pwritev(child *BdrvChild, offset uint64, bytes uint64, flags B
 
 	padding = bdrv_init_padding(bs, offset, bytes, &pad)
 
+	//like the other writes, the aligned zero writes wait for the serialising
+	//requests, the read-modify-write cycles, overlapping them
+	if padding || flags&BDRV_REQ_SERIALISING > 0 {
+		bdrv_make_request_serialising(req, align)
+	} else {
+		bdrv_wait_serialising_requests(req)
+	}
+	flags &^= BDRV_REQ_SERIALISING
+
 	if padding {
-		//bdrv_make_request_serialising(req, align);
-		overlapOffset := offset & ^(align - 1)
-		overlapBytes := round_up(offset+bytes, align) - overlapOffset
-		bdrv_padding_rmw_read(child, overlapOffset, overlapBytes, &pad, true)
+		if err = bdrv_padding_rmw_read(child, req.overlapOffset, req.overlapBytes, &pad, true); err != nil {
+			goto out
+		}
 
 		if pad.Head > 0 || pad.MergeReads {
 			alignedOffset := offset & ^(align - 1)
@@ -405,8 +466,7 @@ func bdrv_init_padding(bs *BlockDriverState, offset uint64, bytes uint64, pad *B
 	} else {
 		pad.BufLen = align
 	}
-	//In C implementation, this allocate a memory range align to the size, by default it is 4k
-	pad.Buf = make([]uint8, pad.BufLen)
+	pad.Buf = qemu_blockalign(bs, pad.BufLen)
 	pad.MergeReads = (sum == pad.BufLen)
 	if pad.Tail > 0 {
 		pad.TailBuf = pad.Buf[pad.BufLen-align:]
@@ -429,6 +489,11 @@ func bdrv_do_pwrite_zeroes(bs *BlockDriverState, offset uint64, bytes uint64, fl
 	alignment := Max_WRITE_ZEROS
 	maxTransfer := Max_WRITE_ZEROS
 
+	//split the requests at the granularity of the driver, if finer
+	if bs.PwriteZeroesAlignment > 0 {
+		alignment = min(alignment, uint64(max(bs.PwriteZeroesAlignment, bs.RequestAlignment)))
+	}
+
 	if flags&BdrvRequestFlags(^bs.SupportedZeroFlags)&BDRV_REQ_NO_FALLBACK > 0 {
 		return ERR_ENOTSUP
 	}
@@ -477,7 +542,7 @@ func bdrv_do_pwrite_zeroes(bs *BlockDriverState, offset uint64, bytes uint64, fl
 			}
 			num = min(num, maxTransfer)
 			if buf == nil {
-				p := make([]byte, num)
+				p := qemu_blockalign(bs, num)
 				buf = unsafe.Pointer(&p[0])
 			}
 			qemu_iovec_init_buf(&qiov, buf, num)
@@ -546,12 +611,81 @@ out:
 
 func bdrv_pwrite_zeroes(child *BdrvChild, offset uint64, bytes uint64, flags BdrvRequestFlags) error {
 
-	if child.bs.OpenFlags&BDRV_O_UNMAP == 0 {
+	if child.GetBS().OpenFlags&BDRV_O_UNMAP == 0 {
 		flags &= ^BDRV_REQ_MAY_UNMAP
 	}
 	return bdrv_pwritev(child, offset, bytes, nil, BDRV_REQ_ZERO_WRITE|flags)
 }
 
+/*
+ * copy bytes of src to dst without passing them through memory, where the
+ * drivers of both ends can: the source maps the range to where the data is,
+ * down to the file holding it, and the target allocates it and copies it
+ * there. ERR_ENOTSUP where they can't, the caller reads and writes it instead
+ */
+func bdrv_copy_range(src *BdrvChild, srcOffset uint64, dst *BdrvChild, dstOffset uint64,
+	bytes uint64, readFlags BdrvRequestFlags, writeFlags BdrvRequestFlags) error {
+	return bdrv_copy_range_from(src, srcOffset, dst, dstOffset, bytes, readFlags, writeFlags)
+}
+
+func bdrv_copy_range_from(src *BdrvChild, srcOffset uint64, dst *BdrvChild, dstOffset uint64,
+	bytes uint64, readFlags BdrvRequestFlags, writeFlags BdrvRequestFlags) error {
+	return bdrv_copy_range_internal(src, srcOffset, dst, dstOffset, bytes, readFlags, writeFlags, true)
+}
+
+func bdrv_copy_range_to(src *BdrvChild, srcOffset uint64, dst *BdrvChild, dstOffset uint64,
+	bytes uint64, readFlags BdrvRequestFlags, writeFlags BdrvRequestFlags) error {
+	return bdrv_copy_range_internal(src, srcOffset, dst, dstOffset, bytes, readFlags, writeFlags, false)
+}
+
+func bdrv_copy_range_internal(src *BdrvChild, srcOffset uint64, dst *BdrvChild, dstOffset uint64,
+	bytes uint64, readFlags BdrvRequestFlags, writeFlags BdrvRequestFlags, recurseSrc bool) error {
+
+	var bs *BlockDriverState
+	var req BdrvTrackedRequest
+	var err error
+
+	if dst == nil || dst.bs == nil || dst.bs.Drv == nil {
+		return Err_NullObject
+	}
+	if dst.perm&PERM_WRITABLE == 0 {
+		return Err_NoWritePerm
+	}
+	//the source reads as zeroes
+	if writeFlags&BDRV_REQ_ZERO_WRITE > 0 {
+		return bdrv_pwrite_zeroes(dst, dstOffset, bytes, writeFlags&^BDRV_REQ_ZERO_WRITE)
+	}
+	if src == nil || src.bs == nil || src.bs.Drv == nil {
+		return Err_NullObject
+	}
+	if src.perm&PERM_READABLE == 0 {
+		return Err_NoReadPerm
+	}
+	if src.bs.Drv.bdrv_copy_range_from == nil || dst.bs.Drv.bdrv_copy_range_to == nil {
+		return ERR_ENOTSUP
+	}
+
+	if recurseSrc {
+		bs = bdrv_enter_request(src)
+		err = bs.Drv.bdrv_copy_range_from(bs, src, srcOffset, dst, dstOffset, bytes, readFlags, writeFlags)
+		goto out
+	}
+
+	bs = bdrv_enter_request(dst)
+	//there's no buffer to pad the request with
+	if !is_aligned(dstOffset|bytes, uint64(bs.RequestAlignment)) {
+		err = ERR_ENOTSUP
+		goto out
+	}
+	tracked_request_begin(&req, bs, dstOffset, bytes)
+	bdrv_wait_serialising_requests(&req)
+	err = bs.Drv.bdrv_copy_range_to(bs, src, srcOffset, dst, dstOffset, bytes, readFlags, writeFlags)
+	tracked_request_end(&req)
+out:
+	bdrv_dec_in_flight(bs)
+	return err
+}
+
 func bdrv_preadv(child *BdrvChild, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, flags BdrvRequestFlags) error {
 	return bdrv_preadv_part(child, offset, bytes, qiov, 0, flags)
@@ -559,16 +693,14 @@ func bdrv_preadv(child *BdrvChild, offset uint64, bytes uint64,
 
 func bdrv_preadv_part(child *BdrvChild, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error {
-	bs := child.bs
+	bs := bdrv_enter_request(child)
 	var pad BdrvRequestPadding
 	var err error
 
 	if bytes == 0 && !is_aligned(offset, uint64(bs.RequestAlignment)) {
-		return nil
+		goto fail
 	}
 
-	atomic.AddUint64(&bs.InFlight, 1)
-
 	if err = bdrv_pad_request(bs, &qiov, &qiovOffset, &offset, &bytes, &pad, nil); err != nil {
 		goto fail
 	}
@@ -577,7 +709,7 @@ func bdrv_preadv_part(child *BdrvChild, offset uint64, bytes uint64,
 	bdrv_padding_destroy(&pad)
 
 fail:
-	atomic.AddUint64(&bs.InFlight, ^uint64(0))
+	bdrv_dec_in_flight(bs)
 	return err
 }
 
@@ -598,9 +730,9 @@ func bdrv_is_allocated(bs *BlockDriverState, offset uint64, bytes uint64, pnum *
 		return 0, err
 	}
 	if ret&BDRV_BLOCK_ALLOCATED > 0 {
-		ret = 1
+		return 1, nil
 	}
-	return ret, nil
+	return 0, nil
 }
 
 func bdrv_driver_preadv(bs *BlockDriverState, offset uint64, bytes uint64,
@@ -850,7 +982,7 @@ func bdrv_block_status(bs *BlockDriverState, wantZero bool, offset uint64, bytes
 		bytes = n
 	}
 
-	atomic.AddUint64(&bs.InFlight, uint64(0))
+	bdrv_inc_in_flight(bs)
 
 	/* Round out to request_alignment boundaries */
 	align = bs.RequestAlignment
@@ -918,7 +1050,7 @@ func bdrv_block_status(bs *BlockDriverState, wantZero bool, offset uint64, bytes
 		}
 	}
 out:
-	atomic.AddUint64(&bs.InFlight, ^uint64(0))
+	bdrv_dec_in_flight(bs)
 	if err == nil && offset+*pnum == total_size {
 		ret |= BDRV_BLOCK_EOF
 	}
@@ -969,6 +1101,7 @@ func bdrv_link_child(parent *BlockDriverState, child *BdrvChild, childName strin
 		return
 	}
 	child.name = childName
+	child.parent = parent
 	parent.current = child
 	child.bs.InheritsFrom = parent
 }
@@ -978,14 +1111,26 @@ func bdrv_link_backing(parent *BlockDriverState, child *BdrvChild, childName str
 		return
 	}
 	child.name = childName
+	child.parent = parent
 	parent.backing = child
 	child.bs.InheritsFrom = parent
 }
 
+// the alignment of the buffers that the file under bs can use without copying
 func bdrv_opt_mem_align(bs *BlockDriverState) uint64 {
+	if s, ok := bs.opaque.(*BDRVRawState); ok && s.BufAlign > 0 {
+		return s.BufAlign
+	}
+	if bs.current != nil && bs.current.bs != nil && bs.current.bs != bs {
+		return bdrv_opt_mem_align(bs.current.bs)
+	}
 	return uint64(DEFAULT_ALIGNMENT)
 }
 
+func qemu_blockalign(bs *BlockDriverState, size uint64) []byte {
+	return qemu_memalign(bdrv_opt_mem_align(bs), size)
+}
+
 func bdrv_getlength(bs *BlockDriverState) (uint64, error) {
 
 	if bs.Drv != nil && bs.Drv.bdrv_getlength != nil {
@@ -1043,14 +1188,15 @@ func bdrv_filter_or_cow_child(bs *BlockDriverState) *BdrvChild {
 	return bdrv_cow_child(bs)
 }
 
-func bdrv_close(bs *BlockDriverState) {
-	bdrv_flush(bs)
+func bdrv_close(bs *BlockDriverState) error {
+	err := bdrv_flush(bs)
 	if bs.Drv != nil {
 		if bs.Drv.bdrv_close != nil {
 			bs.Drv.bdrv_close(bs)
 		}
 		bs.Drv = nil
 	}
+	return err
 }
 
 // read object from the file, the object's size must be obtainable, for debugging purpose
@@ -1095,28 +1241,27 @@ func bdrv_direct_pwrite(child *BdrvChild, offset int64, object any, size int64)
 func bdrv_pdiscard(child *BdrvChild, offset uint64, bytes uint64) error {
 
 	var head, tail, align uint64
-	bs := child.bs
 	var err error
 
-	if bs == nil || bs.Drv == nil {
+	if bs := child.GetBS(); bs == nil || bs.Drv == nil {
 		return Err_NoDriverFound
 	}
+	bs := bdrv_enter_request(child)
 
 	if bs.OpenFlags&BDRV_O_UNMAP == 0 {
-		return nil
+		goto out
 	}
 
 	//depends on driver to execute the discard
 	if bs.Drv.bdrv_pdiscard == nil {
-		return Err_NoDriverFound
+		err = Err_NoDriverFound
+		goto out
 	}
 
 	align = uint64(max(bs.RequestAlignment, bs.PdiscardAlignment))
 	head = offset % align
 	tail = (offset + bytes) % align
 
-	atomic.AddUint64(&bs.InFlight, 1)
-
 	for bytes > 0 {
 		num := bytes
 
@@ -1148,6 +1293,171 @@ func bdrv_pdiscard(child *BdrvChild, offset uint64, bytes uint64) error {
 	}
 	err = nil
 out:
-	atomic.AddUint64(&bs.InFlight, ^uint64(0))
+	bdrv_dec_in_flight(bs)
 	return err
 }
+
+func bdrv_inc_in_flight(bs *BlockDriverState) {
+	atomic.AddUint64(&bs.InFlight, 1)
+}
+
+func bdrv_dec_in_flight(bs *BlockDriverState) {
+	atomic.AddUint64(&bs.InFlight, ^uint64(0))
+	if atomic.LoadInt32(&bs.QuiesceCounter) > 0 {
+		bs.drainLock.Lock()
+		bdrv_drain_cond(bs).Broadcast()
+		bs.drainLock.Unlock()
+	}
+}
+
+func bdrv_drain_cond(bs *BlockDriverState) *sync.Cond {
+	if bs.drainCond == nil {
+		bs.drainCond = sync.NewCond(&bs.drainLock)
+	}
+	return bs.drainCond
+}
+
+/*
+ * Account a new request from the parent of child. New requests are held back
+ * while the node is in a drained section; since the drained section may have
+ * replaced the node (e.g. by a snapshot overlay), the node to issue the
+ * request to is returned.
+ * The requests a node issues to its own children are part of a request
+ * already let in, they aren't held back, or draining a node backing another
+ * one would wait for the requests of the other that wait for it.
+ */
+func bdrv_enter_request(child *BdrvChild) *BlockDriverState {
+	if child.parent != nil {
+		bdrv_inc_in_flight(child.bs)
+		return child.bs
+	}
+	for {
+		bs := child.GetBS()
+		bs.drainLock.Lock()
+		for bs.QuiesceCounter > 0 {
+			bdrv_drain_cond(bs).Wait()
+		}
+		if child.GetBS() != bs {
+			bs.drainLock.Unlock()
+			continue
+		}
+		atomic.AddUint64(&bs.InFlight, 1)
+		bs.drainLock.Unlock()
+		return bs
+	}
+}
+
+// stop new requests on bs and wait for those in flight to complete
+func bdrv_drained_begin(bs *BlockDriverState) {
+	bs.drainLock.Lock()
+	atomic.AddInt32(&bs.QuiesceCounter, 1)
+	for atomic.LoadUint64(&bs.InFlight) > 0 {
+		bdrv_drain_cond(bs).Wait()
+	}
+	bs.drainLock.Unlock()
+}
+
+func bdrv_drained_end(bs *BlockDriverState) {
+	bs.drainLock.Lock()
+	Assert(bs.QuiesceCounter > 0)
+	atomic.AddInt32(&bs.QuiesceCounter, -1)
+	bdrv_drain_cond(bs).Broadcast()
+	bs.drainLock.Unlock()
+}
+
+func tracked_request_begin(req *BdrvTrackedRequest, bs *BlockDriverState, offset uint64, bytes uint64) {
+
+	*req = BdrvTrackedRequest{
+		bs:            bs,
+		offset:        offset,
+		bytes:         bytes,
+		overlapOffset: offset,
+		overlapBytes:  bytes,
+		waitQueue:     sync.NewCond(&bs.reqsLock),
+	}
+	bs.reqsLock.Lock()
+	if bs.trackedRequests == nil {
+		bs.trackedRequests = list.New()
+	}
+	req.elem = bs.trackedRequests.PushBack(req)
+	bs.reqsLock.Unlock()
+}
+
+func tracked_request_end(req *BdrvTrackedRequest) {
+	req.bs.reqsLock.Lock()
+	req.bs.trackedRequests.Remove(req.elem)
+	req.waitQueue.Broadcast()
+	req.bs.reqsLock.Unlock()
+}
+
+func tracked_request_overlaps(req *BdrvTrackedRequest, offset uint64, bytes uint64) bool {
+	/*        aaaa   bbbb */
+	if offset >= req.overlapOffset+req.overlapBytes {
+		return false
+	}
+	/* bbbb   aaaa        */
+	if req.overlapOffset >= offset+bytes {
+		return false
+	}
+	return true
+}
+
+// bs.reqsLock must be held
+func bdrv_find_conflicting_request(self *BdrvTrackedRequest) *BdrvTrackedRequest {
+
+	for e := self.bs.trackedRequests.Front(); e != nil; e = e.Next() {
+		req := e.Value.(*BdrvTrackedRequest)
+		if req == self || (!req.serialising && !self.serialising) {
+			continue
+		}
+		if tracked_request_overlaps(req, self.overlapOffset, self.overlapBytes) {
+			/*
+			 * If the request is already (indirectly) waiting for us, or
+			 * will wait for us as soon as it wakes up, then just go on
+			 * (instead of producing a deadlock in the former case).
+			 */
+			if req.waitingFor == nil {
+				return req
+			}
+		}
+	}
+	return nil
+}
+
+// bs.reqsLock must be held
+func bdrv_wait_serialising_requests_locked(self *BdrvTrackedRequest) {
+	for {
+		req := bdrv_find_conflicting_request(self)
+		if req == nil {
+			break
+		}
+		self.waitingFor = req
+		req.waitQueue.Wait()
+		self.waitingFor = nil
+	}
+}
+
+// wait for the serialising requests overlapping req to complete
+func bdrv_wait_serialising_requests(req *BdrvTrackedRequest) {
+	req.bs.reqsLock.Lock()
+	bdrv_wait_serialising_requests_locked(req)
+	req.bs.reqsLock.Unlock()
+}
+
+/*
+ * widen req to the aligned region it touches, so that no other write
+ * overlapping that region runs at the same time, and wait for those
+ * already in flight
+ */
+func bdrv_make_request_serialising(req *BdrvTrackedRequest, align uint64) {
+
+	overlapOffset := req.offset & ^(align - 1)
+	overlapBytes := round_up(req.offset+req.bytes, align) - overlapOffset
+
+	req.bs.reqsLock.Lock()
+	req.serialising = true
+	req.overlapOffset = min(req.overlapOffset, overlapOffset)
+	req.overlapBytes = max(req.overlapBytes, overlapBytes)
+	bdrv_wait_serialising_requests_locked(req)
+	req.bs.reqsLock.Unlock()
+}
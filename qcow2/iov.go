@@ -260,6 +260,45 @@ func iov_memset(iov []iovec, iovCnt uint64, offset uint64, fillc int, bytes uint
 	return done
 }
 
+func iov_size(iov []iovec, iovCnt uint64) uint64 {
+	var size uint64
+	var i uint64
+
+	for i = 0; i < iovCnt; i++ {
+		size += iov[i].iov_len
+	}
+	return size
+}
+
+// check if the bytes of the vector from offset are all zeroes
+func qemu_iovec_is_zero(qiov *QEMUIOVector, offset uint64, bytes uint64) bool {
+	for i := 0; i < qiov.niov && bytes > 0; i++ {
+		if offset >= qiov.iov[i].iov_len {
+			offset -= qiov.iov[i].iov_len
+			continue
+		}
+		len := min(qiov.iov[i].iov_len-offset, bytes)
+		buf := unsafe.Slice((*byte)(unsafe.Pointer(uintptr(qiov.iov[i].iov_base)+uintptr(offset))), len)
+		if !buffer_is_zero(buf, len) {
+			return false
+		}
+		bytes -= len
+		offset = 0
+	}
+	return true
+}
+
+// check if all the buffers and lengths of the vector are aligned
+func qemu_iovec_is_aligned(qiov *QEMUIOVector, align uint64) bool {
+	for i := 0; i < qiov.niov; i++ {
+		if !is_aligned(uint64(uintptr(qiov.iov[i].iov_base)), align) ||
+			!is_aligned(qiov.iov[i].iov_len, align) {
+			return false
+		}
+	}
+	return true
+}
+
 func qemu_iovec_to_buf(qiov *QEMUIOVector, offset uint64, buf unsafe.Pointer, bytes uint64) uint64 {
 	return iov_to_buf(qiov.iov, uint64(qiov.niov), offset, buf, bytes)
 }
@@ -0,0 +1,121 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// an extent of the image with the same allocation state, like what qemu-img map reports
+type MapEntry struct {
+	Start  uint64 `json:"start"`
+	Length uint64 `json:"length"`
+	//the layer of the backing chain providing the extent, 0 is the top layer
+	Depth   int  `json:"depth"`
+	Present bool `json:"present"`
+	Zero    bool `json:"zero"`
+	Data    bool `json:"data"`
+	//the host offset in Filename, nil if the extent has no host offset
+	Offset   *uint64 `json:"offset,omitempty"`
+	Filename string  `json:"filename,omitempty"`
+}
+
+/*
+ * Return the allocation map of [offset, offset + length) of the image,
+ * adjacent extents of the same state are merged.
+ */
+func Blk_Map(child *BdrvChild, offset uint64, length uint64) ([]*MapEntry, error) {
+
+	var err error
+	var size, end uint64
+	var entries []*MapEntry
+	var last, entry *MapEntry
+
+	if child == nil || child.bs == nil {
+		return nil, Err_NullObject
+	}
+	if size, err = Blk_Getlength(child); err != nil {
+		return nil, err
+	}
+	if offset > size {
+		return nil, ERR_EINVAL
+	}
+	end = size
+	if length < size-offset {
+		end = offset + length
+	}
+
+	for offset < end {
+		if entry, err = get_map_entry(child.bs, offset, end-offset); err != nil {
+			return nil, err
+		}
+		if entry.Length == 0 {
+			break
+		}
+		if last != nil && map_entry_mergeable(last, entry) {
+			last.Length += entry.Length
+		} else {
+			entries = append(entries, entry)
+			last = entry
+		}
+		offset += entry.Length
+	}
+	return entries, nil
+}
+
+func get_map_entry(bs *BlockDriverState, offset uint64, bytes uint64) (*MapEntry, error) {
+
+	var ret, pnum, hostOffset uint64
+	var file *BlockDriverState
+	var depth int
+	var err error
+
+	if ret, err = bdrv_common_block_status_above(bs, nil, false, true, offset, bytes,
+		&pnum, &hostOffset, &file, &depth); err != nil {
+		return nil, err
+	}
+	entry := &MapEntry{
+		Start:   offset,
+		Length:  pnum,
+		Depth:   depth - 1,
+		Present: ret&BDRV_BLOCK_ALLOCATED > 0,
+		Zero:    ret&BDRV_BLOCK_ZERO > 0,
+		Data:    ret&BDRV_BLOCK_DATA > 0,
+	}
+	if ret&BDRV_BLOCK_OFFSET_VALID > 0 {
+		entry.Offset = &hostOffset
+		if file != nil {
+			entry.Filename = file.filename
+		}
+	}
+	return entry, nil
+}
+
+func map_entry_mergeable(curr *MapEntry, next *MapEntry) bool {
+
+	if curr.Depth != next.Depth || curr.Present != next.Present ||
+		curr.Zero != next.Zero || curr.Data != next.Data ||
+		curr.Filename != next.Filename {
+		return false
+	}
+	if (curr.Offset == nil) != (next.Offset == nil) {
+		return false
+	}
+	if curr.Offset != nil && *curr.Offset+curr.Length != *next.Offset {
+		return false
+	}
+	return true
+}
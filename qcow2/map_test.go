@@ -0,0 +1,73 @@
+package qcow2
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_map(t *testing.T) {
+	var err error
+	var basefile = "/tmp/map_base.qcow2"
+	var overlayfile = "/tmp/map_overlay.qcow2"
+	var size = uint64(1024 * 1024)
+	os.Remove(basefile)
+	os.Remove(overlayfile)
+
+	err = Blk_Create(basefile, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	base, err := Blk_Open(basefile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	data := make([]byte, 2*DEFAULT_CLUSTER_SIZE)
+	data[0] = 1
+	_, err = Blk_Pwrite(base, 0, data, 2*DEFAULT_CLUSTER_SIZE, 0)
+	assert.Nil(t, err)
+	Blk_Close(base)
+
+	err = Blk_Create(overlayfile, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size, OPT_BACKING: basefile})
+	assert.Nil(t, err)
+	overlay, err := Blk_Open(overlayfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(overlay, 2*DEFAULT_CLUSTER_SIZE, data, DEFAULT_CLUSTER_SIZE, 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite_Zeroes(overlay, 3*DEFAULT_CLUSTER_SIZE, DEFAULT_CLUSTER_SIZE, 0)
+	assert.Nil(t, err)
+
+	entries, err := Blk_Map(overlay, 0, size)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(entries))
+
+	//two clusters of the backing file, merged
+	assert.Equal(t, uint64(0), entries[0].Start)
+	assert.Equal(t, uint64(2*DEFAULT_CLUSTER_SIZE), entries[0].Length)
+	assert.Equal(t, 1, entries[0].Depth)
+	assert.True(t, entries[0].Data && entries[0].Present)
+	assert.NotNil(t, entries[0].Offset)
+	assert.Equal(t, basefile, entries[0].Filename)
+
+	assert.Equal(t, 0, entries[1].Depth)
+	assert.True(t, entries[1].Data)
+	assert.Equal(t, overlayfile, entries[1].Filename)
+
+	assert.Equal(t, 0, entries[2].Depth)
+	assert.True(t, entries[2].Zero && entries[2].Present)
+	assert.False(t, entries[2].Data)
+
+	//the rest is unallocated in the whole chain
+	assert.Equal(t, uint64(4*DEFAULT_CLUSTER_SIZE), entries[3].Start)
+	assert.Equal(t, size-4*DEFAULT_CLUSTER_SIZE, entries[3].Length)
+	assert.False(t, entries[3].Present)
+	assert.True(t, entries[3].Zero)
+	assert.Nil(t, entries[3].Offset)
+
+	//a sub range
+	entries, err = Blk_Map(overlay, DEFAULT_CLUSTER_SIZE, 2*DEFAULT_CLUSTER_SIZE)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, uint64(DEFAULT_CLUSTER_SIZE), entries[0].Length)
+
+	Blk_Close(overlay)
+	os.Remove(basefile)
+	os.Remove(overlayfile)
+}
@@ -0,0 +1,147 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_measure_size(t *testing.T) {
+	//header, l1 table, 2 l2 tables, refcount table and block
+	info, err := Blk_Measure(nil, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 1024 * 1024 * 1024})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6*DEFAULT_CLUSTER_SIZE), info.Required)
+	assert.Equal(t, uint64(1024*1024*1024+6*DEFAULT_CLUSTER_SIZE), info.FullyAllocated)
+
+	//twice the l2 tables with subclusters
+	infoSc, err := Blk_Measure(nil, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 1024 * 1024 * 1024,
+		OPT_SUBCLUSTER: true})
+	assert.Nil(t, err)
+	assert.Equal(t, info.FullyAllocated+1024*1024*1024/DEFAULT_CLUSTER_SIZE*L2E_SIZE_NORMAL,
+		infoSc.FullyAllocated)
+
+	info, err = Blk_Measure(nil, map[string]any{OPT_FMT: "raw", OPT_SIZE: 1024 * 1024})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1024*1024), info.Required)
+}
+
+func Test_measure_options(t *testing.T) {
+	var size = uint64(1024 * 1024 * 1024)
+
+	//4k clusters: header, l1 table, 512 l2 tables, 1 refcount table and 129 refcount blocks
+	info, err := Blk_Measure(nil, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size,
+		OPT_CLUSTER_SIZE: 4096})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(644*4096), info.Required)
+	assert.Equal(t, size+644*4096, info.FullyAllocated)
+
+	//4 times the refcount blocks with 64 bits refcounts
+	info, err = Blk_Measure(nil, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size,
+		OPT_CLUSTER_SIZE: 4096, OPT_REFCOUNT_BITS: 64})
+	assert.Nil(t, err)
+	assert.Equal(t, qcow2_calc_prealloc_size(size, 4096, 6, false), info.FullyAllocated)
+	assert.Greater(t, info.FullyAllocated, size+644*4096)
+
+	for _, options := range []map[string]any{
+		{OPT_CLUSTER_SIZE: 256}, {OPT_CLUSTER_SIZE: 4 * 1024 * 1024}, {OPT_CLUSTER_SIZE: 3 * 4096},
+		{OPT_CLUSTER_SIZE: 4096, OPT_SUBCLUSTER: true}, {OPT_REFCOUNT_BITS: 0}, {OPT_REFCOUNT_BITS: 12},
+		{OPT_REFCOUNT_BITS: 128},
+	} {
+		options[OPT_FMT] = "qcow2"
+		options[OPT_SIZE] = size
+		_, err = Blk_Measure(nil, options)
+		assert.NotNil(t, err, "%v", options)
+	}
+}
+
+func Test_measure_image(t *testing.T) {
+	var err error
+	var srcfile = "/tmp/measure_src.qcow2"
+	var dstfile = "/tmp/measure_dst.qcow2"
+	var size = uint64(64 * 1024 * 1024)
+	os.Remove(srcfile)
+	os.Remove(dstfile)
+
+	err = Blk_Create(srcfile, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	src, err := Blk_Open(srcfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	data := bytes.Repeat([]byte{0xa5}, 1024*1024)
+	for _, offset := range []uint64{0, 10 * 1024 * 1024, 50*1024*1024 + 4096} {
+		_, err = Blk_Pwrite(src, offset, data, uint64(len(data)), 0)
+		assert.Nil(t, err)
+	}
+	_, err = Blk_Pwrite_Zeroes(src, 30*1024*1024, 4*1024*1024, 0)
+	assert.Nil(t, err)
+
+	info, err := Blk_Measure(src, map[string]any{OPT_FMT: "qcow2"})
+	assert.Nil(t, err)
+	fully, err := Blk_Measure(nil, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	assert.Equal(t, fully.FullyAllocated, info.FullyAllocated)
+	//16 + 16 + 17 clusters of data
+	assert.Equal(t, fully.Required+49*DEFAULT_CLUSTER_SIZE, info.Required)
+
+	//the converted image fits into the measured size
+	err = Blk_Create(dstfile, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	dst, err := Blk_Open(dstfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	err = Blk_Convert(src, dst, &ConvertOptions{TargetIsZero: true})
+	assert.Nil(t, err)
+	Blk_Close(dst)
+	stat, err := os.Stat(dstfile)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, uint64(stat.Size()), info.Required)
+
+	Blk_Close(src)
+	os.Remove(srcfile)
+	os.Remove(dstfile)
+}
+
+func Test_measure_compressed(t *testing.T) {
+	var err error
+	var filename = "/tmp/measure_compressed.qcow2"
+	var size = uint64(64 * 1024 * 1024)
+	var l1Entry, l2Entry [8]byte
+	os.Remove(filename)
+
+	err = Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	data := bytes.Repeat([]byte{0xa5}, 1024*1024)
+	_, err = Blk_Pwrite(root, 0, data, uint64(len(data)), 0)
+	assert.Nil(t, err)
+	Blk_Close(root)
+
+	//turn the 16 data clusters into compressed clusters
+	f, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = f.ReadAt(l1Entry[:], L1_TABLE_OFFSET)
+	assert.Nil(t, err)
+	l2Offset := int64(binary.BigEndian.Uint64(l1Entry[:]) & L1E_OFFSET_MASK)
+	for i := int64(0); i < 16; i++ {
+		_, err = f.ReadAt(l2Entry[:], l2Offset+i*L2E_SIZE_NORMAL)
+		assert.Nil(t, err)
+		entry := binary.BigEndian.Uint64(l2Entry[:])
+		binary.BigEndian.PutUint64(l2Entry[:], entry&L2E_OFFSET_MASK|QCOW_OFLAG_COMPRESSED)
+		_, err = f.WriteAt(l2Entry[:], l2Offset+i*L2E_SIZE_NORMAL)
+		assert.Nil(t, err)
+	}
+	f.Close()
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, 0)
+	assert.Nil(t, err)
+	fully, err := Blk_Measure(nil, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	info, err := Blk_Measure(root, map[string]any{OPT_FMT: "qcow2"})
+	assert.Nil(t, err)
+	//the compressed clusters are written uncompressed to the new image
+	assert.Equal(t, fully.Required+16*DEFAULT_CLUSTER_SIZE, info.Required)
+	Blk_Close(root)
+	os.Remove(filename)
+}
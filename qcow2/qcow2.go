@@ -20,13 +20,16 @@ SOFTWARE.
 */
 
 import (
+	"bytes"
 	"container/list"
-	"context"
 	"encoding/binary"
 	"fmt"
+	"math"
+	"math/bits"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -39,6 +42,7 @@ func newQcow2Driver() *BlockDriver {
 		bdrv_create:          qcow2_create,
 		bdrv_open:            qcow2_open,
 		bdrv_flush_to_os:     qcow2_flush_to_os,
+		bdrv_flush_to_disk:   qcow2_flush_to_disk,
 		bdrv_pwritev_part:    qcow2_pwritev_part,
 		bdrv_preadv_part:     qcow2_preadv_part,
 		bdrv_block_status:    qcow2_block_status,
@@ -46,6 +50,7 @@ func newQcow2Driver() *BlockDriver {
 		bdrv_copy_range_from: qcow2_copy_range_from,
 		bdrv_copy_range_to:   qcow2_copy_range_to,
 		bdrv_pdiscard:        qcow2_pdiscard,
+		bdrv_measure:         qcow2_measure,
 	}
 }
 
@@ -54,6 +59,15 @@ func qcow2_close(bs *BlockDriverState) {
 		return
 	}
 	s := bs.opaque.(*BDRVQcow2State)
+	//no request may be running on the workers or the caches being torn down
+	bdrv_drained_begin(bs)
+	defer bdrv_drained_end(bs)
+	cache_clean_timer_del(bs)
+	if s.DataCache != nil {
+		qcow2_data_cache_destroy(s.DataCache)
+		s.DataCache = nil
+	}
+	qcow2_worker_pool_destroy(s.AioWorkers)
 	qcow2_cache_flush(bs, s.L2TableCache)
 	qcow2_cache_flush(bs, s.RefcountBlockCache)
 	s.L1Table = nil
@@ -72,6 +86,74 @@ func qcow2_close(bs *BlockDriverState) {
 
 }
 
+func cache_clean_timer_init(bs *BlockDriverState, cleanInterval, writebackInterval uint64) {
+	s := bs.opaque.(*BDRVQcow2State)
+	if cleanInterval == 0 && writebackInterval == 0 {
+		return
+	}
+	s.CacheTimer = &Qcow2CacheTimer{
+		CleanInterval:     cleanInterval,
+		WritebackInterval: writebackInterval,
+		stop:              make(chan struct{}),
+	}
+	s.CacheTimer.wg.Add(1)
+	go cache_clean_timer_routine(bs, s.CacheTimer)
+}
+
+func cache_clean_timer_del(bs *BlockDriverState) {
+	s := bs.opaque.(*BDRVQcow2State)
+	if s.CacheTimer == nil {
+		return
+	}
+	close(s.CacheTimer.stop)
+	s.CacheTimer.wg.Wait()
+	s.CacheTimer = nil
+}
+
+func cache_clean_timer_routine(bs *BlockDriverState, t *Qcow2CacheTimer) {
+	var cleanCh, writebackCh <-chan time.Time
+	defer t.wg.Done()
+	if t.CleanInterval > 0 {
+		ticker := time.NewTicker(time.Duration(t.CleanInterval) * time.Second)
+		defer ticker.Stop()
+		cleanCh = ticker.C
+	}
+	if t.WritebackInterval > 0 {
+		ticker := time.NewTicker(time.Duration(t.WritebackInterval) * time.Second)
+		defer ticker.Stop()
+		writebackCh = ticker.C
+	}
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-cleanCh:
+			cache_clean_timer_cb(bs)
+		case <-writebackCh:
+			metadata_writeback_timer_cb(bs)
+		}
+	}
+}
+
+// drop the entries not used since the last run
+func cache_clean_timer_cb(bs *BlockDriverState) {
+	s := bs.opaque.(*BDRVQcow2State)
+	qcow2_cache_clean_unused(s.L2TableCache)
+	qcow2_cache_clean_unused(s.RefcountBlockCache)
+}
+
+// the caches are written in the dependency order, without flushing the file,
+// so the metadata survives the process but not the host crashing. A failure
+// is kept for the next flush to return
+func metadata_writeback_timer_cb(bs *BlockDriverState) {
+	s := bs.opaque.(*BDRVQcow2State)
+	s.Qlock()
+	defer s.Qunlock()
+	if err := qcow2_write_caches(bs); err != nil && s.WritebackErr == nil {
+		s.WritebackErr = err
+	}
+}
+
 func qcow2_create(filename string, options map[string]any) error {
 
 	var err error
@@ -80,6 +162,7 @@ func qcow2_create(filename string, options map[string]any) error {
 	var child *BdrvChild
 	var enableSc bool
 	var dataFile string
+	var version uint32 = QCOW2_VERSION3
 
 	//check file name
 	if filename == "" {
@@ -108,6 +191,20 @@ func qcow2_create(filename string, options map[string]any) error {
 		dataFile = val.(string)
 	}
 
+	//compatibility level
+	if val, ok := options[OPT_COMPAT]; ok {
+		switch val.(string) {
+		case "", "1.1":
+		case "0.10":
+			version = QCOW2_VERSION2
+		default:
+			return fmt.Errorf("invalid compat level: %s", val.(string))
+		}
+	}
+	if version == QCOW2_VERSION2 && (enableSc || dataFile != "") {
+		return fmt.Errorf("subcluster and external data file require compatibility level 1.1 or above")
+	}
+
 	//now open the child
 	if child, err = bdrv_open_child(filename, "raw", options, BDRV_O_CREATE|BDRV_O_RDWR); err != nil {
 		return err
@@ -125,7 +222,7 @@ func qcow2_create(filename string, options map[string]any) error {
 	//initiate default header
 	header := &QCowHeader{
 		Magic:                 binary.BigEndian.Uint32(QCOW_MAGIC),
-		Version:               QCOW2_VERSION3,
+		Version:               version,
 		BackingFileOffset:     uint64(0),
 		BackingFileSize:       uint32(0),
 		ClusterBits:           uint32(DEFAULT_CLUSTER_BITS),
@@ -143,6 +240,9 @@ func qcow2_create(filename string, options map[string]any) error {
 		RefcountOrder:         uint32(QCOW2_REFCOUNT_ORDER), // NOTE: qemu now supported only refcount_order = 4
 		HeaderLength:          uint32(unsafe.Sizeof(QCowHeader{})),
 	}
+	if version == QCOW2_VERSION2 {
+		normalize_v2_header(header)
+	}
 	//set enable subcluster
 	if enableSc {
 		header.IncompatibleFeatures |= QCOW2_INCOMPAT_EXTL2
@@ -179,7 +279,7 @@ func qcow2_create(filename string, options map[string]any) error {
 
 	bdrv_link_child(bs, child, filename)
 	//write the header to buffer in big-endian manner
-	if _, err := Blk_Pwrite_Object(bs.current, 0, header, uint64(unsafe.Sizeof(*header))); err != nil {
+	if _, err := Blk_Pwrite_Object(bs.current, 0, header, uint64(header.HeaderLength)); err != nil {
 		return err
 	}
 	//write the data file if any
@@ -193,6 +293,7 @@ func qcow2_create(filename string, options map[string]any) error {
 			return err
 		} else {
 			bdrv_set_perm(dataChild, PERM_ALL)
+			dataChild.parent = bs
 			qcow2State.DataFile = dataChild
 		}
 
@@ -248,8 +349,14 @@ func qcow2_open(filename string, opts map[string]any, flags int) (*BlockDriverSt
 	var backing *BdrvChild
 	var enableSc bool
 	var l2CacheSize uint64
+	var l2CacheEntrySize uint64
 	var l2CacehNum uint32
 	var dataFile string
+	aioWorkers := uint64(QCOW2_DEFAULT_AIO_WORKERS)
+	aioQueueDepth := uint64(QCOW2_DEFAULT_AIO_QUEUE_DEPTH)
+	cacheCleanInterval := uint64(QCOW2_DEFAULT_CACHE_CLEAN_INTERVAL)
+	writebackInterval := uint64(QCOW2_DEFAULT_METADATA_WRITEBACK_INTERVAL)
+	var dataCacheSize uint64
 
 	//check file name
 	if filename == "" {
@@ -259,6 +366,24 @@ func qcow2_open(filename string, opts map[string]any, flags int) (*BlockDriverSt
 	if val, ok := opts[OPT_L2CACHESIZE]; ok {
 		l2CacheSize = val.(uint64)
 	}
+	if val, ok := opts[OPT_L2_CACHE_ENTRY_SIZE]; ok {
+		l2CacheEntrySize = interface2uint64(val)
+	}
+	if val, ok := opts[OPT_AIO_WORKERS]; ok {
+		aioWorkers = interface2uint64(val)
+	}
+	if val, ok := opts[OPT_AIO_QUEUE_DEPTH]; ok {
+		aioQueueDepth = interface2uint64(val)
+	}
+	if val, ok := opts[OPT_CACHE_CLEAN_INTERVAL]; ok {
+		cacheCleanInterval = interface2uint64(val)
+	}
+	if val, ok := opts[OPT_METADATA_WRITEBACK_INTERVAL]; ok {
+		writebackInterval = interface2uint64(val)
+	}
+	if val, ok := opts[OPT_DATA_CACHE_SIZE]; ok {
+		dataCacheSize = interface2uint64(val)
+	}
 
 	//now open the child
 	if child, err = bdrv_open_child(filename, "raw", opts, flags); err != nil {
@@ -272,11 +397,36 @@ func qcow2_open(filename string, opts map[string]any, flags int) (*BlockDriverSt
 	if _, err = Blk_Pread_Object(child, 0, &header, uint64(unsafe.Sizeof(header))); err != nil {
 		return nil, fmt.Errorf("qcow2 file %s read fail, err: %v", filename, err)
 	}
+	//the fields of version 3 are not part of a version 2 header
+	if header.Version == QCOW2_VERSION2 {
+		normalize_v2_header(&header)
+	}
 	//check header
 	if err = check_header(&header); err != nil {
 		return nil, err
 	}
 	child.header = &header
+	if dataCacheSize > 0 && dataCacheSize < uint64(1)<<header.ClusterBits {
+		return nil, fmt.Errorf("data cache size must be at least the cluster size (%d)", 1<<header.ClusterBits)
+	}
+
+	//read the header extensions
+	var exts []*Qcow2UnknownHeaderExt
+	if exts, err = qcow2_read_header_exts(child, &header); err != nil {
+		return nil, err
+	}
+	var backingFormat string
+	var unknownExts []*Qcow2UnknownHeaderExt
+	for _, ext := range exts {
+		switch ext.Magic {
+		case QCOW2_EXT_MAGIC_BACKING_FORMAT:
+			backingFormat = string(ext.Data)
+		case QCOW2_EXT_MAGIC_DATA_FILE:
+			dataFile = string(ext.Data)
+		default:
+			unknownExts = append(unknownExts, ext)
+		}
+	}
 
 	//read the backing file
 	var backingFile string
@@ -287,10 +437,21 @@ func qcow2_open(filename string, opts map[string]any, flags int) (*BlockDriverSt
 			return nil, fmt.Errorf("can not read backing file, err: %v", err)
 		}
 		backingFile = string(backingBytes)
-		if backing, err = bdrv_open_child(backingFile, "qcow2", opts, flags); err != nil {
-			return nil, err
-		} else {
-			bdrv_set_perm(backing, PERM_READABLE)
+		if flags&BDRV_O_NO_BACKING == 0 {
+			format := backingFormat
+			if format == "" {
+				if format, err = Blk_Probe(backingFile); err != nil {
+					return nil, err
+				}
+			}
+			//the data of the backing files is cached by the image on top,
+			//and the guest never discards into them
+			backingOpts := options_without(opts, OPT_DATA_CACHE_SIZE, OPT_DISCARD_NO_UNREF)
+			if backing, err = bdrv_open_child(backingFile, format, backingOpts, flags); err != nil {
+				return nil, err
+			} else {
+				bdrv_set_perm(backing, PERM_READABLE)
+			}
 		}
 	}
 
@@ -299,6 +460,35 @@ func qcow2_open(filename string, opts map[string]any, flags int) (*BlockDriverSt
 	}
 
 	qcow2State := initiate_qcow2_state(&header, enableSc)
+	qcow2State.BackingFormat = backingFormat
+	//which causes of freeing clusters discard them in the file
+	if val, ok := opts[OPT_DISCARD_REQUEST]; ok {
+		qcow2State.DiscardPassthrough[QCOW2_DISCARD_REQUEST] = val.(bool)
+	}
+	if val, ok := opts[OPT_DISCARD_SNAPSHOT]; ok {
+		qcow2State.DiscardPassthrough[QCOW2_DISCARD_SNAPSHOT] = val.(bool)
+	}
+	if val, ok := opts[OPT_DISCARD_OTHER]; ok {
+		qcow2State.DiscardPassthrough[QCOW2_DISCARD_OTHER] = val.(bool)
+	}
+	if val, ok := opts[OPT_DISCARD_NO_UNREF]; ok {
+		qcow2State.DiscardNoUnref = val.(bool)
+	}
+	//a version 2 image has no zero flag to keep the discarded clusters with
+	if qcow2State.DiscardNoUnref && qcow2State.QcowVersion < QCOW2_VERSION3 {
+		return nil, fmt.Errorf("discard-no-unref is only supported by qcow2 version 3 images")
+	}
+	//an l2 cache entry holds a slice of an l2 table, a whole cluster by default
+	if l2CacheEntrySize == 0 {
+		l2CacheEntrySize = uint64(qcow2State.ClusterSize)
+	}
+	if l2CacheEntrySize < MIN_L2_CACHE_ENTRY_SIZE || l2CacheEntrySize > uint64(qcow2State.ClusterSize) ||
+		l2CacheEntrySize&(l2CacheEntrySize-1) != 0 {
+		return nil, fmt.Errorf("L2 cache entry size must be a power of two between %d and the cluster size (%d)",
+			MIN_L2_CACHE_ENTRY_SIZE, qcow2State.ClusterSize)
+	}
+	qcow2State.L2SliceSize = int(l2CacheEntrySize / l2_entry_size(qcow2State))
+	qcow2State.UnknownHeaderExts = unknownExts
 	//opaque.DataFile = child
 	//initiate the BlockDriverState struct
 	bs := &BlockDriverState{
@@ -306,13 +496,16 @@ func qcow2_open(filename string, opts map[string]any, flags int) (*BlockDriverSt
 		backingFile:         backingFile,
 		opaque:              qcow2State, //initiate the BDRVQcow2State struct
 		options:             make(map[string]any),
-		SupportedWriteFlags: 0,
+		SupportedWriteFlags: BDRV_REQ_FUA,
+		SupportedZeroFlags:  BDRV_REQ_MAY_UNMAP,
 		RequestAlignment:    DEFAULT_ALIGNMENT,
 		PdiscardAlignment:   DEFAULT_CLUSTER_SIZE,
 		MaxTransfer:         DEFAULT_MAX_TRANSFER,
 		TotalSectors:        header.Size / BDRV_SECTOR_SIZE,
 		InheritsFrom:        nil,
 		OpenFlags:           flags,
+		//zeroes are written by subcluster
+		PwriteZeroesAlignment: uint32(qcow2State.SubclusterSize),
 	}
 	//update child
 	bdrv_link_child(bs, child, filename)
@@ -322,9 +515,8 @@ func qcow2_open(filename string, opts map[string]any, flags int) (*BlockDriverSt
 	}
 
 	if header.IncompatibleFeatures&QCOW2_INCOMPAT_DATA_FILE > 0 {
-		//read the header ext
-		if dataFile, err = header_ext_read_external_data_file(bs, uint64(unsafe.Sizeof(header))); err != nil {
-			return nil, err
+		if dataFile == "" {
+			return nil, fmt.Errorf("missing external data file name")
 		}
 		var dataChild *BdrvChild
 		//now open the child
@@ -333,6 +525,7 @@ func qcow2_open(filename string, opts map[string]any, flags int) (*BlockDriverSt
 		} else {
 			bdrv_set_perm(dataChild, PERM_ALL)
 			dataChild.name = dataFile
+			dataChild.parent = bs
 			qcow2State.DataFile = dataChild
 		}
 	} else {
@@ -353,17 +546,39 @@ func qcow2_open(filename string, opts map[string]any, flags int) (*BlockDriverSt
 	}
 
 	//initiate the caches
-	if l2CacheSize > 0 {
-		l2CacheSize = round_up(l2CacheSize, DEFAULT_CLUSTER_SIZE)
-		l2CacehNum = uint32(l2CacheSize / DEFAULT_CLUSTER_SIZE)
-	} else {
-		l2CacehNum = qcow2State.L1Size
-	}
-	qcow2State.L2TableCache = qcow2_cache_create(bs, l2CacehNum, qcow2State.ClusterSize)
+	//by default cover the whole image, but no more than DEFAULT_L2_CACHE, so
+	//the memory of an open image does not grow with its virtual size
+	if l2CacheSize == 0 {
+		l2CacheSize = min(uint64(qcow2State.L1Size)*uint64(qcow2State.ClusterSize), DEFAULT_L2_CACHE)
+	}
+	l2CacheSize = round_up(l2CacheSize, l2CacheEntrySize)
+	l2CacehNum = max(uint32(l2CacheSize/l2CacheEntrySize), MIN_L2_CACHE_TABLES)
+	qcow2State.L2TableCache = qcow2_cache_create(bs, l2CacehNum, uint32(l2CacheEntrySize))
 	//since the refcount block cache must be less than 50% of l2 table cache,
 	//so 50% of l2 cache is good enough for refcount block cache
-	refcountCacheNum := max(l2CacehNum/2, 1)
+	refcountCacheNum := max(uint32(l2CacheSize/2/uint64(qcow2State.ClusterSize)), 1)
 	qcow2State.RefcountBlockCache = qcow2_cache_create(bs, refcountCacheNum, qcow2State.ClusterSize)
+	//the free clusters are indexed once, rather than searched on every allocation
+	if flags&BDRV_O_RDWR != 0 {
+		if err = qcow2_free_map_init(bs); err != nil {
+			return nil, fmt.Errorf("could not index the free clusters, err: %v", err)
+		}
+	}
+
+	//sequential reads are served from the data read ahead of them
+	if dataCacheSize > 0 {
+		qcow2State.DataCache = qcow2_data_cache_create(bs, dataCacheSize)
+	}
+
+	//with no workers the requests are done task by task
+	if aioWorkers > 0 {
+		qcow2State.AioWorkers = qcow2_worker_pool_new(int(aioWorkers), int(aioQueueDepth))
+	}
+	//nothing gets dirty in a read-only image
+	if flags&BDRV_O_RDWR == 0 {
+		writebackInterval = 0
+	}
+	cache_clean_timer_init(bs, cacheCleanInterval, writebackInterval)
 
 	return bs, nil
 }
@@ -374,8 +589,6 @@ func initiate_qcow2_state(header *QCowHeader, enableSC bool) *BDRVQcow2State {
 		ClusterBits:          header.ClusterBits,
 		ClusterSize:          1 << header.ClusterBits,
 		L1Size:               header.L1Size,
-		RefcountBlockBits:    header.ClusterBits - (header.RefcountOrder - 3),
-		RefcountBlockSize:    1 << (header.ClusterBits - (header.RefcountOrder - 3)),
 		RefcountTableOffset:  header.RefcountTableOffset,
 		RefcountTableSize:    header.RefcountTableClusters << (header.ClusterBits - 3),
 		ClusterOffsetMask:    1<<(70-header.ClusterBits) - 1, //only 54 bits
@@ -383,14 +596,12 @@ func initiate_qcow2_state(header *QCowHeader, enableSC bool) *BDRVQcow2State {
 		QcowVersion:          int(header.Version),
 		ClusterAllocs:        list.New(),
 		Discards:             list.New(),
-		get_refcount:         get_refcount,
-		set_refcount:         set_refcount,
-		AioTaskRoutine:       qcow2_aio_routine,
-		Lock:                 &sync.Mutex{},
+		Lock:                 &sync.RWMutex{},
 		AutoclearFeatures:    header.AutoclearFeatures,
 		IncompatibleFeatures: header.IncompatibleFeatures,
 		CompatibleFeatures:   header.CompatibleFeatures,
 	}
+	qcow2_set_refcount_order(s, header.RefcountOrder)
 	//subcluster related
 	if enableSC {
 		s.IncompatibleFeatures |= QCOW2_INCOMPAT_EXTL2
@@ -401,7 +612,7 @@ func initiate_qcow2_state(header *QCowHeader, enableSC bool) *BDRVQcow2State {
 		s.L2Size = 1 << s.L2Bits
 		s.L2SliceSize = 1 << (header.ClusterBits - 4)
 	} else {
-		s.IncompatibleFeatures = 0
+		s.IncompatibleFeatures &^= QCOW2_INCOMPAT_EXTL2
 		s.SubclustersPerCluster = 1
 		s.SubclusterSize = 1 << header.ClusterBits
 		s.SubclusterBits = uint64(header.ClusterBits)
@@ -432,8 +643,8 @@ func check_header(header *QCowHeader) error {
 		return fmt.Errorf("not support cluster size of %d, only cluster size of 64 kib is supported", 1<<header.ClusterBits)
 	}
 	//check refcountorder
-	if header.RefcountOrder != QCOW2_REFCOUNT_ORDER {
-		return fmt.Errorf("not support refcount order of %d, only refcount order of 4 is supported", header.RefcountOrder)
+	if header.RefcountOrder > QCOW2_MAX_REFCOUNT_ORDER {
+		return fmt.Errorf("not support refcount order of %d", header.RefcountOrder)
 	}
 	//check crypt method
 	if header.CryptMethod != QCOW2_CRYPT_METHOD {
@@ -446,49 +657,76 @@ func check_header(header *QCowHeader) error {
 	return nil
 }
 
+// set the version 3 fields of a version 2 header to their implied values
+func normalize_v2_header(header *QCowHeader) {
+	header.IncompatibleFeatures = 0
+	header.CompatibleFeatures = 0
+	header.AutoclearFeatures = 0
+	header.RefcountOrder = QCOW2_REFCOUNT_ORDER
+	header.HeaderLength = QCOW2_V2_HEADER_LENGTH
+	header.CompressionType = 0
+}
+
 func qcow2_preadv_part(bs *BlockDriverState, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error {
 
+	s := bs.opaque.(*BDRVQcow2State)
+	if s.DataCache != nil {
+		return qcow2_data_cache_preadv(bs, offset, bytes, qiov, qiovOffset, flags)
+	}
+	return qcow2_do_preadv_part(bs, offset, bytes, qiov, qiovOffset, flags)
+}
+
+func qcow2_do_preadv_part(bs *BlockDriverState, offset uint64, bytes uint64,
+	qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error {
+
 	s := bs.opaque.(*BDRVQcow2State)
 	var err error
 	var curBytes uint32 /* number of bytes in current iteration */
 	var hostOffset uint64
 	var sctype QCow2SubclusterType
-	var isAio bool
+	var aio *AioTaskPool
 
-	for bytes != 0 {
+	for bytes != 0 && (aio == nil || aio_task_pool_status(aio) == nil) {
 
 		curBytes = uint32(bytes)
-		s.Qlock()
+		s.Qrlock()
 		err = qcow2_get_host_offset(bs, offset, &curBytes,
 			&hostOffset, &sctype)
-		s.Qunlock()
+		s.Qrunlock()
 		if err != nil {
 			goto out
 		}
+		if s.AioWorkers != nil {
+			//one task per cluster, so that large reads fan out over the workers
+			curBytes = min(curBytes, uint32(uint64(s.ClusterSize)-offset_into_cluster(s, offset)))
+		}
 		if sctype == QCOW2_SUBCLUSTER_ZERO_PLAIN ||
 			sctype == QCOW2_SUBCLUSTER_ZERO_ALLOC ||
 			(sctype == QCOW2_SUBCLUSTER_UNALLOCATED_PLAIN && bs.backing == nil) ||
 			(sctype == QCOW2_SUBCLUSTER_UNALLOCATED_ALLOC && bs.backing == nil) {
 			qemu_iovec_memset(qiov, qiovOffset, 0, uint64(curBytes))
 		} else {
-			if !isAio && curBytes != uint32(bytes) {
-				isAio = true
+			if aio == nil && s.AioWorkers != nil && curBytes != uint32(bytes) {
+				aio = aio_task_pool_new()
 			}
-			if err = qcow2_add_task(bs, isAio, qcow2_preadv_task_entry, sctype,
+			if err = qcow2_add_task(bs, aio, qcow2_preadv_task_entry, sctype,
 				hostOffset, offset, uint64(curBytes),
-				qiov, qiovOffset, nil); err != nil {
+				qiov, qiovOffset, nil, 0); err != nil {
 				goto out
 			}
-			/*if err = qcow2_preadv_task(bs, sctype, hostOffset, offset, bytes, qiov, qiovOffset); err != nil {
-				goto out
-			}*/
 		}
 		bytes -= uint64(curBytes)
 		offset += uint64(curBytes)
 		qiovOffset += uint64(curBytes)
 	}
 out:
+	if aio != nil {
+		aio_task_pool_wait_all(aio)
+		if err == nil {
+			err = aio_task_pool_status(aio)
+		}
+	}
 	return err
 }
 
@@ -501,9 +739,12 @@ func qcow2_pwritev_part(bs *BlockDriverState, offset uint64, bytes uint64,
 	var curBytes uint64 /* number of sectors in current iteration */
 	var hostOffset uint64
 	var l2meta *QCowL2Meta
-	var isAio bool
+	var aio *AioTaskPool
 
-	for bytes != 0 {
+	//whatever was read ahead of the range is stale once it's written
+	defer qcow2_data_cache_invalidate(bs, offset, bytes)
+
+	for bytes != 0 && (aio == nil || aio_task_pool_status(aio) == nil) {
 
 		l2meta = nil
 		curBytes = bytes
@@ -518,10 +759,10 @@ func qcow2_pwritev_part(bs *BlockDriverState, offset uint64, bytes uint64,
 		}
 		s.Qunlock()
 
-		if !isAio && curBytes != bytes {
-			isAio = true
+		if aio == nil && s.AioWorkers != nil && curBytes != bytes {
+			aio = aio_task_pool_new()
 		}
-		err = qcow2_add_task(bs, isAio, qcow2_pwritev_task_entry, 0, hostOffset, offset, curBytes, qiov, qiovOffset, l2meta)
+		err = qcow2_add_task(bs, aio, qcow2_pwritev_task_entry, 0, hostOffset, offset, curBytes, qiov, qiovOffset, l2meta, flags)
 		l2meta = nil /* l2meta is consumed by qcow2_co_pwritev_task() */
 		if err != nil {
 			goto fail_nometa
@@ -539,6 +780,12 @@ out_locked:
 	qcow2_handle_l2meta(bs, &l2meta, false)
 	s.Qunlock()
 fail_nometa:
+	if aio != nil {
+		aio_task_pool_wait_all(aio)
+		if err == nil {
+			err = aio_task_pool_status(aio)
+		}
+	}
 	return err
 }
 
@@ -577,6 +824,9 @@ func qcow2_pwrite_zeroes(bs *BlockDriverState, offset uint64, bytes uint64, flag
 				sctype != QCOW2_SUBCLUSTER_ZERO_PLAIN &&
 				sctype != QCOW2_SUBCLUSTER_ZERO_ALLOC) {
 			s.Qunlock()
+			if err == nil {
+				err = ERR_ENOTSUP
+			}
 			return err
 		}
 	} else {
@@ -586,6 +836,7 @@ func qcow2_pwrite_zeroes(bs *BlockDriverState, offset uint64, bytes uint64, flag
 	/* Whatever is left can use real zero subclusters */
 	err = qcow2_subcluster_zeroize(bs, offset, bytes, int(flags))
 	s.Qunlock()
+	qcow2_data_cache_invalidate(bs, offset, bytes)
 
 	return err
 }
@@ -606,6 +857,7 @@ func qcow2_handle_l2meta(bs *BlockDriverState, pl2meta **QCowL2Meta, linkL2 bool
 		}
 
 		s.ClusterAllocs.Remove(l2meta.NextInFlight)
+		l2meta.DependentRequests.Broadcast()
 		l2meta = l2meta.Next
 	}
 
@@ -637,10 +889,11 @@ func qcow2_preadv_task(bs *BlockDriverState, scType QCow2SubclusterType,
 }
 
 func qcow2_pwritev_task(bs *BlockDriverState, hostOffset uint64, offset uint64,
-	bytes uint64, qiov *QEMUIOVector, qiovOffset uint64, l2meta *QCowL2Meta) error {
+	bytes uint64, qiov *QEMUIOVector, qiovOffset uint64, l2meta *QCowL2Meta, flags BdrvRequestFlags) error {
 
 	var err error
 	s := bs.opaque.(*BDRVQcow2State)
+	allocated := l2meta != nil
 
 	/* Try to efficiently initialize the physical space with zeroes */
 	if err = handle_alloc_space(bs, l2meta); err != nil {
@@ -649,13 +902,20 @@ func qcow2_pwritev_task(bs *BlockDriverState, hostOffset uint64, offset uint64,
 
 	if !merge_cow(offset, bytes, qiov, qiovOffset, l2meta) {
 		if err = bdrv_pwritev_part(s.DataFile, hostOffset,
-			bytes, qiov, qiovOffset, 0); err != nil {
+			bytes, qiov, qiovOffset, flags&BDRV_REQ_FUA); err != nil {
 			goto out_unlocked
 		}
 	}
 
 	s.Qlock()
 	err = qcow2_handle_l2meta(bs, &l2meta, true)
+	if err == nil && allocated && flags&BDRV_REQ_FUA > 0 {
+		/* The new mapping must be as durable as the data, and so must
+		 * the COW areas, which are written without FUA */
+		if err = qcow2_flush_caches(bs); err == nil && has_data_file(bs) {
+			err = bdrv_flush(s.DataFile.bs)
+		}
+	}
 	goto out_locked
 
 out_unlocked:
@@ -787,14 +1047,176 @@ func qcow2_flush_to_os(bs *BlockDriverState) error {
 	s := bs.opaque.(*BDRVQcow2State)
 	s.Qlock()
 	defer s.Qunlock()
-	return qcow2_write_caches(bs)
+	err := qcow2_write_caches(bs)
+	//the background writeback failed since the last flush
+	if s.WritebackErr != nil {
+		err = s.WritebackErr
+		s.WritebackErr = nil
+	}
+	return err
+}
+
+// the image file is flushed by the block layer, the external data file is not
+func qcow2_flush_to_disk(bs *BlockDriverState) error {
+	s := bs.opaque.(*BDRVQcow2State)
+	if has_data_file(bs) {
+		return bdrv_flush(s.DataFile.bs)
+	}
+	return nil
 }
 
+/*
+ * Calculate the size of the refcount table and blocks needed to cover the
+ * given number of clusters, including the clusters of the refcount metadata
+ * itself. With generousIncrease, some room is left for the refcount table to
+ * grow.
+ */
 func qcow2_refcount_metadata_size(clusters uint64, clusterSize uint64, refcountOrder int,
 	generousIncrease bool, refblockCount *uint64) (uint64, error) {
-	//TODO2
-	//so far never reach here due to qcow2 file is limited to 4TiB
-	return 0, nil
+
+	blocksPerTableCluster := clusterSize / REFTABLE_ENTRY_SIZE
+	refcountsPerBlock := clusterSize * 8 / (1 << refcountOrder)
+	var table, blocks uint64
+	var last, n uint64
+
+	for {
+		last = n
+		blocks = div_round_up(clusters+table+blocks, refcountsPerBlock)
+		table = div_round_up(blocks, blocksPerTableCluster)
+		n = clusters + blocks + table
+
+		if n == last && generousIncrease {
+			clusters += div_round_up(table, 2)
+			n = 0 /* force another loop */
+			generousIncrease = false
+		}
+		if n == last {
+			break
+		}
+	}
+
+	if refblockCount != nil {
+		*refblockCount = blocks
+	}
+	return (blocks + table) * clusterSize, nil
+}
+
+// the size of a fully allocated image, including all the metadata
+func qcow2_calc_prealloc_size(totalSize uint64, clusterSize uint64, refcountOrder int, extendedL2 bool) uint64 {
+
+	var metaSize, nl1e, nl2e uint64
+	alignedTotalSize := round_up(totalSize, clusterSize)
+	l2eSize := uint64(L2E_SIZE_NORMAL)
+	if extendedL2 {
+		l2eSize = L2E_SIZE_EXTENDED
+	}
+
+	/* header: 1 cluster */
+	metaSize += clusterSize
+
+	/* total size of L2 tables */
+	nl2e = alignedTotalSize / clusterSize
+	nl2e = round_up(nl2e, clusterSize/l2eSize)
+	metaSize += nl2e * l2eSize
+
+	/* total size of L1 tables */
+	nl1e = nl2e * l2eSize / clusterSize
+	nl1e = round_up(nl1e, clusterSize/L1E_SIZE)
+	metaSize += nl1e * L1E_SIZE
+
+	/* total size of refcount table and blocks */
+	refcountSize, _ := qcow2_refcount_metadata_size((metaSize+alignedTotalSize)/clusterSize,
+		clusterSize, refcountOrder, false, nil)
+	metaSize += refcountSize
+
+	return metaSize + alignedTotalSize
+}
+
+/*
+ * Measure the size of a new qcow2 image of the given options, holding the
+ * content of in if any. The new image is never written compressed, so the
+ * compressed clusters of the input count with a full cluster of the new image.
+ */
+func qcow2_measure(options map[string]any, in *BlockDriverState) (*BlockMeasureInfo, error) {
+
+	var err error
+	var virtualSize, required, offset, size, pnum, ret uint64
+	var enableSc, hasBacking bool
+	clusterSize := uint64(DEFAULT_CLUSTER_SIZE)
+	refcountOrder := QCOW2_REFCOUNT_ORDER
+
+	if val, ok := options[OPT_SUBCLUSTER]; ok {
+		enableSc = val.(bool)
+	}
+	if val, ok := options[OPT_BACKING]; ok {
+		hasBacking = val.(string) != ""
+	}
+	if val, ok := options[OPT_CLUSTER_SIZE]; ok {
+		clusterSize = interface2uint64(val)
+		if clusterSize < 1<<MIN_CLUSTER_BITS || clusterSize > 1<<MAX_CLUSTER_BITS ||
+			clusterSize&(clusterSize-1) != 0 {
+			return nil, fmt.Errorf("cluster size must be a power of two between %d and %dk",
+				1<<MIN_CLUSTER_BITS, 1<<(MAX_CLUSTER_BITS-10))
+		}
+	}
+	if enableSc && clusterSize < 16*1024 {
+		return nil, fmt.Errorf("subclusters are only supported with cluster sizes of at least 16k")
+	}
+	if val, ok := options[OPT_REFCOUNT_BITS]; ok {
+		refcountBits := interface2uint64(val)
+		if refcountBits == 0 || refcountBits > 64 || refcountBits&(refcountBits-1) != 0 {
+			return nil, fmt.Errorf("refcount width must be a power of two and may not exceed 64 bits")
+		}
+		refcountOrder = bits.TrailingZeros64(refcountBits)
+	}
+	if val, ok := options[OPT_SIZE]; ok {
+		virtualSize = round_up(interface2uint64(val), clusterSize)
+	} else if in != nil {
+		if size, err = bdrv_getlength(in); err != nil {
+			return nil, err
+		}
+		virtualSize = round_up(size, clusterSize)
+	} else {
+		return nil, Err_IncompleteParameters
+	}
+
+	if in != nil {
+		if size, err = bdrv_getlength(in); err != nil {
+			return nil, err
+		}
+		if hasBacking {
+			/* We don't know how much of the backing chain is shared by the
+			 * input image and the new image, assume all of it needs to be written */
+			required = virtualSize
+		} else {
+			for offset = 0; offset < size; offset += pnum {
+				if ret, err = bdrv_block_status_above(in, nil, offset, size-offset,
+					&pnum, nil, nil); err != nil {
+					return nil, err
+				}
+				if pnum == 0 {
+					break
+				}
+				if ret&BDRV_BLOCK_ZERO > 0 {
+					/* Skip zero regions (safe with no backing file) */
+				} else if ret&(BDRV_BLOCK_DATA|BDRV_BLOCK_ALLOCATED) ==
+					(BDRV_BLOCK_DATA | BDRV_BLOCK_ALLOCATED) {
+					/* Compressed clusters are data too, they are written
+					 * uncompressed. Extend pnum to end of cluster for next iteration */
+					pnum = round_up(offset+pnum, clusterSize) - offset
+					/* Count clusters we've seen */
+					required += offset%clusterSize + pnum
+				}
+			}
+		}
+	}
+
+	fullyAllocated := qcow2_calc_prealloc_size(virtualSize, clusterSize, refcountOrder, enableSc)
+	return &BlockMeasureInfo{
+		FullyAllocated: fullyAllocated,
+		//metadata needed for the fully allocated image is still counted
+		Required: fullyAllocated - virtualSize + min(required, virtualSize),
+	}, nil
 }
 
 func qcow2_block_status(bs *BlockDriverState, wantZero bool, offset uint64,
@@ -806,10 +1228,10 @@ func qcow2_block_status(bs *BlockDriverState, wantZero bool, offset uint64,
 	var status uint64
 	var err error
 
-	s.Qlock()
-	bytes = uint32(count)
+	s.Qrlock()
+	bytes = uint32(min(count, math.MaxInt32))
 	err = qcow2_get_host_offset(bs, offset, &bytes, &hostOffset, &scType)
-	s.Qunlock()
+	s.Qrunlock()
 	if err != nil {
 		return 0, err
 	}
@@ -833,18 +1255,106 @@ func qcow2_block_status(bs *BlockDriverState, wantZero bool, offset uint64,
 	return status, nil
 }
 
+// copy the clusters of the range from the file, or the backing file, holding them
 func qcow2_copy_range_from(bs *BlockDriverState, src *BdrvChild, offset uint64,
 	dst *BdrvChild, dstOffset uint64, bytes uint64,
 	readFlags BdrvRequestFlags, writeFlags BdrvRequestFlags) error {
-	//do nothing
-	return fmt.Errorf("[qcow2_copy_range_from] no implementation")
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var err error
+	var curBytes uint32
+	var copyOffset, backingLength uint64
+	var sctype QCow2SubclusterType
+	var child *BdrvChild
+	var curWriteFlags BdrvRequestFlags
+
+	for bytes != 0 {
+		curBytes = uint32(min(bytes, math.MaxInt32))
+		curWriteFlags = writeFlags
+		child = nil
+
+		s.Qrlock()
+		err = qcow2_get_host_offset(bs, offset, &curBytes, &copyOffset, &sctype)
+		s.Qrunlock()
+		if err != nil {
+			return err
+		}
+
+		switch sctype {
+		case QCOW2_SUBCLUSTER_UNALLOCATED_PLAIN, QCOW2_SUBCLUSTER_UNALLOCATED_ALLOC:
+			if bs.backing == nil {
+				curWriteFlags |= BDRV_REQ_ZERO_WRITE
+				break
+			}
+			if backingLength, err = bdrv_getlength(bs.backing.bs); err != nil {
+				return err
+			}
+			if offset >= backingLength {
+				curWriteFlags |= BDRV_REQ_ZERO_WRITE
+			} else {
+				child = bs.backing
+				curBytes = uint32(min(uint64(curBytes), backingLength-offset))
+				copyOffset = offset
+			}
+		case QCOW2_SUBCLUSTER_ZERO_PLAIN, QCOW2_SUBCLUSTER_ZERO_ALLOC:
+			curWriteFlags |= BDRV_REQ_ZERO_WRITE
+		case QCOW2_SUBCLUSTER_COMPRESSED:
+			return ERR_ENOTSUP
+		case QCOW2_SUBCLUSTER_NORMAL:
+			child = s.DataFile
+		default:
+			return ERR_EIO
+		}
+
+		if err = bdrv_copy_range_from(child, copyOffset, dst, dstOffset, uint64(curBytes),
+			readFlags, curWriteFlags); err != nil {
+			return err
+		}
+		bytes -= uint64(curBytes)
+		offset += uint64(curBytes)
+		dstOffset += uint64(curBytes)
+	}
+	return nil
 }
 
+// allocate the clusters of the range and copy the data into them
 func qcow2_copy_range_to(bs *BlockDriverState, src *BdrvChild, offset uint64,
 	dst *BdrvChild, dstOffset uint64, bytes uint64,
 	readFlags BdrvRequestFlags, writeFlags BdrvRequestFlags) error {
-	//do nothing
-	return fmt.Errorf("[qcow2_copy_range_to] no implementation")
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var err error
+	var curBytes, hostOffset uint64
+	var l2meta *QCowL2Meta
+
+	defer qcow2_data_cache_invalidate(bs, dstOffset, bytes)
+
+	s.Qlock()
+	for bytes != 0 {
+		l2meta = nil
+		curBytes = bytes
+
+		if err = qcow2_alloc_host_offset(bs, dstOffset, &curBytes, &hostOffset, &l2meta); err != nil {
+			goto fail
+		}
+		s.Qunlock()
+		err = bdrv_copy_range_to(src, offset, s.DataFile, hostOffset, curBytes, readFlags, writeFlags)
+		s.Qlock()
+		if err != nil {
+			goto fail
+		}
+		if err = qcow2_handle_l2meta(bs, &l2meta, true); err != nil {
+			goto fail
+		}
+		bytes -= curBytes
+		offset += curBytes
+		dstOffset += curBytes
+	}
+
+fail:
+	qcow2_handle_l2meta(bs, &l2meta, false)
+	s.Qunlock()
+	return err
 }
 
 func qcow2_pdiscard(bs *BlockDriverState, offset uint64, bytes uint64) error {
@@ -857,8 +1367,10 @@ func qcow2_pdiscard(bs *BlockDriverState, offset uint64, bytes uint64) error {
 		}
 	}
 	s.Qlock()
-	defer s.Qunlock()
-	return qcow2_cluster_discard(bs, offset, bytes, QCOW2_DISCARD_REQUEST, false)
+	err := qcow2_cluster_discard(bs, offset, bytes, QCOW2_DISCARD_REQUEST, false)
+	s.Qunlock()
+	qcow2_data_cache_invalidate(bs, offset, bytes)
+	return err
 }
 
 //write the ext header after the qcow2 regular header
@@ -879,31 +1391,122 @@ func header_ext_add_external_data_file(bs *BlockDriverState, offset uint64, data
 	return nil
 }
 
-func header_ext_read_external_data_file(bs *BlockDriverState, offset uint64) (string, error) {
+/*
+ * Read the header extensions, which start right after the header and end
+ * with an end marker, the end of the first cluster or the backing file name.
+ */
+func qcow2_read_header_exts(child *BdrvChild, header *QCowHeader) ([]*Qcow2UnknownHeaderExt, error) {
 
+	var exts []*Qcow2UnknownHeaderExt
 	var extHeader QCowExtension
 	extLen := uint64(unsafe.Sizeof(extHeader))
-	//read the ext header
-	if _, err := Blk_Pread_Object(bs.current, offset, &extHeader, extLen); err != nil {
-		return "", fmt.Errorf("qcow2 external data file read fail, err: %v", err)
+	offset := uint64(header.HeaderLength)
+	end := uint64(1) << header.ClusterBits
+	if header.BackingFileOffset > 0 && header.BackingFileOffset < end {
+		end = header.BackingFileOffset
 	}
-	if extHeader.Magic != QCOW2_EXT_MAGIC_DATA_FILE || extHeader.Length == 0 {
-		return "", nil
+
+	for offset+extLen <= end {
+		if _, err := Blk_Pread_Object(child, offset, &extHeader, extLen); err != nil {
+			return nil, fmt.Errorf("qcow2 header extension read fail, err: %v", err)
+		}
+		if extHeader.Magic == QCOW2_EXT_MAGIC_END {
+			break
+		}
+		offset += extLen
+		if offset+uint64(extHeader.Length) > end {
+			return nil, fmt.Errorf("qcow2 header extension 0x%x is too large", extHeader.Magic)
+		}
+		ext := &Qcow2UnknownHeaderExt{
+			Magic: extHeader.Magic,
+			Data:  make([]byte, extHeader.Length),
+		}
+		if extHeader.Length > 0 {
+			if _, err := Blk_Pread(child, offset, ext.Data, uint64(extHeader.Length)); err != nil {
+				return nil, fmt.Errorf("qcow2 header extension read fail, err: %v", err)
+			}
+		}
+		exts = append(exts, ext)
+		offset += round_up(uint64(extHeader.Length), 8)
 	}
-	//read the data file path
-	var dataFile string
-	bytes := make([]byte, extHeader.Length)
-	if _, err := Blk_Pread_Object(bs.current, offset+extLen, bytes, uint64(extHeader.Length)); err != nil {
-		return "", fmt.Errorf("qcow2 external data file read fail, err: %v", err)
-	} else {
-		dataFile = string(bytes)
+	return exts, nil
+}
+
+/*
+ * Rewrite the first cluster of the image from the in-memory state: the
+ * header, the header extensions and the backing file name.
+ * The header is at the start of the cluster so that its fields are updated
+ * by a single sector write.
+ */
+func qcow2_update_header(bs *BlockDriverState) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var buffer bytes.Buffer
+	var err error
+	var exts []*Qcow2UnknownHeaderExt
+
+	header := *bs.current.header
+	header.Version = uint32(s.QcowVersion)
+	header.L1Size = s.L1Size
+	header.L1TableOffset = s.L1TableOffset
+	header.RefcountTableOffset = s.RefcountTableOffset
+	header.RefcountTableClusters = s.RefcountTableSize >> (s.ClusterBits - 3)
+	header.RefcountOrder = s.RefcountOrder
+	header.IncompatibleFeatures = s.IncompatibleFeatures
+	header.CompatibleFeatures = s.CompatibleFeatures
+	header.AutoclearFeatures = s.AutoclearFeatures
+	header.HeaderLength = uint32(unsafe.Sizeof(header))
+	if s.QcowVersion == QCOW2_VERSION2 {
+		normalize_v2_header(&header)
+	}
+
+	if s.BackingFormat != "" {
+		exts = append(exts, &Qcow2UnknownHeaderExt{Magic: QCOW2_EXT_MAGIC_BACKING_FORMAT, Data: []byte(s.BackingFormat)})
+	}
+	if has_data_file(bs) {
+		exts = append(exts, &Qcow2UnknownHeaderExt{Magic: QCOW2_EXT_MAGIC_DATA_FILE, Data: []byte(s.DataFile.name)})
+	}
+	exts = append(exts, s.UnknownHeaderExts...)
+
+	//header extensions, each padded to 8 bytes, and the end marker
+	var extBuffer bytes.Buffer
+	for _, ext := range exts {
+		binary.Write(&extBuffer, binary.BigEndian, &QCowExtension{Magic: ext.Magic, Length: uint32(len(ext.Data))})
+		extBuffer.Write(ext.Data)
+		extBuffer.Write(make([]byte, round_up(uint64(len(ext.Data)), 8)-uint64(len(ext.Data))))
+	}
+	binary.Write(&extBuffer, binary.BigEndian, &QCowExtension{Magic: QCOW2_EXT_MAGIC_END})
+
+	//the backing file name follows the header extensions
+	header.BackingFileOffset = 0
+	header.BackingFileSize = 0
+	if bs.backingFile != "" {
+		header.BackingFileOffset = uint64(header.HeaderLength) + uint64(extBuffer.Len())
+		header.BackingFileSize = uint32(len(bs.backingFile))
+	}
+
+	binary.Write(&buffer, binary.BigEndian, &header)
+	buffer.Truncate(int(header.HeaderLength))
+	buffer.Write(extBuffer.Bytes())
+	buffer.WriteString(bs.backingFile)
+	if uint64(buffer.Len()) > uint64(s.ClusterSize) {
+		return ERR_ENOSPC
+	}
+	buffer.Write(make([]byte, int(s.ClusterSize)-buffer.Len()))
+
+	if err = bdrv_pwrite(bs.current, 0, unsafe.Pointer(&buffer.Bytes()[0]), uint64(s.ClusterSize)); err != nil {
+		return err
 	}
-	return dataFile, nil
+	if err = bdrv_flush(bs.current.bs); err != nil {
+		return err
+	}
+	*bs.current.header = header
+	return nil
 }
 
 func qcow2_pwritev_task_entry(task *Qcow2Task) error {
 	Assert(task.subclusterType == 0)
-	return qcow2_pwritev_task(task.bs, task.hostOffset, task.offset, task.bytes, task.qiov, task.qiovOffset, task.l2meta)
+	return qcow2_pwritev_task(task.bs, task.hostOffset, task.offset, task.bytes, task.qiov, task.qiovOffset, task.l2meta, task.flags)
 }
 
 func qcow2_preadv_task_entry(task *Qcow2Task) error {
@@ -911,11 +1514,14 @@ func qcow2_preadv_task_entry(task *Qcow2Task) error {
 	return qcow2_preadv_task(task.bs, task.subclusterType, task.hostOffset, task.offset, task.bytes, task.qiov, task.qiovOffset)
 }
 
-func qcow2_add_task(bs *BlockDriverState, isAio bool, taskfunc AioTaskFunc, subclusterType QCow2SubclusterType,
+/*
+ * run the task right away, or on the workers if the request is split
+ * into several tasks tracked by aio.
+ */
+func qcow2_add_task(bs *BlockDriverState, aio *AioTaskPool, taskfunc AioTaskFunc, subclusterType QCow2SubclusterType,
 	hostOffset uint64, offset uint64, bytes uint64, qiov *QEMUIOVector, qiovOffset uint64,
-	l2meta *QCowL2Meta) error {
+	l2meta *QCowL2Meta, flags BdrvRequestFlags) error {
 
-	var err error
 	s := bs.opaque.(*BDRVQcow2State)
 	task := &Qcow2Task{
 		taskFunc:       taskfunc,
@@ -927,27 +1533,12 @@ func qcow2_add_task(bs *BlockDriverState, isAio bool, taskfunc AioTaskFunc, subc
 		bytes:          bytes,
 		qiovOffset:     qiovOffset,
 		l2meta:         l2meta,
-		completeCh:     make(chan any, 1),
-		errorCh:        make(chan error, 1),
+		flags:          flags,
 	}
 
-	if !isAio {
+	if aio == nil {
 		return taskfunc(task)
 	}
-
-	if s.AioTaskList == nil {
-		s.Qlock()
-		if s.AioTaskList == nil {
-			s.AioTaskList = NewSignalList()
-			go s.AioTaskRoutine(context.Background(), s.AioTaskList)
-		}
-		s.Qunlock()
-	}
-
-	s.AioTaskList.Push(task)
-	select {
-	case <-task.completeCh:
-	case err = <-task.errorCh:
-	}
-	return err
+	aio_task_pool_start_task(s.AioWorkers, aio, task)
+	return nil
 }
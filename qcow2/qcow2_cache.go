@@ -20,7 +20,9 @@ SOFTWARE.
 */
 
 import (
+	"container/list"
 	"math"
+	"sync"
 	"unsafe"
 )
 
@@ -29,6 +31,12 @@ type Qcow2CachedTable struct {
 	lruCounter uint64
 	ref        int
 	dirty      bool
+	//the table is allocated when it's loaded and dropped by the cache
+	//manager, elem is its place in the lru list while it's not in use
+	buf   []byte
+	cache *Qcow2Cache
+	index int
+	elem  *list.Element
 }
 
 type Qcow2Cache struct {
@@ -37,22 +45,39 @@ type Qcow2Cache struct {
 	size                 int
 	tableSize            int
 	dependsOnFlush       bool
-	tableArray           []byte
+	tables               map[unsafe.Pointer]int
+	align                uint64
+	bs                   *BlockDriverState
 	lruCounter           uint64
 	cacheCleanLruCounter uint64
+
+	//lookups run under the shared lock of the image, so the entries
+	//have a lock of their own. freed is signalled when a table is put
+	lock  sync.Mutex
+	freed *sync.Cond
 }
 
 func qcow2_cache_get_table_addr(c *Qcow2Cache, tableIndex int) unsafe.Pointer {
-	return unsafe.Pointer(&c.tableArray[tableIndex*c.tableSize])
+	if c.entries[tableIndex].buf == nil {
+		return nil
+	}
+	return unsafe.Pointer(&c.entries[tableIndex].buf[0])
 }
 
+// c.lock must be held
 func qcow2_cache_get_table_idx(c *Qcow2Cache, table unsafe.Pointer) int {
-	tableOffset := int(uintptr(table) - uintptr(unsafe.Pointer(&c.tableArray[0])))
-	tableIdx := tableOffset / c.tableSize
-	Assert(tableIdx >= 0 && tableIdx < c.size && tableOffset%c.tableSize == 0)
+	tableIdx, ok := c.tables[table]
+	Assert(ok && tableIdx >= 0 && tableIdx < c.size)
 	return tableIdx
 }
 
+// c.lock must be held
+func qcow2_cache_table_alloc(c *Qcow2Cache, i int) {
+	qcow2_cache_manager_reserve(c)
+	c.entries[i].buf = qemu_memalign(c.align, uint64(c.tableSize))
+	c.tables[qcow2_cache_get_table_addr(c, i)] = i
+}
+
 func qcow2_cache_get_name(s *BDRVQcow2State, c *Qcow2Cache) string {
 	if c == s.RefcountBlockCache {
 		return "refcount block"
@@ -63,8 +88,16 @@ func qcow2_cache_get_name(s *BDRVQcow2State, c *Qcow2Cache) string {
 	}
 }
 
+// give the memory of the unused tables back to the cache manager, c.lock must be held
 func qcow2_cache_table_release(c *Qcow2Cache, i, numTables int) {
-	//do nothing
+	m := qcow2CacheManager
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for ; numTables > 0; i, numTables = i+1, numTables-1 {
+		if c.entries[i].buf != nil && c.entries[i].ref == 0 {
+			qcow2_cache_manager_free(m, c, &c.entries[i])
+		}
+	}
 }
 
 func can_clean_entry(c *Qcow2Cache, i int) bool {
@@ -72,10 +105,12 @@ func can_clean_entry(c *Qcow2Cache, i int) bool {
 	return t.ref == 0 && !t.dirty && t.offset != 0 && t.lruCounter <= c.cacheCleanLruCounter
 }
 
-// actually we never clean cache since it will auto evict caches during "cache get"
+// run by the background goroutine of the image every cache-clean-interval
 func qcow2_cache_clean_unused(c *Qcow2Cache) {
 
 	var i int
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	for i < c.size {
 		var toClean int
 
@@ -105,27 +140,50 @@ func qcow2_cache_create(bs *BlockDriverState, numTables uint32, tableSize uint32
 	if bs != nil {
 		s := bs.opaque.(*BDRVQcow2State)
 		Assert(numTables > 0)
-		Assert(tableSize >= (1 << DEFAULT_CLUSTER_BITS))
+		Assert(tableSize >= MIN_L2_CACHE_ENTRY_SIZE)
 		Assert(tableSize <= s.ClusterSize)
 	}
 
+	align := uint64(DEFAULT_ALIGNMENT)
+	if bs != nil {
+		align = bdrv_opt_mem_align(bs)
+	}
+	//the tables themselves are allocated on demand, within the budget
+	//of the cache manager
 	c := &Qcow2Cache{
-		size:       int(numTables),
-		tableSize:  int(tableSize),
-		entries:    make([]Qcow2CachedTable, numTables),
-		tableArray: make([]byte, numTables*tableSize),
+		size:      int(numTables),
+		tableSize: int(tableSize),
+		entries:   make([]Qcow2CachedTable, numTables),
+		tables:    make(map[unsafe.Pointer]int),
+		align:     align,
+		bs:        bs,
 	}
-	if c.entries == nil || c.tableArray == nil {
-		return nil
+	for i := range c.entries {
+		c.entries[i].cache = c
+		c.entries[i].index = i
 	}
+	c.freed = sync.NewCond(&c.lock)
 	return c
 }
 
 func qcow2_cache_destroy(c *Qcow2Cache) error {
-	//do nothing
+	if c == nil {
+		return nil
+	}
+	m := qcow2CacheManager
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i := int(0); i < c.size; i++ {
+		if c.entries[i].buf != nil {
+			qcow2_cache_manager_free(m, c, &c.entries[i])
+		}
+	}
 	return nil
 }
 
+// c.lock must be held
 func qcow2_cache_flush_dependency(bs *BlockDriverState, c *Qcow2Cache) error {
 
 	var err error
@@ -138,6 +196,7 @@ func qcow2_cache_flush_dependency(bs *BlockDriverState, c *Qcow2Cache) error {
 	return nil
 }
 
+// c.lock must be held
 func qcow2_cache_entry_flush(bs *BlockDriverState, c *Qcow2Cache, i int) error {
 
 	var err error
@@ -167,6 +226,8 @@ func qcow2_cache_entry_flush(bs *BlockDriverState, c *Qcow2Cache, i int) error {
 func qcow2_cache_write(bs *BlockDriverState, c *Qcow2Cache) error {
 
 	var err, ret error
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	for i := int(0); i < c.size; i++ {
 		if err = qcow2_cache_entry_flush(bs, c, i); err != nil && err != ERR_ENOSPC {
 			ret = err
@@ -188,11 +249,16 @@ func qcow2_cache_flush(bs *BlockDriverState, c *Qcow2Cache) error {
 func qcow2_cache_set_dependency(bs *BlockDriverState, c, dependency *Qcow2Cache) error {
 
 	var err error
+	dependency.lock.Lock()
 	if dependency.depends != nil {
-		if err = qcow2_cache_flush_dependency(bs, dependency); err != nil {
-			return err
-		}
+		err = qcow2_cache_flush_dependency(bs, dependency)
 	}
+	dependency.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	if c.depends != nil && c.depends != dependency {
 		if err = qcow2_cache_flush_dependency(bs, c); err != nil {
 			return err
@@ -203,7 +269,9 @@ func qcow2_cache_set_dependency(bs *BlockDriverState, c, dependency *Qcow2Cache)
 }
 
 func qcow2_cache_depends_on_flush(c *Qcow2Cache) {
+	c.lock.Lock()
 	c.dependsOnFlush = true
+	c.lock.Unlock()
 }
 
 func qcow2_cache_empty(bs *BlockDriverState, c *Qcow2Cache) error {
@@ -212,6 +280,8 @@ func qcow2_cache_empty(bs *BlockDriverState, c *Qcow2Cache) error {
 	if err = qcow2_cache_flush(bs, c); err != nil {
 		return err
 	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	for i := int(0); i < c.size; i++ {
 		Assert(c.entries[i].ref == 0)
 		c.entries[i].offset = 0
@@ -231,6 +301,9 @@ func qcow2_cache_do_get(bs *BlockDriverState, c *Qcow2Cache, offset uint64, read
 	minLruIndex := int(-1)
 
 	Assert(offset != 0)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+retry:
 	// Check if the table is already cached
 	lookupIndex = (int(offset) / c.tableSize * 4) % c.size
 	i = lookupIndex
@@ -253,12 +326,22 @@ func qcow2_cache_do_get(bs *BlockDriverState, c *Qcow2Cache, offset uint64, read
 	}
 
 	// Cache miss: write a table back and replace it
+	if minLruIndex < 0 {
+		//all the tables are in use by the concurrent lookups
+		c.freed.Wait()
+		minLruCounter = math.MaxUint64
+		minLruIndex = -1
+		goto retry
+	}
 	i = minLruIndex
 	if err = qcow2_cache_entry_flush(bs, c, i); err != nil {
 		return nil, err
 	}
 
 	c.entries[i].offset = 0
+	if c.entries[i].buf == nil {
+		qcow2_cache_table_alloc(c, i)
+	}
 	if readFromDisk {
 		//the object's size must be obtainable
 		if err = bdrv_pread(bs.current, offset,
@@ -268,6 +351,9 @@ func qcow2_cache_do_get(bs *BlockDriverState, c *Qcow2Cache, offset uint64, read
 	}
 	c.entries[i].offset = int64(offset)
 found:
+	if c.entries[i].ref == 0 {
+		qcow2_cache_manager_remove(&c.entries[i])
+	}
 	c.entries[i].ref++
 	return qcow2_cache_get_table_addr(c, i), nil
 }
@@ -281,19 +367,25 @@ func qcow2_cache_get_empty(bs *BlockDriverState, c *Qcow2Cache, offset uint64) (
 }
 
 func qcow2_cache_put(c *Qcow2Cache, table unsafe.Pointer) {
-	i := qcow2_cache_get_table_idx(c, table)
 
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	i := qcow2_cache_get_table_idx(c, table)
 	c.entries[i].ref--
 	//table = nil
 
 	if c.entries[i].ref == 0 {
 		c.lruCounter++
 		c.entries[i].lruCounter = c.lruCounter
+		qcow2_cache_manager_push(&c.entries[i])
+		c.freed.Signal()
 	}
 	Assert(c.entries[i].ref >= 0)
 }
 
 func qcow2_cache_entry_mark_dirty(c *Qcow2Cache, table unsafe.Pointer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	i := qcow2_cache_get_table_idx(c, table)
 	Assert(c.entries[i].offset != 0)
 	c.entries[i].dirty = true
@@ -301,6 +393,8 @@ func qcow2_cache_entry_mark_dirty(c *Qcow2Cache, table unsafe.Pointer) {
 
 func qcow2_cache_is_table_offset(c *Qcow2Cache, offset uint64) unsafe.Pointer {
 
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	for i := int(0); i < c.size; i++ {
 		if c.entries[i].offset == int64(offset) {
 			return qcow2_cache_get_table_addr(c, i)
@@ -310,8 +404,14 @@ func qcow2_cache_is_table_offset(c *Qcow2Cache, offset uint64) unsafe.Pointer {
 }
 
 func qcow2_cache_discard(c *Qcow2Cache, table unsafe.Pointer) {
-	i := qcow2_cache_get_table_idx(c, table)
 
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	i, ok := c.tables[table]
+	if !ok {
+		//already dropped by the cache manager
+		return
+	}
 	Assert(c.entries[i].ref == 0)
 
 	c.entries[i].offset = 0
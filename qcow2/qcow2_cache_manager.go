@@ -0,0 +1,173 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Qcow2CacheManager owns one memory budget for the metadata caches of all
+// the open images. A cache only allocates a table when it loads one, the
+// tables not in use are kept in a process-wide lru list, and the least
+// recently used of them are dropped from whichever cache they belong to
+// while the budget is exceeded
+type Qcow2CacheManager struct {
+	lock   sync.Mutex
+	budget uint64
+	used   uint64
+	lru    *list.List
+}
+
+var qcow2CacheManager = &Qcow2CacheManager{
+	budget: QCOW2_DEFAULT_CACHE_BUDGET,
+	lru:    list.New(),
+}
+
+func qcow2_cache_manager_set_budget(budget uint64) {
+	m := qcow2CacheManager
+	m.lock.Lock()
+	m.budget = budget
+	m.lock.Unlock()
+}
+
+func qcow2_cache_manager_used() uint64 {
+	m := qcow2CacheManager
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.used
+}
+
+// account a table about to be allocated by c, c.lock must be held
+func qcow2_cache_manager_reserve(c *Qcow2Cache) {
+	m := qcow2CacheManager
+	m.lock.Lock()
+	m.used += uint64(c.tableSize)
+	//the clean tables are dropped right away, the dirty ones are written
+	//back once m.lock is dropped, the other images go on meanwhile
+	var dirty []*Qcow2CachedTable
+	over := m.used
+	for n := m.lru.Len(); n > 0 && over > m.budget; n-- {
+		e := m.lru.Front()
+		t := e.Value.(*Qcow2CachedTable)
+		evicted, isDirty := qcow2_cache_manager_evict(m, c, t)
+		if evicted {
+			over -= uint64(t.cache.tableSize)
+			continue
+		}
+		if isDirty {
+			dirty = append(dirty, t)
+			over -= uint64(t.cache.tableSize)
+		}
+		//busy, dirty or waiting for its dependency, try the others first
+		m.lru.MoveToBack(e)
+	}
+	m.lock.Unlock()
+	if len(dirty) == 0 {
+		return
+	}
+
+	for _, t := range dirty {
+		qcow2_cache_manager_writeback(c, t)
+	}
+	m.lock.Lock()
+	for _, t := range dirty {
+		if m.used <= m.budget {
+			break
+		}
+		//it may have been taken, dropped or written again meanwhile
+		if t.elem != nil {
+			qcow2_cache_manager_evict(m, c, t)
+		}
+	}
+	m.lock.Unlock()
+}
+
+// drop an unused clean table of any cache, the caller holds c.lock and
+// m.lock so the lock of another cache is only tried, a busy cache is
+// skipped. A dirty table is left for qcow2_cache_manager_writeback
+func qcow2_cache_manager_evict(m *Qcow2CacheManager, c *Qcow2Cache, t *Qcow2CachedTable) (evicted bool, dirty bool) {
+	victim := t.cache
+	if victim != c {
+		if !victim.lock.TryLock() {
+			return false, false
+		}
+		defer victim.lock.Unlock()
+	}
+	if t.dirty {
+		return false, true
+	}
+	t.offset = 0
+	t.lruCounter = 0
+	qcow2_cache_manager_free(m, victim, t)
+	return true, false
+}
+
+// write back a dirty table picked by qcow2_cache_manager_reserve, c.lock
+// must be held but not m.lock. A failed write leaves the table dirty for
+// the flush of its own image to report
+func qcow2_cache_manager_writeback(c *Qcow2Cache, t *Qcow2CachedTable) {
+	victim := t.cache
+	if victim != c {
+		if !victim.lock.TryLock() {
+			return
+		}
+		defer victim.lock.Unlock()
+	}
+	//the dependency would have to be flushed first, under the lock of
+	//another cache, leave the table to the flush of its own image
+	if t.ref > 0 || t.buf == nil || victim.depends != nil {
+		return
+	}
+	qcow2_cache_entry_flush(victim.bs, victim, t.index)
+}
+
+// m.lock and the lock of the cache of t must be held
+func qcow2_cache_manager_free(m *Qcow2CacheManager, c *Qcow2Cache, t *Qcow2CachedTable) {
+	if t.elem != nil {
+		m.lru.Remove(t.elem)
+		t.elem = nil
+	}
+	delete(c.tables, qcow2_cache_get_table_addr(c, t.index))
+	t.buf = nil
+	m.used -= uint64(c.tableSize)
+}
+
+// the table is no longer in use, it becomes the most recently used one
+func qcow2_cache_manager_push(t *Qcow2CachedTable) {
+	m := qcow2CacheManager
+	m.lock.Lock()
+	if t.elem != nil {
+		m.lru.Remove(t.elem)
+	}
+	t.elem = m.lru.PushBack(t)
+	m.lock.Unlock()
+}
+
+// the table is in use again and can't be evicted
+func qcow2_cache_manager_remove(t *Qcow2CachedTable) {
+	m := qcow2CacheManager
+	m.lock.Lock()
+	if t.elem != nil {
+		m.lru.Remove(t.elem)
+		t.elem = nil
+	}
+	m.lock.Unlock()
+}
@@ -8,21 +8,75 @@ import (
 
 func Test_Qcow2_Cache_Get_Table_Addr(t *testing.T) {
 	cache := qcow2_cache_create(nil, 4, 65536)
-	p0 := qcow2_cache_get_table_addr(cache, 0)
-	p1 := qcow2_cache_get_table_addr(cache, 1)
-	p2 := qcow2_cache_get_table_addr(cache, 2)
-	span1 := uint64(uintptr(p1) - uintptr(p0))
-	span2 := uint64(uintptr(p2) - uintptr(p0))
-	assert.Equal(t, uint64(65536), span1)
-	assert.Equal(t, uint64(65536*2), span2)
+	//the tables are only allocated when loaded
+	assert.Nil(t, qcow2_cache_get_table_addr(cache, 0))
+	p1, err := qcow2_cache_get_empty(nil, cache, 65536)
+	assert.Nil(t, err)
+	p2, err := qcow2_cache_get_empty(nil, cache, 65536*2)
+	assert.Nil(t, err)
+	assert.NotEqual(t, p1, p2)
+	assert.Equal(t, uintptr(0), uintptr(p1)%DEFAULT_ALIGNMENT)
+	assert.Equal(t, uintptr(0), uintptr(p2)%DEFAULT_ALIGNMENT)
+	qcow2_cache_put(cache, p1)
+	qcow2_cache_put(cache, p2)
+	qcow2_cache_destroy(cache)
 }
 
 func Test_Qcow2_Cache_Get_Table_Idx(t *testing.T) {
 	cache := qcow2_cache_create(nil, 4, 65536)
-	p1 := qcow2_cache_get_table_addr(cache, 1)
-	p2 := qcow2_cache_get_table_addr(cache, 2)
+	p1, _ := qcow2_cache_get_empty(nil, cache, 65536)
+	p2, _ := qcow2_cache_get_empty(nil, cache, 65536*2)
 	idx1 := qcow2_cache_get_table_idx(cache, p1)
 	idx2 := qcow2_cache_get_table_idx(cache, p2)
-	assert.Equal(t, 1, idx1)
-	assert.Equal(t, 2, idx2)
+	assert.Equal(t, p1, qcow2_cache_get_table_addr(cache, idx1))
+	assert.Equal(t, p2, qcow2_cache_get_table_addr(cache, idx2))
+	assert.NotEqual(t, idx1, idx2)
+	qcow2_cache_put(cache, p1)
+	qcow2_cache_put(cache, p2)
+	qcow2_cache_destroy(cache)
+}
+
+func Test_Qcow2_Cache_Manager_Budget(t *testing.T) {
+	const tableSize = 4096
+	used := qcow2_cache_manager_used()
+	qcow2_cache_manager_set_budget(used + 4*tableSize)
+	defer qcow2_cache_manager_set_budget(QCOW2_DEFAULT_CACHE_BUDGET)
+
+	load := func(c *Qcow2Cache, offset uint64) {
+		p, err := qcow2_cache_get_empty(nil, c, offset)
+		assert.Nil(t, err)
+		qcow2_cache_put(c, p)
+	}
+	c1 := qcow2_cache_create(nil, 4, tableSize)
+	c2 := qcow2_cache_create(nil, 4, tableSize)
+
+	//the idle tables of c1 fill the budget
+	for i := uint64(1); i <= 4; i++ {
+		load(c1, i*tableSize)
+	}
+	assert.Equal(t, used+4*tableSize, qcow2_cache_manager_used())
+
+	//the working set of c2 takes over the least recently used tables of c1
+	load(c2, tableSize)
+	load(c2, 2*tableSize)
+	assert.Equal(t, used+4*tableSize, qcow2_cache_manager_used())
+	assert.Nil(t, qcow2_cache_is_table_offset(c1, tableSize))
+	assert.Nil(t, qcow2_cache_is_table_offset(c1, 2*tableSize))
+	assert.NotNil(t, qcow2_cache_is_table_offset(c1, 3*tableSize))
+
+	//the tables in use are never dropped
+	p3, _ := qcow2_cache_get(nil, c1, 3*tableSize)
+	p4, _ := qcow2_cache_get(nil, c1, 4*tableSize)
+	load(c2, 3*tableSize)
+	load(c2, 4*tableSize)
+	assert.Equal(t, used+4*tableSize, qcow2_cache_manager_used())
+	assert.Equal(t, p3, qcow2_cache_is_table_offset(c1, 3*tableSize))
+	assert.Equal(t, p4, qcow2_cache_is_table_offset(c1, 4*tableSize))
+	assert.NotNil(t, qcow2_cache_is_table_offset(c2, 4*tableSize))
+	qcow2_cache_put(c1, p3)
+	qcow2_cache_put(c1, p4)
+
+	qcow2_cache_destroy(c1)
+	qcow2_cache_destroy(c2)
+	assert.Equal(t, used, qcow2_cache_manager_used())
 }
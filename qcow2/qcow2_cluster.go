@@ -2,6 +2,7 @@ package qcow2
 
 import (
 	"math"
+	"sync"
 	"unsafe"
 )
 
@@ -497,7 +498,7 @@ func calculate_l2_meta(bs *BlockDriverState, hostClusterOffset uint64,
 			NbBytes: cow_end_to - cow_end_from,
 		},
 	}
-	//TODO2
+	(*m).DependentRequests = sync.NewCond(s.Lock)
 	(*m).NextInFlight = s.ClusterAllocs.PushFront(*m)
 	return nil
 }
@@ -576,7 +577,7 @@ func qcow2_alloc_host_offset(bs *BlockDriverState, offset uint64,
 	var curBytes uint64
 	var err error
 
-	//again:
+again:
 	start = offset
 	remaining = *bytes
 	clusterOffset = INV_OFFSET
@@ -599,7 +600,20 @@ func qcow2_alloc_host_offset(bs *BlockDriverState, offset uint64,
 		}
 		curBytes = remaining
 
-		//TODO2: so far we don't handle dependencies
+		/*
+		 * Now start gathering as many contiguous clusters as possible:
+		 * first the ones which are already allocated, then new clusters,
+		 * all of them up to the next allocation in flight
+		 */
+		if err = handle_dependencies(bs, start, &curBytes, m); err == ERR_EAGAIN {
+			/* Currently *m is nil, so the whole request starts over */
+			Assert(*m == nil)
+			goto again
+		} else if err != nil {
+			return err
+		} else if curBytes == 0 {
+			break
+		}
 
 		var ret uint64
 		ret, err = handle_copied(bs, start, &clusterOffset, &curBytes, m)
@@ -630,6 +644,65 @@ func qcow2_alloc_host_offset(bs *BlockDriverState, offset uint64,
 	return err
 }
 
+/*
+ * Check if there's an allocation in flight overlapping the request. If the
+ * request starts before it, bytes is shortened to stop there. Otherwise the
+ * allocation is waited for, which drops s.Lock in the meantime, and
+ * ERR_EAGAIN tells the caller to look up the clusters again.
+ */
+func handle_dependencies(bs *BlockDriverState, guestOffset uint64, curBytes *uint64, m **QCowL2Meta) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	bytes := *curBytes
+
+	for e := s.ClusterAllocs.Front(); e != nil; e = e.Next() {
+		oldAlloc := e.Value.(*QCowL2Meta)
+		start := guestOffset
+		end := start + bytes
+		oldStart := start_of_cluster(s, l2meta_cow_start(oldAlloc))
+		oldEnd := round_up(l2meta_cow_end(oldAlloc), uint64(s.ClusterSize))
+
+		if end <= oldStart || start >= oldEnd {
+			/* No intersection */
+			continue
+		}
+
+		if oldAlloc.KeepOldClusters &&
+			(end <= l2meta_cow_start(oldAlloc) || start >= l2meta_cow_end(oldAlloc)) {
+			/* Clusters intersect but COW areas don't, and the cluster itself
+			 * is already allocated. So there is no actual conflict */
+			continue
+		}
+
+		/* Conflict */
+		if start < oldStart {
+			/* Stop at the start of a running allocation */
+			bytes = oldStart - start
+		} else {
+			bytes = 0
+		}
+
+		/* Stop if an l2meta already exists. After waiting, it wouldn't be
+		 * valid any more */
+		if bytes == 0 && *m != nil {
+			*curBytes = 0
+			return nil
+		}
+
+		if bytes == 0 {
+			/* Wait for the dependency to complete. We need to recheck
+			 * the free/allocated clusters when we continue */
+			oldAlloc.DependentRequests.Wait()
+			return ERR_EAGAIN
+		}
+	}
+
+	/* Make sure that existing clusters and new allocations are only used up
+	 * to the next dependency if we shortened the request above */
+	*curBytes = bytes
+	return nil
+}
+
 func handle_alloc(bs *BlockDriverState, guestOffset uint64,
 	hostOffset *uint64, bytes *uint64, m **QCowL2Meta) (uint64, error) {
 
@@ -873,7 +946,10 @@ func qcow2_free_any_cluster(bs *BlockDriverState, l2Entry uint64, dType Qcow2Dis
 		if s.DiscardPassthrough[dType] &&
 			(ctype == QCOW2_CLUSTER_NORMAL ||
 				ctype == QCOW2_CLUSTER_ZERO_ALLOC) {
-			bdrv_pdiscard(s.DataFile, l2Entry&L2E_OFFSET_MASK, uint64(s.ClusterSize))
+			update_refcount_discard(bs, s.DataFile, l2Entry&L2E_OFFSET_MASK, uint64(s.ClusterSize))
+			if !s.CacheDiscards {
+				qcow2_process_discards(bs, nil)
+			}
 		}
 		return
 	}
@@ -929,6 +1005,54 @@ func do_perform_cow_write(bs *BlockDriverState, clusterOffset uint64,
 	return nil
 }
 
+/*
+ * copy the cow regions within the file system, without reading them into
+ * memory, and write the guest data merged into them on its own.
+ * ERR_ENOTSUP where they can't be copied that way, or aren't data of the
+ * files, the zeroes are better written from memory along with the guest data
+ */
+func perform_cow_copy_range(bs *BlockDriverState, m *QCowL2Meta) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var start *Qcow2COWRegion = &m.CowStart
+	var end *Qcow2COWRegion = &m.CowEnd
+	var dataBytes uint64 = end.Offset - (start.Offset + start.NbBytes)
+	var qiov QEMUIOVector
+	var ret, pnum uint64
+	var err error
+
+	for _, region := range []*Qcow2COWRegion{start, end} {
+		offset := m.Offset + region.Offset
+		for bytes := region.NbBytes; bytes > 0; bytes -= pnum {
+			if ret, err = bdrv_block_status_above(bs, nil, offset, bytes, &pnum, nil, nil); err != nil {
+				return err
+			}
+			if pnum == 0 || ret&BDRV_BLOCK_DATA == 0 || ret&BDRV_BLOCK_ZERO > 0 {
+				return ERR_ENOTSUP
+			}
+			offset += pnum
+		}
+	}
+	for _, region := range []*Qcow2COWRegion{start, end} {
+		if region.NbBytes == 0 {
+			continue
+		}
+		if err = qcow2_copy_range_from(bs, nil, m.Offset+region.Offset, s.DataFile,
+			m.AllocOffset+region.Offset, region.NbBytes, 0, 0); err != nil {
+			return err
+		}
+	}
+	if m.DataQiov == nil {
+		return nil
+	}
+
+	qemu_iovec_init(&qiov, qemu_iovec_subvec_niov(m.DataQiov, m.DataQiovOffset, dataBytes))
+	qemu_iovec_concat(&qiov, m.DataQiov, m.DataQiovOffset, dataBytes)
+	err = do_perform_cow_write(bs, m.AllocOffset, start.Offset+start.NbBytes, &qiov)
+	qemu_iovec_destroy(&qiov)
+	return err
+}
+
 func perform_cow(bs *BlockDriverState, m *QCowL2Meta) error {
 
 	s := bs.opaque.(*BDRVQcow2State)
@@ -949,6 +1073,16 @@ func perform_cow(bs *BlockDriverState, m *QCowL2Meta) error {
 		return nil
 	}
 
+	s.Qunlock()
+	err = perform_cow_copy_range(bs, m)
+	s.Qlock()
+	if err != ERR_ENOTSUP {
+		if err == nil {
+			qcow2_cache_depends_on_flush(s.L2TableCache)
+		}
+		return err
+	}
+
 	mergeReads = (start.NbBytes > 0 && end.NbBytes > 0 && dataBytes <= 16384)
 	if mergeReads {
 		bufferSize = start.NbBytes + dataBytes + end.NbBytes
@@ -959,7 +1093,7 @@ func perform_cow(bs *BlockDriverState, m *QCowL2Meta) error {
 		bufferSize = align_up(start.NbBytes, align) + end.NbBytes
 	}
 
-	startBuffer = make([]uint8, bufferSize)
+	startBuffer = qemu_blockalign(bs, bufferSize)
 	/* The part of the buffer where the end region is located */
 	endBuffer = startBuffer[bufferSize-end.NbBytes:]
 
@@ -1105,9 +1239,20 @@ func qcow2_subcluster_zeroize(bs *BlockDriverState, offset uint64, bytes uint64,
 	Assert(offset_into_subcluster(s, endOffset) == 0 ||
 		endOffset >= bs.TotalSectors<<BDRV_SECTOR_BITS)
 
+	/* The zero flag is only supported by version 3 and newer */
+	if s.QcowVersion < QCOW2_VERSION3 {
+		/* Without a backing file, unallocated clusters read as zeroes */
+		if bs.backing == nil && flags&BDRV_REQ_MAY_UNMAP > 0 {
+			return qcow2_cluster_discard(bs, offset, bytes, QCOW2_DISCARD_REQUEST, false)
+		}
+		return ERR_ENOTSUP
+	}
+
 	head = min(endOffset, round_up(offset, uint64(s.ClusterSize))) - offset
 	offset += head
 
+	s.CacheDiscards = true
+
 	if endOffset >= bs.TotalSectors<<BDRV_SECTOR_BITS {
 		tail = 0
 	} else {
@@ -1140,6 +1285,8 @@ func qcow2_subcluster_zeroize(bs *BlockDriverState, offset uint64, bytes uint64,
 
 	err = nil
 fail:
+	s.CacheDiscards = false
+	qcow2_process_discards(bs, err)
 	return err
 }
 
@@ -1165,9 +1312,10 @@ func zero_in_l2_slice(bs *BlockDriverState, offset uint64, nbClusters uint64, fl
 		var ctype QCow2ClusterType = qcow2_get_cluster_type(bs, oldL2Entry)
 		var unmap bool = (ctype == QCOW2_CLUSTER_COMPRESSED) ||
 			((flags&BDRV_REQ_MAY_UNMAP) > 0 && qcow2_cluster_is_allocated(ctype))
+		var keepReference bool = s.DiscardNoUnref && ctype != QCOW2_CLUSTER_COMPRESSED
 
 		var newL2Entry, newL2Bitmap uint64
-		if unmap {
+		if unmap && !keepReference {
 			newL2Entry = 0
 		} else {
 			newL2Entry = oldL2Entry
@@ -1193,7 +1341,13 @@ func zero_in_l2_slice(bs *BlockDriverState, offset uint64, nbClusters uint64, fl
 
 		/* Then decrease the refcount */
 		if unmap {
-			qcow2_free_any_cluster(bs, oldL2Entry, QCOW2_DISCARD_REQUEST)
+			if !keepReference {
+				qcow2_free_any_cluster(bs, oldL2Entry, QCOW2_DISCARD_REQUEST)
+			} else if s.DiscardPassthrough[QCOW2_DISCARD_REQUEST] &&
+				(ctype == QCOW2_CLUSTER_NORMAL || ctype == QCOW2_CLUSTER_ZERO_ALLOC) {
+				//issued by qcow2_subcluster_zeroize after the l2 update
+				update_refcount_discard(bs, s.DataFile, oldL2Entry&L2E_OFFSET_MASK, uint64(s.ClusterSize))
+			}
 		}
 	}
 
@@ -1273,15 +1427,25 @@ func discard_in_l2_slice(bs *BlockDriverState, offset uint64, nbClusters uint64,
 		new_l2_entry := old_l2_entry
 		new_l2_bitmap := old_l2_bitmap
 		clusterType := qcow2_get_cluster_type(bs, old_l2_entry)
+		keepReference := clusterType != QCOW2_CLUSTER_COMPRESSED && !fullDiscard &&
+			s.DiscardNoUnref && dType == QCOW2_DISCARD_REQUEST
 		if fullDiscard {
 			new_l2_bitmap = 0
 			new_l2_entry = 0
 		} else if bs.backing != nil || qcow2_cluster_is_allocated(clusterType) {
 			if has_subclusters(s) {
-				new_l2_entry = 0
+				if !keepReference {
+					new_l2_entry = 0
+				}
 				new_l2_bitmap = QCOW_L2_BITMAP_ALL_ZEROES
+			} else if s.QcowVersion >= QCOW2_VERSION3 {
+				if keepReference {
+					new_l2_entry |= QCOW_OFLAG_ZERO
+				} else {
+					new_l2_entry = QCOW_OFLAG_ZERO
+				}
 			} else {
-				new_l2_entry = QCOW_OFLAG_ZERO
+				new_l2_entry = 0
 			}
 		}
 
@@ -1295,8 +1459,14 @@ func discard_in_l2_slice(bs *BlockDriverState, offset uint64, nbClusters uint64,
 		if has_subclusters(s) {
 			set_l2_bitmap(s, l2Slice, l2Index+i, new_l2_bitmap)
 		}
-		/* Then decrease the refcount */
-		qcow2_free_any_cluster(bs, old_l2_entry, dType)
+		if !keepReference {
+			/* Then decrease the refcount */
+			qcow2_free_any_cluster(bs, old_l2_entry, dType)
+		} else if s.DiscardPassthrough[dType] &&
+			(clusterType == QCOW2_CLUSTER_NORMAL || clusterType == QCOW2_CLUSTER_ZERO_ALLOC) {
+			/* If we keep the reference, pass on the discard still */
+			update_refcount_discard(bs, s.DataFile, old_l2_entry&L2E_OFFSET_MASK, uint64(s.ClusterSize))
+		}
 	}
 
 	qcow2_cache_put(s.L2TableCache, l2Slice)
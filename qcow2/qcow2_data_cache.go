@@ -0,0 +1,273 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// a guest cluster read ahead
+type Qcow2DataCacheEntry struct {
+	index uint64
+	buf   []byte
+	elem  *list.Element
+}
+
+// a stream of reads, each starting where the last one ended
+type Qcow2ReadStream struct {
+	end    uint64
+	ahead  uint64 //the end of the data read ahead of the stream
+	window uint64 //bytes read ahead at once, 0 for an unused slot
+}
+
+// the data read ahead of the sequential reads of an image, kept by guest
+// cluster, so the data of the backing files is served from it as well
+type Qcow2DataCache struct {
+	lock        sync.Mutex
+	size        uint64
+	used        uint64
+	clusterBits uint32
+	entries     map[uint64]*Qcow2DataCacheEntry
+	//the clusters being read ahead, true once written in the meantime
+	inflight   map[uint64]bool
+	lru        *list.List
+	streams    [QCOW2_DATA_CACHE_STREAMS]Qcow2ReadStream
+	nextStream int
+	wg         sync.WaitGroup
+}
+
+func qcow2_data_cache_create(bs *BlockDriverState, size uint64) *Qcow2DataCache {
+	s := bs.opaque.(*BDRVQcow2State)
+	return &Qcow2DataCache{
+		size:        size,
+		clusterBits: s.ClusterBits,
+		entries:     make(map[uint64]*Qcow2DataCacheEntry),
+		inflight:    make(map[uint64]bool),
+		lru:         list.New(),
+	}
+}
+
+// wait for the reads ahead in flight and drop the data
+func qcow2_data_cache_destroy(c *Qcow2DataCache) {
+	c.wg.Wait()
+	c.lock.Lock()
+	c.entries = make(map[uint64]*Qcow2DataCacheEntry)
+	c.lru.Init()
+	c.used = 0
+	c.lock.Unlock()
+}
+
+func qcow2_data_cache_drop(c *Qcow2DataCache, e *Qcow2DataCacheEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.index)
+	c.used -= 1 << c.clusterBits
+}
+
+// drop the data of the guest range written, called once the write is done
+func qcow2_data_cache_invalidate(bs *BlockDriverState, offset uint64, bytes uint64) {
+	s := bs.opaque.(*BDRVQcow2State)
+	c := s.DataCache
+	if c == nil || bytes == 0 {
+		return
+	}
+	first := offset >> c.clusterBits
+	last := (offset + bytes - 1) >> c.clusterBits
+
+	c.lock.Lock()
+	if last-first < uint64(len(c.entries)+len(c.inflight)) {
+		for i := first; i <= last; i++ {
+			if e, ok := c.entries[i]; ok {
+				qcow2_data_cache_drop(c, e)
+			}
+			if _, ok := c.inflight[i]; ok {
+				c.inflight[i] = true
+			}
+		}
+	} else {
+		for i, e := range c.entries {
+			if i >= first && i <= last {
+				qcow2_data_cache_drop(c, e)
+			}
+		}
+		for i := range c.inflight {
+			if i >= first && i <= last {
+				c.inflight[i] = true
+			}
+		}
+	}
+	c.lock.Unlock()
+}
+
+// record a read, and return the bytes to read ahead from start if it
+// continues a stream which has consumed half of what was read ahead of it,
+// c.lock held
+func qcow2_data_cache_stream(c *Qcow2DataCache, offset uint64, bytes uint64, start *uint64) uint64 {
+	for i := range c.streams {
+		stream := &c.streams[i]
+		if stream.window == 0 || stream.end != offset {
+			continue
+		}
+		stream.end = offset + bytes
+		if stream.ahead > stream.end+stream.window/2 {
+			return 0
+		}
+		*start = max(stream.ahead, stream.end)
+		stream.window = max(min(stream.window*2, c.size/2), 1<<c.clusterBits)
+		stream.ahead = stream.end + stream.window
+		return stream.ahead - *start
+	}
+	//a new stream replaces the oldest one
+	c.streams[c.nextStream] = Qcow2ReadStream{
+		end:    offset + bytes,
+		ahead:  offset + bytes,
+		window: QCOW2_MIN_READAHEAD << c.clusterBits,
+	}
+	c.nextStream = (c.nextStream + 1) % len(c.streams)
+	return 0
+}
+
+// serve the cached clusters of a read from memory and read the others, and
+// read ahead of a sequential read in the background
+func qcow2_data_cache_preadv(bs *BlockDriverState, offset uint64, bytes uint64,
+	qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	c := s.DataCache
+	var err error
+	var curBytes uint64
+	//a run of clusters not cached, read at once
+	var missOffset, missBytes, missQiovOffset uint64
+	var start uint64
+
+	c.lock.Lock()
+	window := qcow2_data_cache_stream(c, offset, bytes, &start)
+	c.lock.Unlock()
+	if window > 0 {
+		qcow2_data_cache_readahead(bs, start, window)
+	}
+
+	for bytes > 0 {
+		curBytes = min(bytes, uint64(s.ClusterSize)-offset_into_cluster(s, offset))
+		c.lock.Lock()
+		e := c.entries[offset>>c.clusterBits]
+		if e != nil {
+			c.lru.MoveToBack(e.elem)
+			qemu_iovec_from_buf(qiov, qiovOffset, unsafe.Pointer(&e.buf[offset_into_cluster(s, offset)]), curBytes)
+		}
+		c.lock.Unlock()
+
+		if e == nil {
+			if missBytes == 0 {
+				missOffset = offset
+				missQiovOffset = qiovOffset
+			}
+			missBytes += curBytes
+		} else if missBytes > 0 {
+			if err = qcow2_do_preadv_part(bs, missOffset, missBytes, qiov, missQiovOffset, flags); err != nil {
+				return err
+			}
+			missBytes = 0
+		}
+		bytes -= curBytes
+		offset += curBytes
+		qiovOffset += curBytes
+	}
+	if missBytes > 0 {
+		err = qcow2_do_preadv_part(bs, missOffset, missBytes, qiov, missQiovOffset, flags)
+	}
+	return err
+}
+
+// read the clusters from offset to offset+window which are neither cached
+// nor being read ahead already, a goroutine per run of them
+func qcow2_data_cache_readahead(bs *BlockDriverState, offset uint64, window uint64) {
+	s := bs.opaque.(*BDRVQcow2State)
+	c := s.DataCache
+	var first, n uint64
+
+	size := bs.TotalSectors * BDRV_SECTOR_SIZE
+	//nothing new is started while the image is drained
+	if offset >= size || atomic.LoadInt32(&bs.QuiesceCounter) > 0 {
+		return
+	}
+	end := div_round_up(min(offset+window, size), uint64(s.ClusterSize))
+
+	c.lock.Lock()
+	for i := offset >> c.clusterBits; i <= end; i++ {
+		_, reading := c.inflight[i]
+		if i < end && c.entries[i] == nil && !reading {
+			c.inflight[i] = false
+			if n == 0 {
+				first = i
+			}
+			n++
+		} else if n > 0 {
+			//in flight from now on, so a drain started once the request
+			//is done waits for it
+			c.wg.Add(1)
+			bdrv_inc_in_flight(bs)
+			go qcow2_data_cache_fill(bs, first, n)
+			n = 0
+		}
+	}
+	c.lock.Unlock()
+}
+
+// read n clusters ahead from the first one into the cache, but for the ones
+// written in the meantime
+func qcow2_data_cache_fill(bs *BlockDriverState, first uint64, n uint64) {
+	s := bs.opaque.(*BDRVQcow2State)
+	c := s.DataCache
+	var qiov QEMUIOVector
+	defer c.wg.Done()
+	defer bdrv_dec_in_flight(bs)
+
+	offset := first << c.clusterBits
+	bytes := min(n<<c.clusterBits, bs.TotalSectors*BDRV_SECTOR_SIZE-offset)
+	buf := qemu_blockalign(s.DataFile.bs, bytes)
+	qemu_iovec_init_buf(&qiov, unsafe.Pointer(&buf[0]), bytes)
+	err := qcow2_do_preadv_part(bs, offset, bytes, &qiov, 0, 0)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i := uint64(0); i < n; i++ {
+		written := c.inflight[first+i]
+		delete(c.inflight, first+i)
+		//the data read ahead is only a hint, a failed read is done again
+		//by the request itself
+		if err != nil || written {
+			continue
+		}
+		start := i << c.clusterBits
+		e := &Qcow2DataCacheEntry{
+			index: first + i,
+			buf:   buf[start:min(start+1<<c.clusterBits, bytes)],
+		}
+		e.elem = c.lru.PushBack(e)
+		c.entries[e.index] = e
+		c.used += 1 << c.clusterBits
+	}
+	for c.used > c.size {
+		qcow2_data_cache_drop(c, c.lru.Front().Value.(*Qcow2DataCacheEntry))
+	}
+}
@@ -0,0 +1,137 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_qcow2_data_cache_stream(t *testing.T) {
+	var start uint64
+	c := &Qcow2DataCache{size: 1024 * 1024, clusterBits: DEFAULT_CLUSTER_BITS}
+	//the first read starts a stream, the next one continues it
+	assert.Equal(t, uint64(0), qcow2_data_cache_stream(c, 0, 4096, &start))
+	assert.Equal(t, uint64(4*DEFAULT_CLUSTER_SIZE), qcow2_data_cache_stream(c, 4096, 4096, &start))
+	assert.Equal(t, uint64(8192), start)
+	//nothing more till half of it is consumed
+	assert.Equal(t, uint64(0), qcow2_data_cache_stream(c, 8192, 4096, &start))
+	assert.Equal(t, uint64(0), qcow2_data_cache_stream(c, 12288, 2*DEFAULT_CLUSTER_SIZE-8192, &start))
+	//then a doubled window from where the last one ends
+	assert.Equal(t, uint64(6*DEFAULT_CLUSTER_SIZE), qcow2_data_cache_stream(c, 2*DEFAULT_CLUSTER_SIZE+4096, 4096, &start))
+	assert.Equal(t, uint64(4*DEFAULT_CLUSTER_SIZE+8192), start)
+	//interleaved with another stream
+	assert.Equal(t, uint64(0), qcow2_data_cache_stream(c, 1<<30, 4096, &start))
+	assert.Equal(t, uint64(4*DEFAULT_CLUSTER_SIZE), qcow2_data_cache_stream(c, 1<<30+4096, 4096, &start))
+	assert.Equal(t, uint64(1<<30+8192), start)
+	//no more than half of the cache at once
+	assert.Equal(t, uint64(6*DEFAULT_CLUSTER_SIZE),
+		qcow2_data_cache_stream(c, 2*DEFAULT_CLUSTER_SIZE+8192, 6*DEFAULT_CLUSTER_SIZE, &start))
+	assert.Equal(t, uint64(10*DEFAULT_CLUSTER_SIZE+8192), start)
+	//a random read is not read ahead of
+	assert.Equal(t, uint64(0), qcow2_data_cache_stream(c, 12345, 4096, &start))
+}
+
+func Test_qcow2_data_cache_readahead(t *testing.T) {
+	var basefile = "/tmp/qcow2_data_cache_base.qcow2"
+	var filename = "/tmp/qcow2_data_cache.qcow2"
+	const size = 64 * DEFAULT_CLUSTER_SIZE
+	os.Remove(basefile)
+	os.Remove(filename)
+
+	err := Blk_Create(basefile, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	base, err := Blk_Open(basefile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i / 4096)
+	}
+	_, err = Blk_Pwrite(base, 0, data, size, 0)
+	assert.Nil(t, err)
+	Blk_Close(base)
+
+	err = Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size, OPT_BACKING: basefile})
+	assert.Nil(t, err)
+	_, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_DATA_CACHE_SIZE: 1000}, BDRV_O_RDWR)
+	assert.NotNil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_DATA_CACHE_SIZE: 16 * DEFAULT_CLUSTER_SIZE},
+		BDRV_O_RDWR)
+	assert.Nil(t, err)
+	s := root.bs.opaque.(*BDRVQcow2State)
+	c := s.DataCache
+	assert.NotNil(t, c)
+	//the backing file is served by the cache on top
+	assert.Nil(t, root.bs.backing.bs.opaque.(*BDRVQcow2State).DataCache)
+
+	//small sequential reads from the backing file
+	buf := make([]byte, 4096)
+	for offset := uint64(0); offset < 4*DEFAULT_CLUSTER_SIZE; offset += 4096 {
+		_, err = Blk_Pread(root, offset, buf, 4096)
+		assert.Nil(t, err)
+		assert.Equal(t, data[offset:offset+4096], buf)
+	}
+	c.wg.Wait()
+	assert.True(t, len(c.entries) > 4)
+	assert.True(t, c.used <= c.size)
+	for index, e := range c.entries {
+		offset := index * DEFAULT_CLUSTER_SIZE
+		assert.Equal(t, data[offset:offset+uint64(len(e.buf))], e.buf)
+	}
+
+	//a write drops the data read ahead of the range
+	assert.NotNil(t, c.entries[5])
+	newData := bytes.Repeat([]byte{0xee}, 4096)
+	_, err = Blk_Pwrite(root, 5*DEFAULT_CLUSTER_SIZE+4096, newData, 4096, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, c.entries[5])
+	_, err = Blk_Pread(root, 5*DEFAULT_CLUSTER_SIZE+4096, buf, 4096)
+	assert.Nil(t, err)
+	assert.Equal(t, newData, buf)
+
+	//the whole image read through the cache
+	_, err = Blk_Pwrite_Zeroes(root, 20*DEFAULT_CLUSTER_SIZE, DEFAULT_CLUSTER_SIZE, 0)
+	assert.Nil(t, err)
+	copy(data[5*DEFAULT_CLUSTER_SIZE+4096:], newData)
+	copy(data[20*DEFAULT_CLUSTER_SIZE:], make([]byte, DEFAULT_CLUSTER_SIZE))
+	buf = make([]byte, 16384)
+	for offset := uint64(0); offset < size; offset += 16384 {
+		_, err = Blk_Pread(root, offset, buf, 16384)
+		assert.Nil(t, err)
+		assert.Equal(t, data[offset:offset+16384], buf)
+	}
+
+	//a write only drops the clusters it covers from the reads ahead in flight
+	c.wg.Wait()
+	qcow2_data_cache_invalidate(root.bs, 30*DEFAULT_CLUSTER_SIZE, 4*DEFAULT_CLUSTER_SIZE)
+	c.lock.Lock()
+	for i := uint64(30); i < 34; i++ {
+		c.inflight[i] = false
+	}
+	c.lock.Unlock()
+	qcow2_data_cache_invalidate(root.bs, 31*DEFAULT_CLUSTER_SIZE+512, 512)
+	qcow2_data_cache_invalidate(root.bs, 40*DEFAULT_CLUSTER_SIZE, DEFAULT_CLUSTER_SIZE)
+	c.wg.Add(1)
+	bdrv_inc_in_flight(root.bs)
+	qcow2_data_cache_fill(root.bs, 30, 4)
+	assert.Empty(t, c.inflight)
+	assert.NotNil(t, c.entries[30])
+	assert.Nil(t, c.entries[31])
+	assert.NotNil(t, c.entries[32])
+	assert.NotNil(t, c.entries[33])
+
+	//a drain waits for the reads ahead, and none is started while drained
+	qcow2_data_cache_invalidate(root.bs, 0, size)
+	qcow2_data_cache_readahead(root.bs, 0, 8*DEFAULT_CLUSTER_SIZE)
+	bdrv_drained_begin(root.bs)
+	assert.Empty(t, c.inflight)
+	assert.Equal(t, 8, len(c.entries))
+	qcow2_data_cache_readahead(root.bs, 16*DEFAULT_CLUSTER_SIZE, 8*DEFAULT_CLUSTER_SIZE)
+	assert.Empty(t, c.inflight)
+	bdrv_drained_end(root.bs)
+	assert.Equal(t, uint64(0), root.bs.InFlight)
+	Blk_Close(root)
+	os.Remove(basefile)
+	os.Remove(filename)
+}
@@ -0,0 +1,135 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"math"
+	"math/bits"
+	"unsafe"
+)
+
+// Qcow2FreeMap mirrors the refcounts of the host clusters, a set bit is a
+// cluster in use or reserved by an allocation in progress, and all the
+// clusters past the end of the map are free. It's built from the refcount
+// blocks and kept up to date by update_refcount, under s.Lock
+type Qcow2FreeMap struct {
+	words []uint64
+	//there's no free run of runHintLen clusters or more below runHint
+	runHint    uint64
+	runHintLen uint64
+}
+
+func qcow2_free_map_init(bs *BlockDriverState) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var refcountBlock unsafe.Pointer
+	var err error
+	m := &Qcow2FreeMap{}
+
+	for i := uint64(0); i < uint64(s.RefcountTableSize); i++ {
+		refcountBlockOffset := s.RefcountTable[i] & REFT_OFFSET_MASK
+		if refcountBlockOffset == 0 {
+			continue
+		}
+		if refcountBlock, err = load_refcount_block(bs, refcountBlockOffset); err != nil {
+			return err
+		}
+		clusterIndex := i << s.RefcountBlockBits
+		for j := uint64(0); j < uint64(s.RefcountBlockSize); j++ {
+			if s.get_refcount(refcountBlock, j) != 0 {
+				qcow2_free_map_set(m, clusterIndex+j, 1, true)
+			}
+		}
+		qcow2_cache_put(s.RefcountBlockCache, refcountBlock)
+	}
+	s.FreeMap = m
+	return nil
+}
+
+func qcow2_free_map_set(m *Qcow2FreeMap, clusterIndex uint64, nbClusters uint64, used bool) {
+	end := clusterIndex + nbClusters
+	if used && div_round_up(end, 64) > uint64(len(m.words)) {
+		words := make([]uint64, max(div_round_up(end, 64), 2*uint64(len(m.words))))
+		copy(words, m.words)
+		m.words = words
+	}
+	end = min(end, uint64(len(m.words))*64)
+	for i := clusterIndex; i < end; i++ {
+		if used {
+			m.words[i/64] |= 1 << (i % 64)
+		} else {
+			m.words[i/64] &^= 1 << (i % 64)
+		}
+	}
+	//the run around the freed clusters may be long enough for the hint
+	if !used && clusterIndex < m.runHint {
+		start := clusterIndex
+		for start > 0 && clusterIndex-start < m.runHintLen && m.words[(start-1)/64]&(1<<((start-1)%64)) == 0 {
+			start--
+		}
+		if qcow2_free_map_next(m, clusterIndex, true)-start >= m.runHintLen {
+			m.runHint = start
+		}
+	}
+}
+
+// the first cluster at or after clusterIndex in use, or free if !used
+func qcow2_free_map_next(m *Qcow2FreeMap, clusterIndex uint64, used bool) uint64 {
+	end := uint64(len(m.words)) * 64
+	if clusterIndex >= end {
+		if used {
+			return math.MaxUint64
+		}
+		return clusterIndex
+	}
+	for i := clusterIndex; i < end; i = (i/64 + 1) * 64 {
+		word := m.words[i/64]
+		if !used {
+			word = ^word
+		}
+		if word >>= i % 64; word != 0 {
+			return i + uint64(bits.TrailingZeros64(word))
+		}
+	}
+	if used {
+		return math.MaxUint64
+	}
+	return end
+}
+
+// the first run of nbClusters free clusters, clusterIndex is the lowest free one
+func qcow2_free_map_find(m *Qcow2FreeMap, clusterIndex uint64, nbClusters uint64) uint64 {
+	//the small holes left by discards aren't searched again and again
+	//for the large runs
+	if nbClusters >= m.runHintLen && m.runHint > clusterIndex {
+		clusterIndex = m.runHint
+	}
+	for {
+		start := qcow2_free_map_next(m, clusterIndex, false)
+		next := qcow2_free_map_next(m, start, true)
+		if next-start >= nbClusters {
+			if nbClusters > 1 {
+				m.runHint, m.runHintLen = start, nbClusters
+			}
+			return start
+		}
+		clusterIndex = next
+	}
+}
@@ -0,0 +1,185 @@
+package qcow2
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_qcow2_free_map_find(t *testing.T) {
+	m := &Qcow2FreeMap{}
+	assert.Equal(t, uint64(0), qcow2_free_map_find(m, 0, 100))
+
+	qcow2_free_map_set(m, 0, 200, true)
+	qcow2_free_map_set(m, 10, 1, false)
+	qcow2_free_map_set(m, 60, 10, false)
+	qcow2_free_map_set(m, 130, 3, false)
+	assert.Equal(t, uint64(10), qcow2_free_map_next(m, 0, false))
+	assert.Equal(t, uint64(11), qcow2_free_map_next(m, 10, true))
+	assert.Equal(t, uint64(10), qcow2_free_map_find(m, 10, 1))
+	assert.Equal(t, uint64(60), qcow2_free_map_find(m, 10, 2))
+	assert.Equal(t, uint64(60), qcow2_free_map_find(m, 10, 10))
+	qcow2_free_map_set(m, 60, 10, true)
+	assert.Equal(t, uint64(130), qcow2_free_map_find(m, 10, 3))
+	//no run long enough, the clusters past the end of the map are free
+	assert.Equal(t, uint64(200), qcow2_free_map_find(m, 10, 11))
+	//the runs of freed clusters are found again
+	qcow2_free_map_set(m, 60, 10, false)
+	assert.Equal(t, uint64(60), qcow2_free_map_find(m, 10, 3))
+	qcow2_free_map_set(m, 189, 11, false)
+	assert.Equal(t, uint64(189), qcow2_free_map_find(m, 10, 11))
+}
+
+// write all the clusters of a new image and discard the ones picked
+func qcow2_fragmented_image(tb testing.TB, filename string, clusters uint64, discard func(i uint64) bool) *BdrvChild {
+	os.Remove(filename)
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: clusters * DEFAULT_CLUSTER_SIZE})
+	assert.Nil(tb, err)
+	//a refcount cache big enough to keep the refcount blocks in memory
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_L2CACHESIZE: uint64(4 * 1024 * 1024)},
+		BDRV_O_RDWR|BDRV_O_UNMAP)
+	assert.Nil(tb, err)
+
+	data := bytes.Repeat([]byte{0x33}, 1024*1024)
+	for offset := uint64(0); offset < clusters*DEFAULT_CLUSTER_SIZE; offset += uint64(len(data)) {
+		_, err = Blk_Pwrite(root, offset, data, uint64(len(data)), 0)
+		assert.Nil(tb, err)
+	}
+	for i := uint64(0); i < clusters; i++ {
+		if discard(i) {
+			err = Blk_Discard(root, i*DEFAULT_CLUSTER_SIZE, DEFAULT_CLUSTER_SIZE)
+			assert.Nil(tb, err)
+		}
+	}
+	return root
+}
+
+func Test_qcow2_free_map_alloc(t *testing.T) {
+	var filename = "/tmp/qcow2_free_map.qcow2"
+	const clusters = 64
+	holes := map[uint64]bool{8: true, 9: true, 10: true, 11: true, 20: true, 22: true, 24: true}
+
+	root := qcow2_fragmented_image(t, filename, clusters, func(i uint64) bool { return false })
+	hostOffsets := make(map[uint64]uint64)
+	for i := range holes {
+		var bytes uint32 = DEFAULT_CLUSTER_SIZE
+		var scType QCow2SubclusterType
+		var hostOffset uint64
+		err := qcow2_get_host_offset(root.bs, i*DEFAULT_CLUSTER_SIZE, &bytes, &hostOffset, &scType)
+		assert.Nil(t, err)
+		hostOffsets[i] = hostOffset
+		err = Blk_Discard(root, i*DEFAULT_CLUSTER_SIZE, DEFAULT_CLUSTER_SIZE)
+		assert.Nil(t, err)
+	}
+	Blk_Close(root)
+
+	//the map built at open agrees with the refcounts
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	bs := root.bs
+	s := bs.opaque.(*BDRVQcow2State)
+	fileClusters := uint64(len(s.FreeMap.words)) * 64
+	for i := uint64(0); i < fileClusters; i++ {
+		refcount, err := qcow2_get_refcount(bs, i)
+		assert.Nil(t, err)
+		assert.Equal(t, refcount != 0, qcow2_free_map_next(s.FreeMap, i, true) == i, fmt.Sprintf("cluster %d", i))
+	}
+	end := qcow2_free_map_next(s.FreeMap, hostOffsets[24]>>s.ClusterBits+1, false) << s.ClusterBits
+
+	//the discarded clusters are reused first, lowest first, and a run only
+	//goes where it fits as a whole
+	s.Qlock()
+	offset, err := qcow2_alloc_clusters(bs, DEFAULT_CLUSTER_SIZE)
+	assert.Nil(t, err)
+	assert.Equal(t, hostOffsets[8], offset)
+	offset, err = qcow2_alloc_clusters(bs, 3*DEFAULT_CLUSTER_SIZE)
+	assert.Nil(t, err)
+	assert.Equal(t, hostOffsets[9], offset)
+	offset, err = qcow2_alloc_clusters(bs, 2*DEFAULT_CLUSTER_SIZE)
+	assert.Nil(t, err)
+	assert.Equal(t, end, offset)
+	offset, err = qcow2_alloc_clusters(bs, DEFAULT_CLUSTER_SIZE)
+	assert.Nil(t, err)
+	assert.Equal(t, hostOffsets[20], offset)
+	s.Qunlock()
+
+	//freed clusters show up again
+	qcow2_free_clusters(bs, hostOffsets[9], 3*DEFAULT_CLUSTER_SIZE, QCOW2_DISCARD_NEVER)
+	s.Qlock()
+	offset, err = qcow2_alloc_clusters(bs, 2*DEFAULT_CLUSTER_SIZE)
+	assert.Nil(t, err)
+	assert.Equal(t, hostOffsets[9], offset)
+	s.Qunlock()
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_qcow2_free_map_refcount_block_fail(t *testing.T) {
+	var filename = "/tmp/qcow2_free_map_fail.qcow2"
+	os.Remove(filename)
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 1024 * 1024 * 1024})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	bs := root.bs
+	s := bs.opaque.(*BDRVQcow2State)
+
+	//the refcount block of a new area describes itself, it can't be
+	//written and its cluster is free again
+	s.Qlock()
+	clusterIndex := 10 * uint64(s.RefcountBlockSize)
+	s.FreeClusterIndex = clusterIndex
+	root.bs.current.perm &^= PERM_WRITABLE
+	_, err = alloc_refcount_block(bs, clusterIndex)
+	assert.ErrorIs(t, err, Err_NoWritePerm)
+	assert.Equal(t, clusterIndex, qcow2_free_map_next(s.FreeMap, clusterIndex, false))
+	assert.Nil(t, qcow2_cache_is_table_offset(s.RefcountBlockCache, clusterIndex<<s.ClusterBits))
+	root.bs.current.perm |= PERM_WRITABLE
+	s.FreeClusterIndex = 0
+	s.Qunlock()
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func bench_qcow2_alloc_fragmented(b *testing.B, nbClusters uint64) {
+	var filename = "/tmp/qcow2_free_map_bench.qcow2"
+	const clusters = 16384
+
+	//every other cluster of a 1 GiB image discarded
+	root := qcow2_fragmented_image(b, filename, clusters, func(i uint64) bool { return i%2 == 1 })
+	bs := root.bs
+	s := bs.opaque.(*BDRVQcow2State)
+	s.Qlock()
+	low, err := qcow2_alloc_clusters(bs, DEFAULT_CLUSTER_SIZE)
+	s.Qunlock()
+	assert.Nil(b, err)
+
+	//a cluster low in the image is freed before every allocation, like the
+	//discards of a guest, and taken again afterwards
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Qlock()
+		qcow2_free_clusters(bs, low, DEFAULT_CLUSTER_SIZE, QCOW2_DISCARD_NEVER)
+		if _, err = qcow2_alloc_clusters(bs, nbClusters*DEFAULT_CLUSTER_SIZE); err == nil && nbClusters > 1 {
+			low, err = qcow2_alloc_clusters(bs, DEFAULT_CLUSTER_SIZE)
+		}
+		s.Qunlock()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Benchmark_qcow2_alloc_fragmented(b *testing.B) {
+	for _, nbClusters := range []uint64{1, 16} {
+		b.Run(fmt.Sprintf("clusters-%d", nbClusters), func(b *testing.B) {
+			bench_qcow2_alloc_fragmented(b, nbClusters)
+		})
+	}
+}
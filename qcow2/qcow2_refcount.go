@@ -21,20 +21,121 @@ SOFTWARE.
 
 import (
 	"container/list"
+	"encoding/binary"
 	"fmt"
 	"math"
 	"unsafe"
 )
 
-func get_refcount(refcountArray unsafe.Pointer, index uint64) uint16 {
+func get_refcount_ro0(refcountArray unsafe.Pointer, index uint64) uint64 {
+	p := (*uint8)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index/8)))
+	return uint64(*p>>(index%8)) & 0x1
+}
+
+func set_refcount_ro0(refcountArray unsafe.Pointer, index uint64, value uint64) {
+	Assert(value>>1 == 0)
+	p := (*uint8)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index/8)))
+	*p &^= 0x1 << (index % 8)
+	*p |= uint8(value << (index % 8))
+}
+
+func get_refcount_ro1(refcountArray unsafe.Pointer, index uint64) uint64 {
+	p := (*uint8)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index/4)))
+	return uint64(*p>>(2*(index%4))) & 0x3
+}
+
+func set_refcount_ro1(refcountArray unsafe.Pointer, index uint64, value uint64) {
+	Assert(value>>2 == 0)
+	p := (*uint8)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index/4)))
+	*p &^= 0x3 << (2 * (index % 4))
+	*p |= uint8(value << (2 * (index % 4)))
+}
+
+func get_refcount_ro2(refcountArray unsafe.Pointer, index uint64) uint64 {
+	p := (*uint8)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index/2)))
+	return uint64(*p>>(4*(index%2))) & 0xf
+}
+
+func set_refcount_ro2(refcountArray unsafe.Pointer, index uint64, value uint64) {
+	Assert(value>>4 == 0)
+	p := (*uint8)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index/2)))
+	*p &^= 0xf << (4 * (index % 2))
+	*p |= uint8(value << (4 * (index % 2)))
+}
+
+func get_refcount_ro3(refcountArray unsafe.Pointer, index uint64) uint64 {
+	return uint64(*(*uint8)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index))))
+}
+
+func set_refcount_ro3(refcountArray unsafe.Pointer, index uint64, value uint64) {
+	Assert(value>>8 == 0)
+	*(*uint8)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index))) = uint8(value)
+}
+
+// the default refcount order of 4
+func get_refcount(refcountArray unsafe.Pointer, index uint64) uint64 {
 	value := *(*uint16)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index*2))) //uint16 occpies 2 bytes.
 	value = be16_to_cpu(value)
-	return value
+	return uint64(value)
 }
 
-func set_refcount(refcountArray unsafe.Pointer, index uint64, value uint16) {
+func set_refcount(refcountArray unsafe.Pointer, index uint64, value uint64) {
+	Assert(value>>16 == 0)
 	p := (*uint16)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index*2))) //uint16 occpies 2 bytes.
-	*p = cpu_to_be16(value)
+	*p = cpu_to_be16(uint16(value))
+}
+
+func get_refcount_ro5(refcountArray unsafe.Pointer, index uint64) uint64 {
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(uintptr(refcountArray)+uintptr(index*4))), 4)
+	return uint64(binary.BigEndian.Uint32(buf))
+}
+
+func set_refcount_ro5(refcountArray unsafe.Pointer, index uint64, value uint64) {
+	Assert(value>>32 == 0)
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(uintptr(refcountArray)+uintptr(index*4))), 4)
+	binary.BigEndian.PutUint32(buf, uint32(value))
+}
+
+func get_refcount_ro6(refcountArray unsafe.Pointer, index uint64) uint64 {
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(uintptr(refcountArray)+uintptr(index*8))), 8)
+	return binary.BigEndian.Uint64(buf)
+}
+
+func set_refcount_ro6(refcountArray unsafe.Pointer, index uint64, value uint64) {
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(uintptr(refcountArray)+uintptr(index*8))), 8)
+	binary.BigEndian.PutUint64(buf, value)
+}
+
+var get_refcount_funcs = []Get_Refcount_Func{
+	get_refcount_ro0,
+	get_refcount_ro1,
+	get_refcount_ro2,
+	get_refcount_ro3,
+	get_refcount,
+	get_refcount_ro5,
+	get_refcount_ro6,
+}
+
+var set_refcount_funcs = []Set_Refcount_Func{
+	set_refcount_ro0,
+	set_refcount_ro1,
+	set_refcount_ro2,
+	set_refcount_ro3,
+	set_refcount,
+	set_refcount_ro5,
+	set_refcount_ro6,
+}
+
+// set up the refcount related fields for the given refcount order
+func qcow2_set_refcount_order(s *BDRVQcow2State, refcountOrder uint32) {
+	s.RefcountOrder = refcountOrder
+	s.RefcountBits = 1 << refcountOrder
+	s.RefcountMax = uint64(1) << (s.RefcountBits - 1)
+	s.RefcountMax += s.RefcountMax - 1
+	s.RefcountBlockBits = s.ClusterBits - (refcountOrder - 3)
+	s.RefcountBlockSize = 1 << s.RefcountBlockBits
+	s.get_refcount = get_refcount_funcs[refcountOrder]
+	s.set_refcount = set_refcount_funcs[refcountOrder]
 }
 
 // Initate the refcount table
@@ -67,14 +168,14 @@ func load_refcount_block(bs *BlockDriverState, refcountBlockOffset uint64) (unsa
 	return qcow2_cache_get(bs, s.RefcountBlockCache, refcountBlockOffset)
 }
 
-func qcow2_get_refcount(bs *BlockDriverState, clusterIndex uint64) (uint16, error) {
+func qcow2_get_refcount(bs *BlockDriverState, clusterIndex uint64) (uint64, error) {
 	s := bs.opaque.(*BDRVQcow2State)
 	var refcountTableIndex, blockIndex uint64
 	var refcountBlockOffset uint64
 	var err error
 	var refcountBlock unsafe.Pointer
 
-	refcount := uint16(0)
+	refcount := uint64(0)
 	refcountTableIndex = clusterIndex >> s.RefcountBlockBits
 	if refcountTableIndex >= uint64(s.RefcountTableSize) {
 		return 0, nil
@@ -114,6 +215,7 @@ func alloc_refcount_block(bs *BlockDriverState, clusterIndex uint64) (unsafe.Poi
 	var refcountBlock unsafe.Pointer
 	var metaOffset, blocksUsed uint64
 	var data64 uint64
+	var referenced bool
 
 	refcountTableIndex = clusterIndex >> s.RefcountBlockBits
 
@@ -161,6 +263,7 @@ func alloc_refcount_block(bs *BlockDriverState, clusterIndex uint64) (unsafe.Poi
 		if err = update_refcount(bs, newBlockOffset, uint64(s.ClusterSize), 1, false, QCOW2_DISCARD_NEVER); err != nil {
 			goto fail
 		}
+		referenced = true
 		if err = qcow2_cache_flush(bs, s.RefcountBlockCache); err != nil {
 			goto fail
 		}
@@ -212,6 +315,16 @@ fail:
 	if refcountBlock != nil {
 		qcow2_cache_put(s.RefcountBlockCache, refcountBlock)
 	}
+	//drop the reservation of alloc_clusters_noref unless the cluster is
+	//referenced already. the new block describing itself isn't linked yet,
+	//it must not be written over the cluster once it's reused
+	if !referenced {
+		if refcountBlock != nil {
+			qcow2_cache_discard(s.RefcountBlockCache, refcountBlock)
+			refcountBlock = nil
+		}
+		qcow2_free_map_set(s.FreeMap, newBlockOffset>>s.ClusterBits, 1, false)
+	}
 	return refcountBlock, err
 }
 
@@ -230,7 +343,7 @@ func qcow2_refcount_area(bs *BlockDriverState, startOffset uint64, additionalClu
 	Assert((startOffset % uint64(s.ClusterSize)) == 0)
 
 	qcow2_refcount_metadata_size(startOffset/uint64(s.ClusterSize)+additionalClusters,
-		uint64(s.ClusterSize), QCOW2_REFCOUNT_ORDER,
+		uint64(s.ClusterSize), int(s.RefcountOrder),
 		!exactSize, &totalRefblockCount_u64)
 
 	if totalRefblockCount_u64 > QCOW_MAX_REFTABLE_SIZE {
@@ -244,7 +357,7 @@ func qcow2_refcount_area(bs *BlockDriverState, startOffset uint64, additionalClu
 	if exactSize {
 		tableSize = totalRefblockCount
 	} else {
-		tableSize = totalRefblockCount + round_up(totalRefblockCount, 2)
+		tableSize = totalRefblockCount + div_round_up(totalRefblockCount, 2)
 	}
 
 	/* The qcow2 file can only store the reftable size in number of clusters */
@@ -391,7 +504,7 @@ func update_refcount(bs *BlockDriverState, offset uint64, length uint64, addend
 	last = start_of_cluster(s, offset+length-1)
 	for clusterOffset = start; clusterOffset <= last; clusterOffset += uint64(s.ClusterSize) {
 		var blockIndex int64
-		var refcount uint16
+		var refcount uint64
 		clusterIndex := int64(clusterOffset >> s.ClusterBits)
 		tableIndex := int64(clusterIndex >> s.RefcountBlockBits)
 		/* Load the refcount block and allocate it if needed */
@@ -413,38 +526,46 @@ func update_refcount(bs *BlockDriverState, offset uint64, length uint64, addend
 		blockIndex = clusterIndex & int64(s.RefcountBlockSize-1)
 		refcount = s.get_refcount(refcountBlock, uint64(blockIndex))
 
-		if (decrease && refcount-uint16(addend) > refcount) || (!decrease && (refcount+uint16(addend) < refcount)) {
+		if (decrease && refcount-addend > refcount) ||
+			(!decrease && (refcount+addend < refcount || refcount+addend > s.RefcountMax)) {
 			err = ERR_EINVAL
 			goto fail
 		}
 
 		if decrease {
-			refcount -= uint16(addend)
+			refcount -= addend
 		} else {
-			refcount += uint16(addend)
+			refcount += addend
 		}
 
 		if refcount == 0 && uint64(clusterIndex) < s.FreeClusterIndex {
 			s.FreeClusterIndex = uint64(clusterIndex)
 		}
 		s.set_refcount(refcountBlock, uint64(blockIndex), refcount)
+		if s.FreeMap != nil {
+			qcow2_free_map_set(s.FreeMap, uint64(clusterIndex), 1, refcount != 0)
+		}
 
 		if refcount == 0 {
 			var table unsafe.Pointer
 
-			table = qcow2_cache_is_table_offset(s.RefcountBlockCache, uint64(offset))
+			table = qcow2_cache_is_table_offset(s.RefcountBlockCache, clusterOffset)
 			if table != nil {
 				qcow2_cache_put(s.RefcountBlockCache, refcountBlock)
 				oldTableIndex = -1
 				//qcow2_cache_discard(s->refcount_block_cache, table);
 			}
-			table = qcow2_cache_is_table_offset(s.L2TableCache, uint64(offset))
-			if table != nil {
-				qcow2_cache_discard(s.L2TableCache, table)
+			//a freed l2 table may be cached as several slices
+			sliceSize := uint64(s.L2TableCache.tableSize)
+			for sliceOffset := clusterOffset; sliceOffset < clusterOffset+uint64(s.ClusterSize); sliceOffset += sliceSize {
+				table = qcow2_cache_is_table_offset(s.L2TableCache, sliceOffset)
+				if table != nil {
+					qcow2_cache_discard(s.L2TableCache, table)
+				}
 			}
 
 			if s.DiscardPassthrough[dType] {
-				update_refcount_discard(bs, clusterOffset, uint64(s.ClusterSize))
+				update_refcount_discard(bs, bs.current, clusterOffset, uint64(s.ClusterSize))
 			}
 		}
 	}
@@ -458,6 +579,10 @@ fail:
 	if err != nil {
 		update_refcount(bs, offset, clusterOffset-offset, addend, !decrease, QCOW2_DISCARD_NEVER)
 	}
+	//the discards are batched by the callers setting CacheDiscards
+	if !s.CacheDiscards {
+		qcow2_process_discards(bs, err)
+	}
 	return err
 }
 
@@ -475,28 +600,29 @@ func qcow2_update_cluster_refcount(bs *BlockDriverState, clusterIndex uint64, ad
 func alloc_clusters_noref(bs *BlockDriverState, size uint64, max uint64) (uint64, error) {
 
 	s := bs.opaque.(*BDRVQcow2State)
-	var nbClusters uint64
-	var refcount uint16
+	var nbClusters, clusterIndex uint64
 	var err error
 
-	nbClusters = size_to_clusters(s, size)
-retry:
-	//try to find nbClusters of continuous empty blocks.
-	for i := uint64(0); i < nbClusters; i++ {
-		nextClusterIndex := s.FreeClusterIndex
-		s.FreeClusterIndex++
-		if refcount, err = qcow2_get_refcount(bs, nextClusterIndex); err != nil {
+	if s.FreeMap == nil {
+		if err = qcow2_free_map_init(bs); err != nil {
 			return 0, err
-		} else if refcount != 0 {
-			goto retry
 		}
 	}
+	nbClusters = size_to_clusters(s, size)
+	//no cluster below FreeClusterIndex is free, searching from the lowest
+	//free one reuses the discarded space first
+	s.FreeClusterIndex = qcow2_free_map_next(s.FreeMap, s.FreeClusterIndex, false)
+	//try to find nbClusters of continuous empty blocks.
+	clusterIndex = qcow2_free_map_find(s.FreeMap, s.FreeClusterIndex, nbClusters)
 
-	if s.FreeClusterIndex > 0 && s.FreeClusterIndex-1 > (max>>uint(s.ClusterBits)) {
+	if clusterIndex+nbClusters-1 > (max >> uint(s.ClusterBits)) {
 		return 0, ERR_EFBIG
 	}
+	//reserved until the references are taken, so the refcount blocks
+	//allocated meanwhile go elsewhere
+	qcow2_free_map_set(s.FreeMap, clusterIndex, nbClusters, true)
 	//return the first pointer of the continuous blocks.
-	return (s.FreeClusterIndex - nbClusters) << uint64(s.ClusterBits), nil
+	return clusterIndex << uint64(s.ClusterBits), nil
 }
 
 func qcow2_alloc_clusters(bs *BlockDriverState, size uint64) (uint64, error) {
@@ -508,6 +634,11 @@ func qcow2_alloc_clusters(bs *BlockDriverState, size uint64) (uint64, error) {
 			return offset, err
 		}
 		err = update_refcount(bs, offset, size, 1, false, QCOW2_DISCARD_NEVER)
+		if err != nil {
+			//drop the reservation, the references taken are rolled back
+			s := bs.opaque.(*BDRVQcow2State)
+			qcow2_free_map_set(s.FreeMap, offset>>s.ClusterBits, size_to_clusters(s, size), false)
+		}
 		if err != ERR_EAGAIN {
 			break
 		}
@@ -519,7 +650,7 @@ func qcow2_alloc_clusters_at(bs *BlockDriverState, offset uint64, nbClusters int
 
 	s := bs.opaque.(*BDRVQcow2State)
 	var clusterIndex, i uint64
-	var refcount uint16
+	var refcount uint64
 	var err error
 
 	Assert(nbClusters >= 0)
@@ -586,7 +717,7 @@ func update_max_refcount_table_index(s *BDRVQcow2State) {
 	s.MaxRefcountTableIndex = i
 }
 
-func update_refcount_discard(bs *BlockDriverState,
+func update_refcount_discard(bs *BlockDriverState, file *BdrvChild,
 	offset uint64, length uint64) {
 
 	s := bs.opaque.(*BDRVQcow2State)
@@ -595,6 +726,9 @@ func update_refcount_discard(bs *BlockDriverState,
 
 	for i = s.Discards.Front(); i != nil; i = i.Next() {
 		d = i.Value.(*Qcow2DiscardRegion)
+		if d.file != file {
+			continue
+		}
 		newStart := min(offset, d.offset)
 		newEnd := max(offset+length, d.offset+d.bytes)
 		if newEnd-newStart <= length+d.bytes {
@@ -606,6 +740,7 @@ func update_refcount_discard(bs *BlockDriverState,
 	}
 	d = &Qcow2DiscardRegion{
 		bs:     bs,
+		file:   file,
 		offset: offset,
 		bytes:  length,
 	}
@@ -615,7 +750,7 @@ found:
 	/* Merge discard requests if they are adjacent now */
 	for i = s.Discards.Front(); i != nil; i = i.Next() {
 		p = i.Value.(*Qcow2DiscardRegion)
-		if p == d || p.offset > d.offset+d.bytes || d.offset > p.offset+p.bytes {
+		if p == d || p.file != d.file || p.offset > d.offset+d.bytes || d.offset > p.offset+p.bytes {
 			continue
 		}
 		s.Discards.Remove(i)
@@ -628,13 +763,14 @@ found:
 func qcow2_process_discards(bs *BlockDriverState, err error) {
 	s := bs.opaque.(*BDRVQcow2State)
 	var d *Qcow2DiscardRegion
-	var e *list.Element
+	var e, next *list.Element
 
-	for e = s.Discards.Front(); e != nil; e = e.Next() {
+	for e = s.Discards.Front(); e != nil; e = next {
+		next = e.Next()
 		d = e.Value.(*Qcow2DiscardRegion)
 		s.Discards.Remove(e)
 		if err == nil {
-			bdrv_pdiscard(bs.current, d.offset, d.bytes)
+			bdrv_pdiscard(d.file, d.offset, d.bytes)
 		}
 	}
 }
@@ -1,13 +1,10 @@
 package qcow2
 
 import (
-	"container/list"
-	"context"
 	"sync"
 )
 
 type AioTaskFunc func(task *Qcow2Task) error
-type AioTaskRoutineFunc func(ctx context.Context, taskList *SignalList)
 
 type Qcow2Task struct {
 	bs             *BlockDriverState
@@ -18,60 +15,106 @@ type Qcow2Task struct {
 	qiov           *QEMUIOVector
 	qiovOffset     uint64
 	l2meta         *QCowL2Meta /* only for write */
-	completeCh     chan any
-	errorCh        chan error
+	flags          BdrvRequestFlags
+	pool           *AioTaskPool
 	taskFunc       AioTaskFunc
 }
 
-type SignalList struct {
-	list     *list.List
-	awakenCh chan any
-	lock     sync.RWMutex
+// the workers running the tasks of all the requests of an image
+type Qcow2WorkerPool struct {
+	tasks chan *Qcow2Task
+	wg    sync.WaitGroup
+	//taken for reading by the submitters, the tasks are no longer queued once closed
+	lock   sync.RWMutex
+	closed bool
 }
 
-func NewSignalList() *SignalList {
-	return &SignalList{
-		list:     list.New(),
-		awakenCh: make(chan any),
+// the tasks of one request, the first error fails the request
+type AioTaskPool struct {
+	wg     sync.WaitGroup
+	lock   sync.Mutex
+	status error
+}
+
+func qcow2_worker_pool_new(workers int, queueDepth int) *Qcow2WorkerPool {
+	p := &Qcow2WorkerPool{
+		tasks: make(chan *Qcow2Task, queueDepth),
+	}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go qcow2_worker_routine(p)
+	}
+	return p
+}
+
+// the queued tasks are still run, the tasks started afterwards run on their submitter
+func qcow2_worker_pool_destroy(p *Qcow2WorkerPool) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.tasks)
+	p.lock.Unlock()
+	p.wg.Wait()
+}
+
+func qcow2_worker_routine(p *Qcow2WorkerPool) {
+	defer p.wg.Done()
+	for task := range p.tasks {
+		aio_task_run(task)
 	}
 }
 
-func (l *SignalList) Push(ele any) {
-	l.lock.Lock()
-	l.list.PushBack(ele)
-	l.lock.Unlock()
-	l.awakenCh <- struct{}{}
+func aio_task_pool_new() *AioTaskPool {
+	return &AioTaskPool{}
 }
 
-func (l *SignalList) Pop() any {
-	l.lock.Lock()
-	defer l.lock.Unlock()
-	ele := l.list.Front()
-	if ele != nil {
-		l.list.Remove(ele)
-		return ele.Value
+func aio_task_run(task *Qcow2Task) {
+	aio := task.pool
+	if err := task.taskFunc(task); err != nil {
+		aio.lock.Lock()
+		if aio.status == nil {
+			aio.status = err
+		}
+		aio.lock.Unlock()
 	}
-	return nil
+	aio.wg.Done()
 }
 
-func qcow2_aio_routine(ctx context.Context, taskList *SignalList) {
-	for {
+/*
+ * queue the task to the workers. when the queue is full, the submitter
+ * runs the task itself, which holds it back until the workers catch up
+ * and can't deadlock a task that submits tasks of its own.
+ */
+func aio_task_pool_start_task(p *Qcow2WorkerPool, aio *AioTaskPool, task *Qcow2Task) {
+	queued := false
+	task.pool = aio
+	aio.wg.Add(1)
+	p.lock.RLock()
+	if !p.closed {
 		select {
-		case <-ctx.Done():
-			return
-		case <-taskList.awakenCh:
-			for {
-				obj := taskList.Pop()
-				if obj == nil {
-					break
-				}
-				task := obj.(*Qcow2Task)
-				if err := task.taskFunc(task); err != nil {
-					task.errorCh <- err
-				} else {
-					task.completeCh <- struct{}{}
-				}
-			}
+		case p.tasks <- task:
+			queued = true
+		default:
 		}
 	}
+	p.lock.RUnlock()
+	if !queued {
+		aio_task_run(task)
+	}
+}
+
+func aio_task_pool_wait_all(aio *AioTaskPool) {
+	aio.wg.Wait()
+}
+
+func aio_task_pool_status(aio *AioTaskPool) error {
+	aio.lock.Lock()
+	defer aio.lock.Unlock()
+	return aio.status
 }
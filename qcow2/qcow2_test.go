@@ -1,8 +1,13 @@
 package qcow2
 
 import (
+	"bytes"
+	"fmt"
 	"os"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/stretchr/testify/assert"
@@ -45,13 +50,13 @@ func Test_qcow2_simple(t *testing.T) {
 	//check cache
 	cluster1Ref, err := qcow2_get_refcount(bs, 0)
 	assert.Nil(t, err)
-	assert.Equal(t, cluster1Ref, uint16(1))
+	assert.Equal(t, cluster1Ref, uint64(1))
 	cluster4Ref, err := qcow2_get_refcount(bs, 3)
 	assert.Nil(t, err)
-	assert.Equal(t, cluster4Ref, uint16(1))
+	assert.Equal(t, cluster4Ref, uint64(1))
 	cluster5Ref, err := qcow2_get_refcount(bs, 4)
 	assert.Nil(t, err)
-	assert.Equal(t, cluster5Ref, uint16(0))
+	assert.Equal(t, cluster5Ref, uint64(0))
 
 	//flush the cache
 	qcow2_cache_flush(bs, s.RefcountBlockCache)
@@ -222,3 +227,684 @@ func Test_qcow2_write_read_zeros(t *testing.T) {
 	qcow2_close(bs)
 	os.Remove(filename)
 }
+
+func Test_qcow2_v2_write_zeroes_discard(t *testing.T) {
+	var basefile = "/tmp/qcow2_v2_base.qcow2"
+	var filename = "/tmp/qcow2_v2.qcow2"
+	os.Remove(basefile)
+	os.Remove(filename)
+
+	err := Blk_Create(basefile, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 1048576, OPT_COMPAT: "0.10"})
+	assert.Nil(t, err)
+	base, err := Blk_Open(basefile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR|BDRV_O_UNMAP)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(QCOW2_VERSION2), base.bs.current.header.Version)
+	assert.Equal(t, uint32(QCOW2_V2_HEADER_LENGTH), base.bs.current.header.HeaderLength)
+	data := make([]byte, 3*65536)
+	for i := range data {
+		data[i] = 0x5a
+	}
+	_, err = Blk_Pwrite(base, 0, data, uint64(len(data)), 0)
+	assert.Nil(t, err)
+
+	//without a backing file the clusters can simply be deallocated
+	_, err = Blk_Pwrite_Zeroes(base, 65536, 65536, BDRV_REQ_MAY_UNMAP)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2*65536), count_allocated(t, base, 1048576))
+	Blk_Close(base)
+
+	err = Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 1048576,
+		OPT_COMPAT: "0.10", OPT_BACKING: basefile})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR|BDRV_O_UNMAP)
+	assert.Nil(t, err)
+
+	//zeroes over the backing file are written out
+	_, err = Blk_Pwrite_Zeroes(root, 0, 65536, BDRV_REQ_MAY_UNMAP)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite_Zeroes(root, 2*65536+100, 200, 0)
+	assert.Nil(t, err)
+	buf := make([]byte, 3*65536)
+	_, err = Blk_Pread(root, 0, buf, uint64(len(buf)))
+	assert.Nil(t, err)
+	assert.True(t, buffer_is_zero(buf, 2*65536))
+	assert.Equal(t, byte(0x5a), buf[2*65536+99])
+	assert.True(t, buffer_is_zero(buf[2*65536+100:], 200))
+	assert.Equal(t, byte(0x5a), buf[2*65536+300])
+
+	//no zero flag has been written
+	s := root.bs.opaque.(*BDRVQcow2State)
+	l2Slice, l2Index, err := get_cluster_table(root.bs, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), get_l2_entry(s, l2Slice, l2Index)&QCOW_OFLAG_ZERO)
+	qcow2_cache_put(s.L2TableCache, l2Slice)
+
+	//a discarded cluster falls back to the backing file
+	err = Blk_Discard(root, 2*65536, 65536)
+	assert.Nil(t, err)
+	_, err = Blk_Pread(root, 2*65536, buf, 65536)
+	assert.Nil(t, err)
+	assert.Equal(t, data[:65536], buf[:65536])
+	Blk_Close(root)
+
+	err = Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 1048576,
+		OPT_COMPAT: "0.10", OPT_SUBCLUSTER: true})
+	assert.NotNil(t, err)
+
+	os.Remove(basefile)
+	os.Remove(filename)
+}
+
+func Test_qcow2_aio_workers(t *testing.T) {
+	var filename = "/tmp/qcow2_aio_workers.qcow2"
+	const size = 4 * 1024 * 1024
+
+	expected := make([]byte, size)
+	data := make([]byte, 1024*1024+1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	for _, workers := range []int{0, 1, 4} {
+		os.Remove(filename)
+		err := Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+		assert.Nil(t, err)
+		goroutines := runtime.NumGoroutine()
+		root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2",
+			OPT_AIO_WORKERS: workers, OPT_AIO_QUEUE_DEPTH: 1}, BDRV_O_RDWR)
+		assert.Nil(t, err)
+		s := root.bs.opaque.(*BDRVQcow2State)
+		assert.Equal(t, workers == 0, s.AioWorkers == nil)
+
+		//unaligned writes spanning many clusters, partly overwritten
+		copy(expected[32768+100:], data)
+		_, err = Blk_Pwrite(root, 32768+100, data, uint64(len(data)), 0)
+		assert.Nil(t, err)
+		copy(expected[500000:], data[:300000])
+		_, err = Blk_Pwrite(root, 500000, data, 300000, 0)
+		assert.Nil(t, err)
+
+		buf := make([]byte, size)
+		_, err = Blk_Pread(root, 0, buf, size)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, buf)
+		Blk_Close(root)
+		//the workers are gone after close
+		assert.Equal(t, goroutines, runtime.NumGoroutine())
+	}
+	os.Remove(filename)
+}
+
+func Test_qcow2_worker_pool_destroy(t *testing.T) {
+	const submitters = 8
+	const tasks = 200
+	var ran sync.WaitGroup
+	var count int64
+	var lock sync.Mutex
+	p := qcow2_worker_pool_new(2, 4)
+	ran.Add(submitters)
+
+	//tasks started while the pool is destroyed run on their submitter
+	for i := 0; i < submitters; i++ {
+		go func() {
+			defer ran.Done()
+			aio := aio_task_pool_new()
+			for j := 0; j < tasks; j++ {
+				aio_task_pool_start_task(p, aio, &Qcow2Task{taskFunc: func(task *Qcow2Task) error {
+					lock.Lock()
+					count++
+					lock.Unlock()
+					return nil
+				}})
+			}
+			aio_task_pool_wait_all(aio)
+		}()
+	}
+	qcow2_worker_pool_destroy(p)
+	ran.Wait()
+	assert.Equal(t, int64(submitters*tasks), count)
+	qcow2_worker_pool_destroy(p)
+}
+
+func Test_qcow2_concurrent_allocating_writes(t *testing.T) {
+	var basefile = "/tmp/qcow2_concurrent_base.qcow2"
+	var filename = "/tmp/qcow2_concurrent.qcow2"
+	const writers = 16
+	const rounds = 32
+	const region = 5000
+	const size = rounds * 131072
+	os.Remove(basefile)
+	os.Remove(filename)
+
+	err := Blk_Create(basefile, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	base, err := Blk_Open(basefile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	backing := bytes.Repeat([]byte{0x11}, size)
+	_, err = Blk_Pwrite(base, 0, backing, size, 0)
+	assert.Nil(t, err)
+	Blk_Close(base)
+
+	err = Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size, OPT_BACKING: basefile})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+
+	//disjoint regions sharing the same unallocated clusters, each write
+	//has to wait for the allocations in flight instead of overwriting them
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte(i + 0x20)}, region-1000)
+			for r := 0; r < rounds; r++ {
+				Blk_Pwrite(root, uint64(r*131072+i*region), data, uint64(len(data)), 0)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 131072)
+			for r := 0; r < rounds; r++ {
+				Blk_Pread(root, uint64(r*131072), buf, uint64(len(buf)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	buf := make([]byte, size)
+	_, err = Blk_Pread(root, 0, buf, size)
+	assert.Nil(t, err)
+	for r := 0; r < rounds; r++ {
+		for i := 0; i < writers; i++ {
+			start := r*131072 + i*region
+			assert.Equal(t, bytes.Repeat([]byte{byte(i + 0x20)}, region-1000), buf[start:start+region-1000])
+			assert.Equal(t, bytes.Repeat([]byte{0x11}, 1000), buf[start+region-1000:start+region])
+		}
+	}
+	Blk_Close(root)
+	os.Remove(basefile)
+	os.Remove(filename)
+}
+
+func Test_qcow2_l2_cache_entry_size(t *testing.T) {
+	var filename = "/tmp/qcow2_l2_slices.qcow2"
+	const size = 1 << 40
+	const stride = 32 * 1024 * 1024 //guest bytes covered by a 4k slice
+	const count = 300
+	os.Remove(filename)
+
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+
+	//the default cache is bounded, not one l2 table per l1 entry
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	s := root.bs.opaque.(*BDRVQcow2State)
+	assert.Equal(t, DEFAULT_L2_CACHE, s.L2TableCache.size*s.L2TableCache.tableSize)
+	assert.Equal(t, s.L2Size, uint32(s.L2SliceSize))
+	Blk_Close(root)
+
+	for _, entrySize := range []int{256, 1000, 128 * 1024} {
+		_, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_L2_CACHE_ENTRY_SIZE: entrySize}, BDRV_O_RDWR)
+		assert.NotNil(t, err)
+	}
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_L2_CACHE_ENTRY_SIZE: 4096},
+		BDRV_O_RDWR|BDRV_O_UNMAP)
+	assert.Nil(t, err)
+	s = root.bs.opaque.(*BDRVQcow2State)
+	assert.Equal(t, 4096, s.L2TableCache.tableSize)
+	assert.Equal(t, 512, s.L2SliceSize)
+	assert.Equal(t, DEFAULT_L2_CACHE/4096, s.L2TableCache.size)
+
+	//more slices than cache entries, so the slices get evicted and reloaded
+	data := make([]byte, 3*DEFAULT_CLUSTER_SIZE)
+	for i := range data {
+		data[i] = byte(i%251 + 1)
+	}
+	for i := uint64(0); i < count; i++ {
+		_, err = Blk_Pwrite(root, i*stride+100, data, uint64(len(data)), 0)
+		assert.Nil(t, err)
+	}
+	for i := uint64(0); i < count; i += 3 {
+		_, err = Blk_Pwrite_Zeroes(root, i*stride+DEFAULT_CLUSTER_SIZE, DEFAULT_CLUSTER_SIZE, BDRV_REQ_MAY_UNMAP)
+		assert.Nil(t, err)
+		err = Blk_Discard(root, i*stride+2*DEFAULT_CLUSTER_SIZE, DEFAULT_CLUSTER_SIZE)
+		assert.Nil(t, err)
+	}
+	Blk_Close(root)
+
+	//the slices written back make up whole l2 tables
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	buf := make([]byte, len(data)+100)
+	for i := uint64(0); i < count; i++ {
+		expected := make([]byte, len(buf))
+		copy(expected[100:], data)
+		if i%3 == 0 {
+			copy(expected[DEFAULT_CLUSTER_SIZE:], make([]byte, 2*DEFAULT_CLUSTER_SIZE))
+		}
+		_, err = Blk_Pread(root, i*stride, buf, uint64(len(buf)))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, buf)
+	}
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_qcow2_shared_cache_budget(t *testing.T) {
+	const images = 8
+	const stride = 32 * 1024 * 1024 //guest bytes covered by a 4k slice
+	const count = 32
+	const size = count * stride
+	used := qcow2_cache_manager_used()
+	Blk_Set_Cache_Budget(used + 16*4096)
+	defer Blk_Set_Cache_Budget(QCOW2_DEFAULT_CACHE_BUDGET)
+
+	roots := make([]*BdrvChild, images)
+	for n := range roots {
+		filename := fmt.Sprintf("/tmp/qcow2_cache_budget%d.qcow2", n)
+		os.Remove(filename)
+		err := Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+		assert.Nil(t, err)
+		roots[n], err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_L2_CACHE_ENTRY_SIZE: 4096}, BDRV_O_RDWR)
+		assert.Nil(t, err)
+	}
+
+	//the images take turns, so the dirty tables of one are written back
+	//when another needs the memory
+	data := make([]byte, 4096)
+	for i := uint64(0); i < count; i++ {
+		for n, root := range roots {
+			data[0], data[1] = byte(n), byte(i)
+			_, err := Blk_Pwrite(root, i*stride, data, uint64(len(data)), 0)
+			assert.Nil(t, err)
+		}
+		assert.LessOrEqual(t, qcow2_cache_manager_used(), used+16*4096+2*images*DEFAULT_CLUSTER_SIZE)
+	}
+	buf := make([]byte, len(data))
+	for n, root := range roots {
+		for i := uint64(0); i < count; i++ {
+			_, err := Blk_Pread(root, i*stride, buf, uint64(len(buf)))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte{byte(n), byte(i)}, buf[:2])
+		}
+		Blk_Close(root)
+	}
+	assert.Equal(t, used, qcow2_cache_manager_used())
+
+	for n := range roots {
+		filename := fmt.Sprintf("/tmp/qcow2_cache_budget%d.qcow2", n)
+		root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, 0)
+		assert.Nil(t, err)
+		for i := uint64(0); i < count; i++ {
+			_, err = Blk_Pread(root, i*stride, buf, uint64(len(buf)))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte{byte(n), byte(i)}, buf[:2])
+		}
+		Blk_Close(root)
+		os.Remove(filename)
+	}
+}
+
+func Test_qcow2_cache_timer(t *testing.T) {
+	var filename = "/tmp/qcow2_cache_timer.qcow2"
+	const size = 64 * 1024 * 1024
+	os.Remove(filename)
+
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	goroutines := runtime.NumGoroutine()
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_AIO_WORKERS: 0,
+		OPT_CACHE_CLEAN_INTERVAL: 1, OPT_METADATA_WRITEBACK_INTERVAL: 1}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	s := root.bs.opaque.(*BDRVQcow2State)
+	assert.NotNil(t, s.CacheTimer)
+
+	data := bytes.Repeat([]byte{0x5a}, 4096)
+	_, err = Blk_Pwrite(root, 3*DEFAULT_CLUSTER_SIZE, data, uint64(len(data)), 0)
+	assert.Nil(t, err)
+	dirty := func(c *Qcow2Cache) bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		for i := 0; i < c.size; i++ {
+			if c.entries[i].dirty {
+				return true
+			}
+		}
+		return false
+	}
+	assert.True(t, dirty(s.L2TableCache))
+
+	//the metadata reaches the file without a flush
+	assert.Eventually(t, func() bool {
+		return !dirty(s.L2TableCache) && !dirty(s.RefcountBlockCache)
+	}, 3*time.Second, 50*time.Millisecond)
+	other, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, 0)
+	assert.Nil(t, err)
+	buf := make([]byte, len(data))
+	_, err = Blk_Pread(other, 3*DEFAULT_CLUSTER_SIZE, buf, uint64(len(buf)))
+	assert.Nil(t, err)
+	assert.Equal(t, data, buf)
+	Blk_Close(other)
+
+	//the idle entries are dropped after a whole interval unused
+	assert.Eventually(t, func() bool {
+		return qcow2_cache_is_table_offset(s.L2TableCache, s.L1Table[0]&L1E_OFFSET_MASK) == nil
+	}, 4*time.Second, 50*time.Millisecond)
+
+	Blk_Close(root)
+	assert.Equal(t, goroutines, runtime.NumGoroutine())
+
+	//both disabled, no goroutine at all
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2",
+		OPT_CACHE_CLEAN_INTERVAL: 0, OPT_METADATA_WRITEBACK_INTERVAL: 0}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	assert.Nil(t, root.bs.opaque.(*BDRVQcow2State).CacheTimer)
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_qcow2_writeback_error(t *testing.T) {
+	var filename = "/tmp/qcow2_writeback_error.qcow2"
+	const size = 64 * 1024 * 1024
+	os.Remove(filename)
+
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2",
+		OPT_METADATA_WRITEBACK_INTERVAL: 1}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	s := root.bs.opaque.(*BDRVQcow2State)
+	setWritable := func(writable bool) {
+		s.Qlock()
+		defer s.Qunlock()
+		if writable {
+			root.bs.current.perm |= PERM_WRITABLE
+		} else {
+			root.bs.current.perm &^= PERM_WRITABLE
+		}
+	}
+
+	//the writeback fails in the background, the next flush returns it
+	data := bytes.Repeat([]byte{0x5a}, 4096)
+	_, err = Blk_Pwrite(root, 3*DEFAULT_CLUSTER_SIZE, data, uint64(len(data)), 0)
+	assert.Nil(t, err)
+	setWritable(false)
+	assert.Eventually(t, func() bool {
+		s.Qlock()
+		defer s.Qunlock()
+		return s.WritebackErr != nil
+	}, 3*time.Second, 50*time.Millisecond)
+	setWritable(true)
+	assert.ErrorIs(t, Blk_Flush(root), Err_NoWritePerm)
+	assert.Nil(t, Blk_Flush(root))
+
+	//and so does the close
+	_, err = Blk_Pwrite(root, 4*DEFAULT_CLUSTER_SIZE, data, uint64(len(data)), 0)
+	assert.Nil(t, err)
+	setWritable(false)
+	assert.Eventually(t, func() bool {
+		s.Qlock()
+		defer s.Qunlock()
+		return s.WritebackErr != nil
+	}, 3*time.Second, 50*time.Millisecond)
+	setWritable(true)
+	assert.ErrorIs(t, Blk_Close(root), Err_NoWritePerm)
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, 0)
+	assert.Nil(t, err)
+	buf := make([]byte, len(data))
+	_, err = Blk_Pread(root, 4*DEFAULT_CLUSTER_SIZE, buf, uint64(len(buf)))
+	assert.Nil(t, err)
+	assert.Equal(t, data, buf)
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func bench_qcow2_parallel(b *testing.B, write bool) {
+	var filename = "/tmp/qcow2_bench.qcow2"
+	const size = 64 * 1024 * 1024
+	const chunk = 65536
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(b, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(b, err)
+	defer Blk_Close(root)
+	//fully allocated, so that the writes only look up the clusters
+	data := make([]byte, 1024*1024)
+	for offset := uint64(0); offset < size; offset += uint64(len(data)) {
+		_, err = Blk_Pwrite(root, offset, data, uint64(len(data)), 0)
+		assert.Nil(b, err)
+	}
+
+	for _, goroutines := range []int{1, 2, 4, 8, 16, 32} {
+		b.Run(fmt.Sprintf("goroutines-%d", goroutines), func(b *testing.B) {
+			var wg sync.WaitGroup
+			b.SetBytes(chunk)
+			b.ResetTimer()
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					buf := make([]byte, chunk)
+					for i := g; i < b.N; i += goroutines {
+						//spread the requests over the whole image
+						offset := uint64(i*7919%(size/chunk)) * chunk
+						if write {
+							Blk_Pwrite(root, offset, buf, chunk, 0)
+						} else {
+							Blk_Pread(root, offset, buf, chunk)
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func Benchmark_qcow2_parallel_read(b *testing.B) {
+	bench_qcow2_parallel(b, false)
+}
+
+func Benchmark_qcow2_parallel_write(b *testing.B) {
+	bench_qcow2_parallel(b, true)
+}
+
+func Test_qcow2_discard_no_unref(t *testing.T) {
+	var filename = "/tmp/qcow2_discard_no_unref.qcow2"
+	os.Remove(filename)
+
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 1048576})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_DISCARD_NO_UNREF: true},
+		BDRV_O_RDWR|BDRV_O_UNMAP)
+	assert.Nil(t, err)
+	bs := root.bs
+	s := bs.opaque.(*BDRVQcow2State)
+	assert.True(t, s.DiscardNoUnref)
+	data := bytes.Repeat([]byte{0x5a}, 4*65536)
+	_, err = Blk_Pwrite(root, 0, data, uint64(len(data)), 0)
+	assert.Nil(t, err)
+
+	hostOffset := func(offset uint64) (uint64, QCow2SubclusterType) {
+		var bytes uint32 = 65536
+		var host uint64
+		var scType QCow2SubclusterType
+		err := qcow2_get_host_offset(bs, offset, &bytes, &host, &scType)
+		assert.Nil(t, err)
+		return host, scType
+	}
+	host1, _ := hostOffset(65536)
+	host2, _ := hostOffset(2 * 65536)
+	fileLength, err := Blk_Getlength(bs.current)
+	assert.Nil(t, err)
+
+	//the discarded and zeroed clusters read as zeroes but stay allocated
+	err = Blk_Discard(root, 65536, 65536)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite_Zeroes(root, 2*65536, 65536, BDRV_REQ_MAY_UNMAP)
+	assert.Nil(t, err)
+	buf := make([]byte, 4*65536)
+	_, err = Blk_Pread(root, 0, buf, uint64(len(buf)))
+	assert.Nil(t, err)
+	assert.Equal(t, data[:65536], buf[:65536])
+	assert.True(t, buffer_is_zero(buf[65536:], 2*65536))
+	assert.Equal(t, data[3*65536:], buf[3*65536:])
+	for _, host := range []uint64{host1, host2} {
+		refcount, err := qcow2_get_refcount(bs, host>>s.ClusterBits)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(1), refcount)
+	}
+	host, scType := hostOffset(65536)
+	assert.Equal(t, host1, host)
+	assert.Equal(t, QCow2SubclusterType(QCOW2_SUBCLUSTER_ZERO_ALLOC), scType)
+	//the file is still told about them, once their l2 entries are updated
+	assert.Equal(t, 0, s.Discards.Len())
+	for _, host := range []uint64{host1, host2} {
+		var pnum uint64
+		ret, err := bdrv_block_status(bs.current.bs, true, host, 65536, &pnum, nil, nil)
+		assert.Nil(t, err)
+		if ret&BDRV_BLOCK_DATA > 0 && host == host1 {
+			t.Log("the file system of /tmp doesn't report holes")
+			break
+		}
+		assert.Equal(t, uint64(BDRV_BLOCK_ZERO), ret&(BDRV_BLOCK_DATA|BDRV_BLOCK_ZERO))
+	}
+
+	//and are written in place again
+	_, err = Blk_Pwrite(root, 65536, data[:65536], 65536, 0)
+	assert.Nil(t, err)
+	host, scType = hostOffset(65536)
+	assert.Equal(t, host1, host)
+	assert.Equal(t, QCow2SubclusterType(QCOW2_SUBCLUSTER_NORMAL), scType)
+	length, err := Blk_Getlength(bs.current)
+	assert.Nil(t, err)
+	assert.Equal(t, fileLength, length)
+	Blk_Close(root)
+
+	//a version 2 image has no zero clusters to keep them as
+	err = Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 1048576, OPT_COMPAT: "0.10"})
+	assert.Nil(t, err)
+	_, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_DISCARD_NO_UNREF: true}, BDRV_O_RDWR)
+	assert.NotNil(t, err)
+	os.Remove(filename)
+}
+
+func Test_qcow2_discard_policies(t *testing.T) {
+	var filename = "/tmp/qcow2_discard_policies.qcow2"
+	os.Remove(filename)
+
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 1048576})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2",
+		OPT_DISCARD_REQUEST: false, OPT_DISCARD_OTHER: true}, BDRV_O_RDWR|BDRV_O_UNMAP)
+	assert.Nil(t, err)
+	bs := root.bs
+	s := bs.opaque.(*BDRVQcow2State)
+	assert.False(t, s.DiscardPassthrough[QCOW2_DISCARD_REQUEST])
+	assert.False(t, s.DiscardPassthrough[QCOW2_DISCARD_SNAPSHOT])
+	assert.True(t, s.DiscardPassthrough[QCOW2_DISCARD_OTHER])
+
+	s.Qlock()
+	offset, err := qcow2_alloc_clusters(bs, 6*65536)
+	assert.Nil(t, err)
+	//batched, only the discards of the types passed through are queued
+	s.CacheDiscards = true
+	qcow2_free_clusters(bs, offset, 65536, QCOW2_DISCARD_OTHER)
+	qcow2_free_clusters(bs, offset+2*65536, 65536, QCOW2_DISCARD_REQUEST)
+	qcow2_free_clusters(bs, offset+4*65536, 65536, QCOW2_DISCARD_OTHER)
+	assert.Equal(t, 2, s.Discards.Len())
+	s.CacheDiscards = false
+	qcow2_process_discards(bs, nil)
+	assert.Equal(t, 0, s.Discards.Len())
+
+	//otherwise they are processed right away
+	qcow2_free_clusters(bs, offset+65536, 65536, QCOW2_DISCARD_OTHER)
+	assert.Equal(t, 0, s.Discards.Len())
+	s.Qunlock()
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_qcow2_cow_copy_range(t *testing.T) {
+	var basefile = "/tmp/qcow2_cow_copy_range.raw"
+	var filename = "/tmp/qcow2_cow_copy_range.qcow2"
+	const size = 1024 * 1024
+	os.Remove(basefile)
+	os.Remove(filename)
+
+	err := Blk_Create(basefile, map[string]any{OPT_FMT: "raw", OPT_SIZE: size})
+	assert.Nil(t, err)
+	base, err := Blk_Open(basefile, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	_, err = Blk_Pwrite(base, 0, data, size, 0)
+	assert.Nil(t, err)
+	Blk_Close(base)
+
+	err = Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: size})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	err = Blk_Amend(root, map[string]any{OPT_BACKING: basefile, OPT_BACKING_FMT: "raw"})
+	assert.Nil(t, err)
+	Blk_Close(root)
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+
+	//the head and tail of the clusters written come from the backing file
+	newData := bytes.Repeat([]byte{0xee}, 8192)
+	_, err = Blk_Pwrite(root, 65536+4096, newData, 8192, 0)
+	assert.Nil(t, err)
+	copy(data[65536+4096:], newData)
+	_, err = Blk_Pwrite(root, 3*65536-4096, newData, 8192, 0)
+	assert.Nil(t, err)
+	copy(data[3*65536-4096:], newData)
+	//and of a zeroed cluster read as zeroes
+	_, err = Blk_Pwrite_Zeroes(root, 5*65536, 65536, 0)
+	assert.Nil(t, err)
+	copy(data[5*65536:], make([]byte, 65536))
+	_, err = Blk_Pwrite(root, 5*65536+512, newData, 1024, 0)
+	assert.Nil(t, err)
+	copy(data[5*65536+512:], newData[:1024])
+
+	//only the data of the files is copied within the file system, the
+	//zeroes are written from memory
+	_, err = Blk_Pwrite_Zeroes(root, 8*65536, 65536, 0)
+	assert.Nil(t, err)
+	copy(data[8*65536:], make([]byte, 65536))
+	s := root.bs.opaque.(*BDRVQcow2State)
+	s.Qlock()
+	allocOffset, err := qcow2_alloc_clusters(root.bs, 65536)
+	s.Qunlock()
+	assert.Nil(t, err)
+	for offset, expected := range map[uint64]error{7 * 65536: nil, 8 * 65536: ERR_ENOTSUP} {
+		m := &QCowL2Meta{Offset: offset, AllocOffset: allocOffset, NbClusters: 1,
+			CowStart: Qcow2COWRegion{Offset: 0, NbBytes: 4096}, CowEnd: Qcow2COWRegion{Offset: 65536}}
+		assert.Equal(t, expected, perform_cow_copy_range(root.bs, m), fmt.Sprintf("offset %d", offset))
+	}
+
+	buf := make([]byte, size)
+	_, err = Blk_Pread(root, 0, buf, size)
+	assert.Nil(t, err)
+	assert.Equal(t, data, buf)
+	Blk_Close(root)
+
+	//and so they read from the image alone
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	os.Remove(basefile)
+	for _, offset := range []uint64{65536, 2 * 65536, 3 * 65536, 5 * 65536} {
+		_, err = Blk_Pread(root, offset, buf[:65536], 65536)
+		assert.Nil(t, err)
+		assert.Equal(t, data[offset:offset+65536], buf[:65536])
+	}
+	Blk_Close(root)
+	os.Remove(filename)
+}
@@ -23,6 +23,8 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"syscall"
+	"unsafe"
 )
 
 func newRawDriver() *BlockDriver {
@@ -39,8 +41,10 @@ func newRawDriver() *BlockDriver {
 		bdrv_pwritev:         raw_pwritev,
 		bdrv_block_status:    raw_block_status,
 		bdrv_pwrite_zeroes:   raw_pwrite_zeroes,
+		bdrv_pdiscard:        raw_pdiscard,
 		bdrv_copy_range_from: raw_copy_range_from,
 		bdrv_copy_range_to:   raw_copy_range_to,
+		bdrv_measure:         raw_measure,
 	}
 }
 
@@ -54,7 +58,7 @@ func openflag2PosixFlag(flag int) int {
 		posixFlag |= os.O_RDWR
 	}
 	if (flag & BDRV_O_NOCACHE) > 0 {
-		posixFlag |= os.O_SYNC
+		posixFlag |= O_DIRECT
 	}
 	return posixFlag
 }
@@ -73,13 +77,24 @@ func raw_create(filename string, options map[string]any) error {
 		return fmt.Errorf("failed to open %s, err: %v", filename, err)
 	}
 	defer file.Close()
+
+	//a sparse file of the given size
+	if val, ok := options[OPT_SIZE]; ok {
+		if err = file.Truncate(int64(interface2uint64(val))); err != nil {
+			return fmt.Errorf("failed to truncate %s, err: %v", filename, err)
+		}
+	}
 	return nil
 }
 
 func raw_open(filename string, options map[string]any, flags int) (*BlockDriverState, error) {
 
 	var file *os.File
+	var ring *LuringState
 	var err error
+	var supportedWriteFlags, supportedZeroFlags uint64
+	align := uint32(DEFAULT_ALIGNMENT)
+	bufAlign := uint64(0)
 
 	//check file name
 	if filename == "" {
@@ -90,18 +105,34 @@ func raw_open(filename string, options map[string]any, flags int) (*BlockDriverS
 	if file, err = os.OpenFile(filename, openflag2PosixFlag(flags), os.FileMode(0777)); err != nil {
 		return nil, fmt.Errorf("failed to open %s, err: %v", filename, err)
 	}
+	//without io_uring, e.g. forbidden by seccomp, the synchronous path is used
+	if flags&BDRV_O_IO_URING > 0 {
+		ring, _ = luring_init(LURING_QUEUE_DEPTH)
+	}
+	if flags&BDRV_O_RDWR > 0 {
+		supportedWriteFlags = BDRV_REQ_FUA
+		supportedZeroFlags = BDRV_REQ_MAY_UNMAP
+	}
+	if flags&BDRV_O_NOCACHE > 0 && O_DIRECT != 0 {
+		align = DIRECT_IO_ALIGNMENT
+		bufAlign = DIRECT_IO_ALIGNMENT
+	}
 
 	//initiate the BlockDriverState struct
 	bs := &BlockDriverState{
 		filename: filename,
 		opaque: &BDRVRawState{
-			File: file,
+			File:      file,
+			Ring:      ring,
+			OpenFlags: flags,
+			BufAlign:  bufAlign,
 		},
 		current:             nil,
 		backing:             nil,
 		options:             make(map[string]any),
-		SupportedWriteFlags: 0,
-		RequestAlignment:    DEFAULT_ALIGNMENT,
+		SupportedWriteFlags: supportedWriteFlags,
+		SupportedZeroFlags:  supportedZeroFlags,
+		RequestAlignment:    align,
 		MaxTransfer:         DEFAULT_MAX_TRANSFER,
 		OpenFlags:           flags,
 	}
@@ -114,6 +145,10 @@ func raw_close(bs *BlockDriverState) {
 	if s == nil || s.File == nil {
 		return
 	}
+	luring_cleanup(s.Ring)
+	if s.DsyncFile != nil {
+		s.DsyncFile.Close()
+	}
 	s.File.Close()
 }
 
@@ -152,8 +187,16 @@ func raw_preadv_part(bs *BlockDriverState, offset uint64, bytes uint64,
 	}
 
 	//call physical read for the qiov buffer
-	ctx := context.Background()
-	_, err = preadv(ctx, s.File, qiov.iov, qiov.niov, offset)
+	if s.BufAlign > 1 && !qemu_iovec_is_aligned(qiov, s.BufAlign) {
+		//O_DIRECT can't read into the buffers of the caller
+		bounce := qemu_memalign(s.BufAlign, bytes)
+		iov := []iovec{{iov_base: unsafe.Pointer(&bounce[0]), iov_len: bytes}}
+		if err = raw_do_preadv(s, iov, 1, offset); err == nil {
+			qemu_iovec_from_buf(qiov, 0, unsafe.Pointer(&bounce[0]), bytes)
+		}
+	} else {
+		err = raw_do_preadv(s, qiov.iov, qiov.niov, offset)
+	}
 	if qiov == &localQiov {
 		qemu_iovec_destroy(&localQiov)
 	}
@@ -180,41 +223,281 @@ func raw_pwritev_part(bs *BlockDriverState, offset uint64, bytes uint64,
 		qiov = &localQiov
 	}
 
-	//call physical read for the qiov buffer
-	ctx := context.Background()
-	_, err = pwritev(ctx, s.File, qiov.iov, qiov.niov, offset)
+	//call physical write for the qiov buffer
+	if s.BufAlign > 1 && !qemu_iovec_is_aligned(qiov, s.BufAlign) {
+		//O_DIRECT can't write from the buffers of the caller
+		bounce := qemu_memalign(s.BufAlign, bytes)
+		qemu_iovec_to_buf(qiov, 0, unsafe.Pointer(&bounce[0]), bytes)
+		iov := []iovec{{iov_base: unsafe.Pointer(&bounce[0]), iov_len: bytes}}
+		err = raw_do_pwritev(s, iov, 1, offset, flags)
+	} else {
+		err = raw_do_pwritev(s, qiov.iov, qiov.niov, offset, flags)
+	}
 	if qiov == &localQiov {
 		qemu_iovec_destroy(&localQiov)
 	}
 	return err
 }
 
+func raw_do_preadv(s *BDRVRawState, iov []iovec, iovcnt int, offset uint64) error {
+	var err error
+	if s.Ring != nil {
+		_, err = luring_preadv(s.Ring, s.File, iov[:iovcnt], offset)
+	} else {
+		_, err = preadv(context.Background(), s.File, iov, iovcnt, offset)
+	}
+	return err
+}
+
+func raw_do_pwritev(s *BDRVRawState, iov []iovec, iovcnt int, offset uint64, flags BdrvRequestFlags) error {
+	var err error
+	if s.Ring != nil {
+		_, err = luring_pwritev(s.Ring, s.File, iov[:iovcnt], offset, flags&BDRV_REQ_FUA > 0)
+		return err
+	}
+	file := s.File
+	if flags&BDRV_REQ_FUA > 0 {
+		if file, err = raw_dsync_file(s); err != nil {
+			return err
+		}
+	}
+	_, err = pwritev(context.Background(), file, iov, iovcnt, offset)
+	return err
+}
+
+/*
+ * FUA writes go through a second descriptor opened with O_DSYNC, so that they
+ * don't have to flush everything else written to the file. It is only opened
+ * by the first FUA write, io_uring has RWF_DSYNC instead.
+ */
+func raw_dsync_file(s *BDRVRawState) (*os.File, error) {
+	s.dsyncOnce.Do(func() {
+		s.DsyncFile, s.dsyncErr = os.OpenFile(s.File.Name(),
+			openflag2PosixFlag(s.OpenFlags&^BDRV_O_CREATE)|syscall.O_DSYNC, os.FileMode(0777))
+	})
+	return s.DsyncFile, s.dsyncErr
+}
+
 func raw_flush_to_disk(bs *BlockDriverState) error {
 	s := bs.opaque.(*BDRVRawState)
+	if s.Ring != nil {
+		return luring_fsync(s.Ring, s.File, false)
+	}
 	return s.File.Sync()
 }
 
+/*
+ * find the extent of start: in data, *data is start and *hole where the
+ * data ends, in a hole, *hole is start and *data where the next data begins.
+ * ERR_ENXIO if start is in the trailing hole or past the end of the file.
+ */
+func find_allocation(s *BDRVRawState, start uint64, data *uint64, hole *uint64) error {
+
+	var offs uint64
+	var err error
+
+	if offs, err = file_seek(s.File, start, SEEK_DATA); err != nil {
+		return err
+	}
+	if offs < start {
+		return ERR_EIO
+	}
+	if offs > start {
+		//in a hole, the next data is at offs
+		*hole = start
+		*data = offs
+		return nil
+	}
+
+	//in data, it ends at the next hole, the end of the file at the latest
+	if offs, err = file_seek(s.File, start, SEEK_HOLE); err != nil {
+		return err
+	}
+	if offs < start {
+		return ERR_EIO
+	}
+	if offs > start {
+		*hole = offs
+		*data = start
+		return nil
+	}
+	//a hole has been dug since the first lseek
+	return ERR_EBUSY
+}
+
+// the data and the holes of the file, holes read as zeroes, everything is
+// reported as data unless the zeroes are wanted
 func raw_block_status(bs *BlockDriverState, wantZero bool, offset uint64,
 	bytes uint64, pnum *uint64, tmap *uint64, file **BlockDriverState) (uint64, error) {
-	fmt.Println("[raw_block_status] no implementation")
-	return 0, nil
+
+	s := bs.opaque.(*BDRVRawState)
+	var data, hole, ret uint64
+
+	*tmap = offset
+	*file = bs
+	if !wantZero {
+		*pnum = bytes
+		return BDRV_BLOCK_DATA | BDRV_BLOCK_OFFSET_VALID, nil
+	}
+
+	err := find_allocation(s, offset, &data, &hole)
+	if err == ERR_ENXIO {
+		//the trailing hole
+		*pnum = bytes
+		ret = BDRV_BLOCK_ZERO
+	} else if err != nil {
+		//nothing is known, so pretend there are no holes
+		*pnum = bytes
+		ret = BDRV_BLOCK_DATA
+	} else if data == offset {
+		//a partial sector at the end of the file is data as a whole
+		*pnum = round_up(hole-offset, uint64(bs.RequestAlignment))
+		ret = BDRV_BLOCK_DATA
+	} else {
+		*pnum = data - offset
+		ret = BDRV_BLOCK_ZERO
+	}
+	return ret | BDRV_BLOCK_OFFSET_VALID, nil
+}
+
+func raw_do_fallocate(s *BDRVRawState, mode uint32, offset uint64, bytes uint64) error {
+	if s.Ring != nil {
+		return luring_fallocate(s.Ring, s.File, mode, offset, bytes)
+	}
+	return file_fallocate(s.File, mode, offset, bytes)
 }
 
+/*
+ * zero the range with fallocate(2), deallocating it if BDRV_REQ_MAY_UNMAP.
+ * ERR_ENOTSUP if the file system can't, the block layer writes a zeroed
+ * buffer instead.
+ */
 func raw_pwrite_zeroes(bs *BlockDriverState, offset uint64, bytes uint64, flags BdrvRequestFlags) error {
-	fmt.Println("[raw_pwrite_zeroes] no implementation")
-	return nil
+
+	s := bs.opaque.(*BDRVRawState)
+	var length uint64
+	var err error
+
+	if length, err = raw_getlength(bs); err != nil {
+		return err
+	}
+
+	//a hole reads as zeroes, but punching one doesn't grow the file
+	if flags&BDRV_REQ_MAY_UNMAP > 0 && offset+bytes <= length && !s.noPunchHole.Load() {
+		err = raw_do_fallocate(s, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, offset, bytes)
+		switch err {
+		case ERR_ENOTSUP:
+			s.noPunchHole.Store(true)
+		case ERR_EINVAL, ERR_EBUSY:
+		default:
+			return err
+		}
+	}
+
+	if !s.noZeroRange.Load() {
+		err = raw_do_fallocate(s, FALLOC_FL_ZERO_RANGE, offset, bytes)
+		if err == ERR_ENOTSUP {
+			s.noZeroRange.Store(true)
+		} else if err != ERR_EINVAL {
+			return err
+		}
+	}
+
+	//a hole allocated again reads as zeroes as well
+	if offset+bytes <= length && !s.noPunchHole.Load() && !s.noFallocate.Load() {
+		err = raw_do_fallocate(s, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, offset, bytes)
+		if err == nil {
+			if err = raw_do_fallocate(s, 0, offset, bytes); err != ERR_ENOTSUP {
+				return err
+			}
+			s.noFallocate.Store(true)
+		} else if err == ERR_ENOTSUP {
+			s.noPunchHole.Store(true)
+		} else if err != ERR_EINVAL {
+			return err
+		}
+	}
+
+	//so is the space allocated past the end of the file
+	if offset >= length && !s.noFallocate.Load() {
+		if err = raw_do_fallocate(s, 0, offset, bytes); err != ERR_ENOTSUP {
+			return err
+		}
+		s.noFallocate.Store(true)
+	}
+	return ERR_ENOTSUP
 }
 
+// deallocate the range, which reads as zeroes afterwards
+func raw_pdiscard(bs *BlockDriverState, offset uint64, bytes uint64) error {
+
+	s := bs.opaque.(*BDRVRawState)
+	if s.noPunchHole.Load() {
+		return ERR_ENOTSUP
+	}
+	err := raw_do_fallocate(s, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, offset, bytes)
+	if err == ERR_ENOTSUP {
+		s.noPunchHole.Store(true)
+	}
+	return err
+}
+
+// the data is where it's read from, the target decides how it's copied
 func raw_copy_range_from(bs *BlockDriverState, src *BdrvChild, offset uint64,
 	dst *BdrvChild, dstOffset uint64, bytes uint64,
 	readFlags BdrvRequestFlags, writeFlags BdrvRequestFlags) error {
-	fmt.Println("[raw_copy_range_from] no implementation")
-	return nil
+	return bdrv_copy_range_to(src, offset, dst, dstOffset, bytes, readFlags, writeFlags)
 }
 
+// copy_file_range(2) between two raw files
 func raw_copy_range_to(bs *BlockDriverState, src *BdrvChild, offset uint64,
 	dst *BdrvChild, dstOffset uint64, bytes uint64,
 	readFlags BdrvRequestFlags, writeFlags BdrvRequestFlags) error {
-	fmt.Println("[raw_copy_range_to] no implementation")
+
+	s := bs.opaque.(*BDRVRawState)
+	srcState, ok := src.bs.opaque.(*BDRVRawState)
+	if !ok {
+		return ERR_ENOTSUP
+	}
+	if err := file_copy_range(srcState.File, offset, s.File, dstOffset, bytes); err != nil {
+		return err
+	}
+	if writeFlags&BDRV_REQ_FUA > 0 {
+		return raw_flush_to_disk(bs)
+	}
 	return nil
 }
+
+// a raw image needs the space of the data, at most its virtual size
+func raw_measure(options map[string]any, in *BlockDriverState) (*BlockMeasureInfo, error) {
+
+	var err error
+	var size, required, offset, pnum, ret uint64
+
+	if val, ok := options[OPT_SIZE]; ok {
+		size = interface2uint64(val)
+	} else if in != nil {
+		if size, err = bdrv_getlength(in); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, Err_IncompleteParameters
+	}
+	if in == nil {
+		return &BlockMeasureInfo{Required: size, FullyAllocated: size}, nil
+	}
+
+	for offset = 0; offset < size; offset += pnum {
+		if ret, err = bdrv_block_status_above(in, nil, offset, size-offset,
+			&pnum, nil, nil); err != nil {
+			return nil, err
+		}
+		if pnum == 0 {
+			break
+		}
+		if ret&BDRV_BLOCK_ZERO == 0 && ret&BDRV_BLOCK_DATA > 0 {
+			required += pnum
+		}
+	}
+	return &BlockMeasureInfo{Required: required, FullyAllocated: size}, nil
+}
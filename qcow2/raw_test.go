@@ -1,7 +1,9 @@
 package qcow2
 
 import (
+	"bytes"
 	"os"
+	"sync"
 	"testing"
 	"unsafe"
 
@@ -70,6 +72,213 @@ func Test_raw_write_read(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "this is a test", string(bufOut))
 
+	//the first FUA write opens the O_DSYNC descriptor
+	s := bs.opaque.(*BDRVRawState)
+	assert.Nil(t, s.DsyncFile)
+	err = raw_pwritev_part(bs, 4096, bytes, &qiov, 0, BDRV_REQ_FUA)
+	assert.Nil(t, err)
+	assert.NotNil(t, s.DsyncFile)
+	err = raw_preadv_part(bs, 4096, bytes, &qiovOut, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "this is a test", string(bufOut))
+
+	raw_close(bs)
+	os.Remove(filename)
+}
+
+func Test_raw_io_uring(t *testing.T) {
+	const workers = 8
+	const chunk = 256 * 1024
+	var filename = "/tmp/raw_io_uring.img"
+	os.Remove(filename)
+	err := raw_create(filename, map[string]any{OPT_SIZE: workers * chunk})
+	assert.Nil(t, err)
+
+	bs, err := raw_open(filename, nil, BDRV_O_RDWR|BDRV_O_IO_URING)
+	assert.Nil(t, err)
+	s := bs.opaque.(*BDRVRawState)
+	if s.Ring == nil {
+		raw_close(bs)
+		t.Skip("io_uring is not available")
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			wbuf := bytes.Repeat([]byte{byte(i + 1)}, chunk)
+			rbuf := make([]byte, chunk)
+			var qiov QEMUIOVector
+			//several iovecs batched in one submission
+			qemu_iovec_init(&qiov, 4)
+			for j := 0; j < 4; j++ {
+				qemu_iovec_add(&qiov, unsafe.Pointer(&wbuf[j*chunk/4]), chunk/4)
+			}
+			if errs[i] = raw_pwritev(bs, uint64(i*chunk), chunk, &qiov, 0); errs[i] != nil {
+				return
+			}
+			qemu_iovec_init_buf(&qiov, unsafe.Pointer(&rbuf[0]), chunk)
+			if errs[i] = raw_preadv(bs, uint64(i*chunk), chunk, &qiov, 0); errs[i] != nil {
+				return
+			}
+			if !bytes.Equal(wbuf, rbuf) {
+				errs[i] = ERR_EIO
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < workers; i++ {
+		assert.Nil(t, errs[i])
+	}
+	assert.Nil(t, raw_flush_to_disk(bs))
+
+	//grow the file through the ring
+	err = luring_fallocate(s.Ring, s.File, 0, workers*chunk, chunk)
+	assert.Nil(t, err)
+	size, err := raw_getlength(bs)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64((workers+1)*chunk), size)
 	raw_close(bs)
 	os.Remove(filename)
 }
+
+func Test_raw_block_status(t *testing.T) {
+	var filename = "/tmp/raw_block_status.raw"
+	const size = 16 * 1024 * 1024
+	os.Remove(filename)
+
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "raw", OPT_SIZE: size})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	data := bytes.Repeat([]byte{0x5a}, 65536)
+	_, err = Blk_Pwrite(root, 0, data, 65536, 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(root, 8*1024*1024, data, 4096, 0)
+	assert.Nil(t, err)
+
+	var pnum uint64
+	//without the zeroes wanted, everything is data
+	ret, err := bdrv_block_status(root.bs, false, 65536, size, &pnum, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(BDRV_BLOCK_DATA), ret&(BDRV_BLOCK_DATA|BDRV_BLOCK_ZERO))
+	assert.Equal(t, uint64(size-65536), pnum)
+
+	ret, err = bdrv_block_status(root.bs, true, 65536, size, &pnum, nil, nil)
+	assert.Nil(t, err)
+	if ret&BDRV_BLOCK_ZERO == 0 {
+		t.Skip("the file system of /tmp doesn't report holes")
+	}
+	assert.Equal(t, uint64(8*1024*1024-65536), pnum)
+
+	ret, err = bdrv_block_status(root.bs, true, 0, size, &pnum, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(BDRV_BLOCK_DATA), ret&(BDRV_BLOCK_DATA|BDRV_BLOCK_ZERO))
+	assert.Equal(t, uint64(65536), pnum)
+
+	ret, err = bdrv_block_status(root.bs, true, 8*1024*1024, size, &pnum, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(BDRV_BLOCK_DATA), ret&(BDRV_BLOCK_DATA|BDRV_BLOCK_ZERO))
+	assert.Equal(t, uint64(4096), pnum)
+
+	//the trailing hole
+	ret, err = bdrv_block_status(root.bs, true, 8*1024*1024+4096, size, &pnum, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(BDRV_BLOCK_ZERO|BDRV_BLOCK_EOF), ret&(BDRV_BLOCK_DATA|BDRV_BLOCK_ZERO|BDRV_BLOCK_EOF))
+	assert.Equal(t, uint64(size-8*1024*1024-4096), pnum)
+
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_raw_pwrite_zeroes_discard(t *testing.T) {
+	var filename = "/tmp/raw_zeroes.raw"
+	const size = 4 * 1024 * 1024
+	os.Remove(filename)
+
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "raw", OPT_SIZE: size})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR|BDRV_O_UNMAP)
+	assert.Nil(t, err)
+	data := bytes.Repeat([]byte{0x5a}, size)
+	_, err = Blk_Pwrite(root, 0, data, size, 0)
+	assert.Nil(t, err)
+
+	//zeroed in place, then punched out and discarded
+	_, err = Blk_Pwrite_Zeroes(root, 65536, 65536, 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite_Zeroes(root, 1024*1024, 1024*1024, BDRV_REQ_MAY_UNMAP)
+	assert.Nil(t, err)
+	err = Blk_Discard(root, 3*1024*1024, 65536)
+	assert.Nil(t, err)
+	copy(data[65536:], make([]byte, 65536))
+	copy(data[1024*1024:], make([]byte, 1024*1024))
+	copy(data[3*1024*1024:], make([]byte, 65536))
+
+	buf := make([]byte, size)
+	_, err = Blk_Pread(root, 0, buf, size)
+	assert.Nil(t, err)
+	assert.Equal(t, data, buf)
+	length, err := raw_getlength(root.bs)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(size), length)
+
+	var pnum uint64
+	ret, err := bdrv_block_status(root.bs, true, 1024*1024, size, &pnum, nil, nil)
+	assert.Nil(t, err)
+	if ret&BDRV_BLOCK_DATA > 0 {
+		t.Skip("the file system of /tmp doesn't punch holes")
+	}
+	assert.Equal(t, uint64(BDRV_BLOCK_ZERO), ret&(BDRV_BLOCK_DATA|BDRV_BLOCK_ZERO))
+	assert.Equal(t, uint64(1024*1024), pnum)
+	ret, err = bdrv_block_status(root.bs, true, 3*1024*1024, size, &pnum, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(BDRV_BLOCK_ZERO), ret&(BDRV_BLOCK_DATA|BDRV_BLOCK_ZERO))
+	assert.Equal(t, uint64(65536), pnum)
+
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_raw_copy_range(t *testing.T) {
+	var srcfile = "/tmp/raw_copy_range_src.raw"
+	var dstfile = "/tmp/raw_copy_range_dst.raw"
+	const size = 1024 * 1024
+	os.Remove(srcfile)
+	os.Remove(dstfile)
+
+	err := Blk_Create(srcfile, map[string]any{OPT_FMT: "raw", OPT_SIZE: size})
+	assert.Nil(t, err)
+	err = Blk_Create(dstfile, map[string]any{OPT_FMT: "raw", OPT_SIZE: size})
+	assert.Nil(t, err)
+	src, err := Blk_Open(srcfile, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	dst, err := Blk_Open(dstfile, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	_, err = Blk_Pwrite(src, 0, data, size, 0)
+	assert.Nil(t, err)
+
+	//a range of the target that isn't aligned is left to the caller
+	err = Blk_Copy_Range(src, 0, dst, 100, 4096)
+	assert.Equal(t, ERR_ENOTSUP, err)
+
+	err = Blk_Copy_Range(src, 4096, dst, 65536, 128*1024)
+	if err == ERR_ENOTSUP {
+		t.Skip("copy_file_range isn't supported by the file system of /tmp")
+	}
+	assert.Nil(t, err)
+	buf := make([]byte, size)
+	_, err = Blk_Pread(dst, 0, buf, size)
+	assert.Nil(t, err)
+	assert.True(t, buffer_is_zero(buf, 65536))
+	assert.Equal(t, data[4096:4096+128*1024], buf[65536:65536+128*1024])
+	assert.True(t, buffer_is_zero(buf[65536+128*1024:], size-65536-128*1024))
+
+	Blk_Close(src)
+	Blk_Close(dst)
+	os.Remove(srcfile)
+	os.Remove(dstfile)
+}
@@ -0,0 +1,173 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"os"
+)
+
+// one external snapshot inside a group transaction
+type ExternalSnapshotState struct {
+	child    *BdrvChild
+	old      *BlockDriverState
+	new      *BlockDriverState
+	overlay  string
+	created  bool
+	prepared bool
+}
+
+/*
+ * Take an external snapshot of every child as one transaction.
+ * All the images are drained first, so that no request is in flight while the
+ * overlays are created, which makes the snapshots crash-consistent across
+ * the group. overlays[i] becomes the active layer of children[i] and is
+ * backed by the image children[i] pointed to before.
+ * If any of the overlays can not be created, all the images are left as they
+ * were and the overlays created so far are removed.
+ */
+func Blk_Snapshot_Group(children []*BdrvChild, overlays []string, options map[string]any) error {
+
+	var err error
+	var states []*ExternalSnapshotState
+	var drained []*BlockDriverState
+
+	if len(children) == 0 || len(children) != len(overlays) {
+		return Err_IncompleteParameters
+	}
+	for i, child := range children {
+		if child == nil || child.GetBS() == nil {
+			return Err_NullObject
+		}
+		states = append(states, &ExternalSnapshotState{
+			child:   child,
+			old:     child.GetBS(),
+			overlay: overlays[i],
+		})
+	}
+
+	//quiesce the whole group before touching any of them
+	for _, state := range states {
+		bdrv_drained_begin(state.old)
+		drained = append(drained, state.old)
+	}
+
+	for _, state := range states {
+		if err = external_snapshot_prepare(state, options); err != nil {
+			goto abort
+		}
+	}
+	for _, state := range states {
+		external_snapshot_commit(state)
+	}
+	goto out
+
+abort:
+	for _, state := range states {
+		external_snapshot_abort(state)
+	}
+out:
+	for _, bs := range drained {
+		bdrv_drained_end(bs)
+	}
+	return err
+}
+
+func external_snapshot_prepare(state *ExternalSnapshotState, options map[string]any) error {
+
+	var err error
+	var size uint64
+	var child *BdrvChild
+	bs := state.old
+
+	//the backing file of a qcow2 image is always opened as qcow2
+	if bs.Drv == nil || bs.Drv.FormatName != TYPE_QCOW2_NAME {
+		return ERR_ENOTSUP
+	}
+	if _, err = os.Stat(state.overlay); err == nil {
+		return ERR_EEXIST
+	}
+	for _, other := range []string{bs.filename, bs.backingFile} {
+		if other == state.overlay {
+			return ERR_EINVAL
+		}
+	}
+
+	//everything written so far must be part of the snapshot
+	if err = bdrv_flush(bs); err != nil {
+		return err
+	}
+	if size, err = bdrv_getlength(bs); err != nil {
+		return err
+	}
+
+	createOpts := make(map[string]any)
+	for k, v := range options {
+		createOpts[k] = v
+	}
+	createOpts[OPT_FMT] = TYPE_QCOW2_NAME
+	createOpts[OPT_SIZE] = size
+	createOpts[OPT_BACKING] = bs.filename
+	createOpts[OPT_FILENAME] = state.overlay
+	if _, ok := createOpts[OPT_SUBCLUSTER]; !ok {
+		createOpts[OPT_SUBCLUSTER] = has_subclusters(bs.opaque.(*BDRVQcow2State))
+	}
+	if err = bdrv_create(state.overlay, createOpts); err != nil {
+		//remove whatever has been left behind
+		os.Remove(state.overlay)
+		return err
+	}
+	state.created = true
+
+	//the old image is linked as backing on commit, instead of being opened twice
+	if child, err = bdrv_open_child(state.overlay, TYPE_QCOW2_NAME, createOpts,
+		bs.OpenFlags|BDRV_O_NO_BACKING); err != nil {
+		return err
+	}
+	state.new = child.bs
+	state.new.OpenFlags &^= BDRV_O_NO_BACKING
+	state.prepared = true
+	return nil
+}
+
+func external_snapshot_commit(state *ExternalSnapshotState) {
+
+	backing := &BdrvChild{bs: state.old}
+	bdrv_set_perm(backing, PERM_READABLE)
+	bdrv_link_backing(state.new, backing, state.new.backingFile)
+	//the options of the block layer go on with the new top image
+	state.new.DetectZeroes = state.old.DetectZeroes
+
+	state.old.drainLock.Lock()
+	state.child.SetBS(state.new)
+	state.old.drainLock.Unlock()
+}
+
+func external_snapshot_abort(state *ExternalSnapshotState) {
+
+	if state.prepared {
+		bdrv_close(state.new)
+		state.new = nil
+		state.prepared = false
+	}
+	if state.created {
+		os.Remove(state.overlay)
+		state.created = false
+	}
+}
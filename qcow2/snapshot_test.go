@@ -0,0 +1,217 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func prepare_snapshot_image(t *testing.T, filename string, content string) *BdrvChild {
+	os.Remove(filename)
+	var create_opts = map[string]any{
+		OPT_SIZE:       1048576,
+		OPT_FILENAME:   filename,
+		OPT_FMT:        "qcow2",
+		OPT_SUBCLUSTER: true,
+	}
+	var open_opts = map[string]any{
+		OPT_FILENAME: filename,
+		OPT_FMT:      "qcow2",
+	}
+	err := Blk_Create(filename, create_opts)
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, open_opts, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(root, 0, []byte(content), uint64(len(content)), 0)
+	assert.Nil(t, err)
+	return root
+}
+
+func Test_snapshot_group(t *testing.T) {
+	var files = []string{"/tmp/disk1.qcow2", "/tmp/disk2.qcow2"}
+	var overlays = []string{"/tmp/disk1.snap.qcow2", "/tmp/disk2.snap.qcow2"}
+	var roots []*BdrvChild
+	for i, filename := range files {
+		os.Remove(overlays[i])
+		roots = append(roots, prepare_snapshot_image(t, filename, "before snapshot"))
+	}
+
+	err := Blk_Snapshot_Group(roots, overlays, nil)
+	assert.Nil(t, err)
+
+	for i, root := range roots {
+		assert.Equal(t, overlays[i], root.bs.filename)
+		assert.NotNil(t, root.bs.backing)
+		assert.Equal(t, files[i], root.bs.backing.bs.filename)
+
+		//old data is visible through the backing file
+		buf := make([]byte, 15)
+		_, err = Blk_Pread(root, 0, buf, 15)
+		assert.Nil(t, err)
+		assert.Equal(t, "before snapshot", string(buf))
+
+		_, err = Blk_Pwrite(root, 0, []byte("beyond"), 6, 0)
+		assert.Nil(t, err)
+		Blk_Close(root)
+	}
+
+	//the snapshots keep the old content
+	for i, filename := range files {
+		base, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, 0)
+		assert.Nil(t, err)
+		buf := make([]byte, 15)
+		_, err = Blk_Pread(base, 0, buf, 15)
+		assert.Nil(t, err)
+		assert.Equal(t, "before snapshot", string(buf))
+		Blk_Close(base)
+
+		top, err := Blk_Open(overlays[i], map[string]any{OPT_FMT: "qcow2"}, 0)
+		assert.Nil(t, err)
+		_, err = Blk_Pread(top, 0, buf, 15)
+		assert.Nil(t, err)
+		assert.Equal(t, "beyond snapshot", string(buf))
+		Blk_Close(top)
+
+		os.Remove(filename)
+		os.Remove(overlays[i])
+	}
+}
+
+func Test_snapshot_group_detect_zeroes(t *testing.T) {
+	var filename = "/tmp/disk_detect_zeroes.qcow2"
+	var overlay = "/tmp/disk_detect_zeroes.snap.qcow2"
+	os.Remove(filename)
+	os.Remove(overlay)
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 1048576})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_DETECT_ZEROES: "on"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	data := bytes.Repeat([]byte{0x5a}, 65536)
+	_, err = Blk_Pwrite(root, 0, data, 65536, 0)
+	assert.Nil(t, err)
+
+	err = Blk_Snapshot_Group([]*BdrvChild{root}, []string{overlay}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, BDRV_DETECT_ZEROES_ON, root.bs.DetectZeroes)
+
+	//the zeroed cluster of the overlay is a zero cluster, not data
+	_, err = Blk_Pwrite(root, 0, make([]byte, 65536), 65536, 0)
+	assert.Nil(t, err)
+	var bytes uint32 = 65536
+	var host uint64
+	var scType QCow2SubclusterType
+	err = qcow2_get_host_offset(root.bs, 0, &bytes, &host, &scType)
+	assert.Nil(t, err)
+	assert.Equal(t, QCow2SubclusterType(QCOW2_SUBCLUSTER_ZERO_PLAIN), scType)
+	Blk_Close(root)
+	os.Remove(filename)
+	os.Remove(overlay)
+}
+
+func Test_snapshot_group_rollback(t *testing.T) {
+	var files = []string{"/tmp/disk1.qcow2", "/tmp/disk2.qcow2"}
+	var overlays = []string{"/tmp/disk1.snap.qcow2", "/tmp/disk2.snap.qcow2"}
+	var roots []*BdrvChild
+	for i, filename := range files {
+		os.Remove(overlays[i])
+		roots = append(roots, prepare_snapshot_image(t, filename, "before snapshot"))
+	}
+	//the second overlay can't be created
+	err := os.WriteFile(overlays[1], []byte("in the way"), 0644)
+	assert.Nil(t, err)
+
+	err = Blk_Snapshot_Group(roots, overlays, nil)
+	assert.Equal(t, ERR_EEXIST, err)
+
+	//the first overlay is gone and nothing changed on either image
+	_, err = os.Stat(overlays[0])
+	assert.True(t, os.IsNotExist(err))
+	for i, root := range roots {
+		assert.Equal(t, files[i], root.bs.filename)
+		assert.Nil(t, root.bs.backing)
+		assert.Equal(t, int32(0), root.bs.QuiesceCounter)
+
+		//I/O goes on against the original image
+		_, err = Blk_Pwrite(root, 0, []byte("beyond"), 6, 0)
+		assert.Nil(t, err)
+		buf := make([]byte, 15)
+		_, err = Blk_Pread(root, 0, buf, 15)
+		assert.Nil(t, err)
+		assert.Equal(t, "beyond snapshot", string(buf))
+		Blk_Close(root)
+		os.Remove(files[i])
+		os.Remove(overlays[i])
+	}
+}
+
+func Test_snapshot_group_backing_member(t *testing.T) {
+	var basefile = "/tmp/disk_base.qcow2"
+	var filename = "/tmp/disk_top.qcow2"
+	var overlays = []string{"/tmp/disk_base.snap.qcow2", "/tmp/disk_top.snap.qcow2"}
+	for _, overlay := range overlays {
+		os.Remove(overlay)
+	}
+	base := prepare_snapshot_image(t, basefile, "from the base")
+	Blk_Close(base)
+	os.Remove(filename)
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 1048576, OPT_BACKING: basefile})
+	assert.Nil(t, err)
+	top, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	//the image backing the top one is a member of the group as well
+	base = &BdrvChild{perm: PERM_ALL}
+	base.SetBS(top.bs.backing.bs)
+
+	//reads of the top image go on to the backing one while both are drained
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 13)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_, err := Blk_Pread(top, 0, buf, 13)
+				assert.Nil(t, err)
+				assert.Equal(t, "from the base", string(buf))
+			}
+		}()
+	}
+	done := make(chan error)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		done <- Blk_Snapshot_Group([]*BdrvChild{base, top}, overlays, nil)
+	}()
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+	case <-time.After(30 * time.Second):
+		t.Fatal("the snapshot of the group didn't complete")
+	}
+	close(stop)
+	wg.Wait()
+
+	assert.Equal(t, overlays[0], base.GetBS().filename)
+	assert.Equal(t, overlays[1], top.GetBS().filename)
+	buf := make([]byte, 13)
+	_, err = Blk_Pread(top, 0, buf, 13)
+	assert.Nil(t, err)
+	assert.Equal(t, "from the base", string(buf))
+
+	//the old base is closed with the chain of the top image
+	base.GetBS().backing = nil
+	Blk_Close(base)
+	Blk_Close(top)
+	for _, f := range append(overlays, basefile, filename) {
+		os.Remove(f)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"encoding/json"
 	"os"
 	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -64,12 +65,31 @@ type BDRVRawState struct {
 	File      *os.File
 	OpenFlags int
 	BufAlign  uint64
+	//opened with O_DSYNC on the first FUA write
+	DsyncFile *os.File
+	dsyncOnce sync.Once
+	dsyncErr  error
+	//set with BDRV_O_IO_URING, nil for the synchronous path
+	Ring *LuringState
+	//set once the file system turns out to lack the fallocate modes
+	noZeroRange atomic.Bool
+	noPunchHole atomic.Bool
+	noFallocate atomic.Bool
 
 	/* The current permissions. */
 	Perm       uint64
 	SharedPerm uint64
 }
 
+// the background goroutine cleaning the caches and writing the dirty
+// metadata back, at the intervals in seconds, 0 disables either of them
+type Qcow2CacheTimer struct {
+	CleanInterval     uint64
+	WritebackInterval uint64
+	stop              chan struct{}
+	wg                sync.WaitGroup
+}
+
 // for qcow2 file state
 type BDRVQcow2State struct {
 	ClusterBits       uint32
@@ -79,6 +99,9 @@ type BDRVQcow2State struct {
 	L1Size            uint32
 	RefcountBlockBits uint32
 	RefcountBlockSize uint32
+	RefcountOrder     uint32
+	RefcountBits      uint32
+	RefcountMax       uint64
 
 	ClusterOffsetMask uint64
 	L1TableOffset     uint64
@@ -93,10 +116,11 @@ type BDRVQcow2State struct {
 
 	MaxRefcountTableIndex uint32
 	FreeClusterIndex      uint64
+	FreeMap               *Qcow2FreeMap
 	QcowVersion           int
 
 	FreeByteOffset uint64 //not used
-	Lock           *sync.Mutex
+	Lock           *sync.RWMutex
 	Flags          int //not used
 
 	L2SliceSize int
@@ -116,11 +140,23 @@ type BDRVQcow2State struct {
 
 	DataFile *BdrvChild
 
+	//header extensions
+	BackingFormat     string
+	UnknownHeaderExts []*Qcow2UnknownHeaderExt
+
 	CacheDiscards      bool
 	DiscardPassthrough [QCOW2_DISCARD_MAX]bool
-
-	AioTaskList    *SignalList
-	AioTaskRoutine AioTaskRoutineFunc
+	//the clusters discarded or zeroed by the guest keep their references
+	DiscardNoUnref bool
+
+	//nil runs every task in the goroutine of its request
+	AioWorkers *Qcow2WorkerPool
+	//nil if neither the cache cleaning nor the metadata writeback is enabled
+	CacheTimer *Qcow2CacheTimer
+	//the last failure of the metadata writeback, returned by the next flush
+	WritebackErr error
+	//nil unless the data-cache-size option is set
+	DataCache *Qcow2DataCache
 
 	/* The following fields are only valid for version >= 3 */
 	IncompatibleFeatures uint64
@@ -140,6 +176,19 @@ func (s *BDRVQcow2State) Qunlock() {
 	}
 }
 
+// shared for the lookups, which only modify the caches
+func (s *BDRVQcow2State) Qrlock() {
+	if s.Lock != nil {
+		s.Lock.RLock()
+	}
+}
+
+func (s *BDRVQcow2State) Qrunlock() {
+	if s.Lock != nil {
+		s.Lock.RUnlock()
+	}
+}
+
 type QCowL2Meta struct {
 	Offset          uint64
 	AllocOffset     uint64
@@ -155,6 +204,8 @@ type QCowL2Meta struct {
 	/** Pointer to next L2Meta of the same write request */
 	Next         *QCowL2Meta
 	NextInFlight *list.Element
+	//woken up when the allocation is no longer in flight
+	DependentRequests *sync.Cond
 }
 
 type Qcow2COWRegion struct {
@@ -208,8 +259,8 @@ type BdrvRequestPadding struct {
 	LocalQiov  QEMUIOVector
 }
 
-type Get_Refcount_Func func(refcountArray unsafe.Pointer, index uint64) uint16
-type Set_Refcount_Func func(refcountArray unsafe.Pointer, index uint64, value uint16)
+type Get_Refcount_Func func(refcountArray unsafe.Pointer, index uint64) uint64
+type Set_Refcount_Func func(refcountArray unsafe.Pointer, index uint64, value uint64)
 
 type BlockDriverState struct {
 	opaque      any
@@ -219,11 +270,18 @@ type BlockDriverState struct {
 	current     *BdrvChild
 	options     map[string]any
 	//static configuration
-	RequestAlignment  uint32
-	PdiscardAlignment uint32
-	MaxTransfer       uint32
+	RequestAlignment      uint32
+	PdiscardAlignment     uint32
+	PwriteZeroesAlignment uint32 //the granularity of zero writes, 0 if none
+	MaxTransfer           uint32
+	DetectZeroes          int
 	//statistic information
 	InFlight            uint64
+	QuiesceCounter      int32
+	drainLock           sync.Mutex
+	drainCond           *sync.Cond
+	reqsLock            sync.Mutex
+	trackedRequests     *list.List //writes in flight, for the serialising ones
 	SupportedWriteFlags uint64
 	SupportedReadFlags  uint64
 	SupportedZeroFlags  uint64
@@ -233,18 +291,39 @@ type BlockDriverState struct {
 	Drv                 *BlockDriver
 }
 
+type BdrvTrackedRequest struct {
+	bs     *BlockDriverState
+	offset uint64
+	bytes  uint64
+	//the aligned region a serialising request must have to itself
+	overlapOffset uint64
+	overlapBytes  uint64
+	serialising   bool
+	waitingFor    *BdrvTrackedRequest
+	waitQueue     *sync.Cond
+	elem          *list.Element
+}
+
 type BdrvChild struct {
 	name   string
 	bs     *BlockDriverState
 	perm   uint8
 	header *QCowHeader
+	//the node the child is linked to, nil for the images opened by the user
+	parent *BlockDriverState
+	//guards bs of the images opened by the user, a snapshot swaps it
+	lock sync.Mutex
 }
 
 func (child *BdrvChild) SetBS(bs *BlockDriverState) {
+	child.lock.Lock()
 	child.bs = bs
+	child.lock.Unlock()
 }
 
 func (child *BdrvChild) GetBS() *BlockDriverState {
+	child.lock.Lock()
+	defer child.lock.Unlock()
 	return child.bs
 }
 
@@ -305,11 +384,12 @@ func scanRefcountTable(bs *BlockDriverState, stat *BlockStatistic) {
 			if p, err = load_refcount_block(bs, refcountBlockOffset); err != nil {
 				return
 			} else {
-				for j := uint64(0); j < DEFAULT_CLUSTER_SIZE/2; j++ {
+				for j := uint64(0); j < uint64(s.RefcountBlockSize); j++ {
 					if s.get_refcount(p, j) > 0 {
 						stat.TotalBlocks++
 					}
 				}
+				qcow2_cache_put(s.RefcountBlockCache, p)
 			}
 			stat.RecountBlocks++
 		}
@@ -365,6 +445,7 @@ type Bdrv_Copy_Range_To_Func func(bs *BlockDriverState, src *BdrvChild, srcOffse
 	dst *BdrvChild, dstOffset uint64, bytes uint64,
 	readFlags BdrvRequestFlags, writeFlags BdrvRequestFlags) error
 type Bdrv_Pdiscard_Func func(bs *BlockDriverState, offset uint64, bytes uint64) error
+type Bdrv_Measure_Func func(options map[string]any, in *BlockDriverState) (*BlockMeasureInfo, error)
 
 type BlockDriver struct {
 	FormatName     string
@@ -388,6 +469,13 @@ type BlockDriver struct {
 	bdrv_copy_range_from Bdrv_Copy_Range_From_Func //for convert copy
 	bdrv_copy_range_to   Bdrv_Copy_Range_To_Func   //for convert copy
 	bdrv_pdiscard        Bdrv_Pdiscard_Func
+	bdrv_measure         Bdrv_Measure_Func
+}
+
+// the host space needed by an image
+type BlockMeasureInfo struct {
+	Required       uint64 `json:"required"`
+	FullyAllocated uint64 `json:"fully-allocated"`
 }
 
 type BlockInfo struct {
@@ -416,6 +504,7 @@ type BlockStatistic struct {
 
 type Qcow2DiscardRegion struct {
 	bs     *BlockDriverState
+	file   *BdrvChild //the image file, or the data file for the guest clusters
 	offset uint64
 	bytes  uint64
 	next   *Qcow2DiscardRegion
@@ -435,3 +524,9 @@ type QCowExtension struct {
 	Magic  uint32
 	Length uint32
 }
+
+// a header extension not known by the library, kept as it is
+type Qcow2UnknownHeaderExt struct {
+	Magic uint32
+	Data  []byte
+}
@@ -0,0 +1,461 @@
+//go:build linux
+
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	IORING_OFF_SQ_RING = 0
+	IORING_OFF_CQ_RING = 0x8000000
+	IORING_OFF_SQES    = 0x10000000
+
+	IORING_ENTER_GETEVENTS = 1
+
+	IORING_OP_NOP       = 0
+	IORING_OP_READV     = 1
+	IORING_OP_WRITEV    = 2
+	IORING_OP_FSYNC     = 3
+	IORING_OP_FALLOCATE = 17
+
+	IORING_FSYNC_DATASYNC = 1
+
+	RWF_DSYNC = unix.RWF_DSYNC
+
+	// user data of the request stopping the completion routine
+	LURING_STOP = ^uint64(0)
+)
+
+type io_sqring_offsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type io_cqring_offsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type io_uring_params struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCpu  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        io_sqring_offsets
+	cqOff        io_cqring_offsets
+}
+
+type io_uring_sqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad2        uint64
+}
+
+type io_uring_cqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+/*
+ * an io_uring shared by the requests of one file. the submitters queue
+ * their sqes under the lock, the first of them moves the queue to the ring
+ * and submits it without the lock until the queue is empty. a routine reaps
+ * the completions and wakes up the submitters.
+ */
+type LuringState struct {
+	fd      int
+	sqRing  []byte
+	cqRing  []byte
+	sqesMem []byte
+
+	sqHead  *uint32
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray unsafe.Pointer
+	sqes    unsafe.Pointer
+	cqHead  *uint32
+	cqTail  *uint32
+	cqMask  uint32
+	cqes    unsafe.Pointer
+
+	lock    sync.Mutex
+	nextId  uint64
+	pending map[uint64]chan int32
+	closed  bool
+	//the sqes not in the ring yet, and whether a submitter is moving them
+	queue      []io_uring_sqe
+	submitting bool
+	//bounds the requests in flight, so that the rings never overflow
+	slots  chan struct{}
+	exited chan struct{}
+}
+
+func io_uring_enter(fd int, toSubmit uint32, minComplete uint32, flags uint32) (int, syscall.Errno) {
+	n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(fd), uintptr(toSubmit),
+		uintptr(minComplete), uintptr(flags), 0, 0)
+	return int(n), errno
+}
+
+func luring_init(entries uint32) (*LuringState, error) {
+
+	var params io_uring_params
+	var err error
+	ring := &LuringState{fd: -1}
+
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	ring.fd = int(fd)
+
+	prot := unix.PROT_READ | unix.PROT_WRITE
+	mflags := unix.MAP_SHARED | unix.MAP_POPULATE
+	if ring.sqRing, err = unix.Mmap(ring.fd, IORING_OFF_SQ_RING,
+		int(params.sqOff.array+params.sqEntries*4), prot, mflags); err != nil {
+		goto fail
+	}
+	if ring.cqRing, err = unix.Mmap(ring.fd, IORING_OFF_CQ_RING,
+		int(params.cqOff.cqes+params.cqEntries*uint32(unsafe.Sizeof(io_uring_cqe{}))), prot, mflags); err != nil {
+		goto fail
+	}
+	if ring.sqesMem, err = unix.Mmap(ring.fd, IORING_OFF_SQES,
+		int(params.sqEntries*uint32(unsafe.Sizeof(io_uring_sqe{}))), prot, mflags); err != nil {
+		goto fail
+	}
+
+	ring.sqHead = (*uint32)(unsafe.Pointer(&ring.sqRing[params.sqOff.head]))
+	ring.sqTail = (*uint32)(unsafe.Pointer(&ring.sqRing[params.sqOff.tail]))
+	ring.sqMask = *(*uint32)(unsafe.Pointer(&ring.sqRing[params.sqOff.ringMask]))
+	ring.sqArray = unsafe.Pointer(&ring.sqRing[params.sqOff.array])
+	ring.sqes = unsafe.Pointer(&ring.sqesMem[0])
+	ring.cqHead = (*uint32)(unsafe.Pointer(&ring.cqRing[params.cqOff.head]))
+	ring.cqTail = (*uint32)(unsafe.Pointer(&ring.cqRing[params.cqOff.tail]))
+	ring.cqMask = *(*uint32)(unsafe.Pointer(&ring.cqRing[params.cqOff.ringMask]))
+	ring.cqes = unsafe.Pointer(&ring.cqRing[params.cqOff.cqes])
+
+	ring.pending = make(map[uint64]chan int32)
+	ring.slots = make(chan struct{}, params.sqEntries)
+	ring.exited = make(chan struct{})
+	go luring_completion_routine(ring)
+	return ring, nil
+
+fail:
+	luring_unmap(ring)
+	return nil, err
+}
+
+func luring_unmap(ring *LuringState) {
+	if ring.sqesMem != nil {
+		unix.Munmap(ring.sqesMem)
+	}
+	if ring.cqRing != nil {
+		unix.Munmap(ring.cqRing)
+	}
+	if ring.sqRing != nil {
+		unix.Munmap(ring.sqRing)
+	}
+	if ring.fd >= 0 {
+		unix.Close(ring.fd)
+	}
+}
+
+// stop the completion routine and release the ring, nothing may be in flight
+func luring_cleanup(ring *LuringState) {
+	if ring == nil {
+		return
+	}
+	done := make(chan int32, 1)
+	ring.lock.Lock()
+	ring.pending[LURING_STOP] = done
+	ring.lock.Unlock()
+	if luring_submit(ring, LURING_STOP, func(sqe *io_uring_sqe) {
+		sqe.opcode = IORING_OP_NOP
+	}) == nil {
+		select {
+		case <-ring.exited:
+		case <-done:
+			//the routine waits for a completion which never comes,
+			//so the ring is left to it rather than unmapped under it
+			return
+		}
+	}
+	ring.lock.Lock()
+	ring.closed = true
+	ring.lock.Unlock()
+	luring_unmap(ring)
+}
+
+/*
+ * queue one sqe, and submit the queue unless another submitter is at it.
+ * the sqe is prepared outside of the ring, as the tail published to the
+ * kernel before a failing io_uring_enter has to be taken back.
+ */
+func luring_submit(ring *LuringState, userData uint64, prep func(sqe *io_uring_sqe)) error {
+
+	var sqe io_uring_sqe
+	prep(&sqe)
+	sqe.userData = userData
+
+	ring.slots <- struct{}{}
+	ring.lock.Lock()
+	if ring.closed {
+		ring.lock.Unlock()
+		<-ring.slots
+		return syscall.EBADF
+	}
+	ring.queue = append(ring.queue, sqe)
+	if !ring.submitting {
+		ring.submitting = true
+		for len(ring.queue) > 0 && !ring.closed {
+			luring_flush_queue(ring)
+		}
+		ring.submitting = false
+	}
+	ring.lock.Unlock()
+	return nil
+}
+
+/*
+ * move the queue to the ring and submit it with one io_uring_enter, called
+ * with the lock held. Only the submitter consumes the sqes, the completion
+ * routine enters with nothing to submit, so the sqes the kernel has not
+ * taken when io_uring_enter fails are removed from the ring again and their
+ * requests complete with the error.
+ */
+func luring_flush_queue(ring *LuringState) {
+
+	var submitted int
+	var errno syscall.Errno
+	batch := ring.queue
+	ring.queue = nil
+
+	tail := *ring.sqTail
+	for i := range batch {
+		idx := (tail + uint32(i)) & ring.sqMask
+		*(*io_uring_sqe)(unsafe.Add(ring.sqes, uintptr(idx)*unsafe.Sizeof(io_uring_sqe{}))) = batch[i]
+		*(*uint32)(unsafe.Add(ring.sqArray, uintptr(idx)*4)) = idx
+	}
+	atomic.StoreUint32(ring.sqTail, tail+uint32(len(batch)))
+	ring.lock.Unlock()
+
+	for submitted < len(batch) {
+		var n int
+		if n, errno = io_uring_enter(ring.fd, uint32(len(batch)-submitted), 0, 0); errno == 0 && n > 0 {
+			submitted += n
+			continue
+		} else if errno == 0 {
+			errno = syscall.EIO
+		}
+		if errno != syscall.EINTR && errno != syscall.EAGAIN && errno != syscall.EBUSY {
+			break
+		}
+	}
+
+	ring.lock.Lock()
+	if submitted < len(batch) {
+		atomic.StoreUint32(ring.sqTail, atomic.LoadUint32(ring.sqHead))
+		for _, sqe := range batch[submitted:] {
+			if done := ring.pending[sqe.userData]; done != nil {
+				delete(ring.pending, sqe.userData)
+				done <- -int32(errno)
+			}
+		}
+	}
+}
+
+// run one request on the ring and wait for its result
+func luring_do(ring *LuringState, prep func(sqe *io_uring_sqe)) int32 {
+
+	done := make(chan int32, 1)
+	ring.lock.Lock()
+	id := ring.nextId
+	ring.nextId++
+	ring.pending[id] = done
+	ring.lock.Unlock()
+
+	if err := luring_submit(ring, id, prep); err != nil {
+		ring.lock.Lock()
+		delete(ring.pending, id)
+		ring.lock.Unlock()
+		return -int32(err.(syscall.Errno))
+	}
+	res := <-done
+	<-ring.slots
+	return res
+}
+
+func luring_completion_routine(ring *LuringState) {
+
+	stop := false
+	defer close(ring.exited)
+
+	for !stop {
+		head := atomic.LoadUint32(ring.cqHead)
+		tail := atomic.LoadUint32(ring.cqTail)
+		if head == tail {
+			_, errno := io_uring_enter(ring.fd, 0, 1, IORING_ENTER_GETEVENTS)
+			if errno != 0 && errno != syscall.EINTR && errno != syscall.EAGAIN && errno != syscall.EBUSY {
+				luring_fail_pending(ring, errno)
+				return
+			}
+			continue
+		}
+		for ; head != tail; head++ {
+			cqe := (*io_uring_cqe)(unsafe.Add(ring.cqes, uintptr(head&ring.cqMask)*unsafe.Sizeof(io_uring_cqe{})))
+			if cqe.userData == LURING_STOP {
+				stop = true
+				continue
+			}
+			ring.lock.Lock()
+			done := ring.pending[cqe.userData]
+			delete(ring.pending, cqe.userData)
+			ring.lock.Unlock()
+			if done != nil {
+				done <- cqe.res
+			}
+		}
+		atomic.StoreUint32(ring.cqHead, head)
+	}
+}
+
+// the ring is unusable, complete everything in flight with the error
+func luring_fail_pending(ring *LuringState, errno syscall.Errno) {
+	ring.lock.Lock()
+	ring.closed = true
+	for id, done := range ring.pending {
+		delete(ring.pending, id)
+		done <- -int32(errno)
+	}
+	ring.lock.Unlock()
+}
+
+func luring_rwv(ring *LuringState, opcode uint8, rwFlags uint32) rwv_func {
+	return func(fd uintptr, vec []syscall.Iovec, offset uint64) (uintptr, syscall.Errno) {
+		res := luring_do(ring, func(sqe *io_uring_sqe) {
+			sqe.opcode = opcode
+			sqe.fd = int32(fd)
+			sqe.off = offset
+			sqe.addr = uint64(uintptr(unsafe.Pointer(&vec[0])))
+			sqe.len = uint32(len(vec))
+			sqe.rwFlags = rwFlags
+		})
+		//the kernel uses the vector until the completion
+		runtime.KeepAlive(vec)
+		if res < 0 {
+			return 0, syscall.Errno(-res)
+		}
+		return uintptr(res), 0
+	}
+}
+
+// the whole iov goes to the kernel in one sqe, as long as it fits IOV_MAX
+func luring_preadv(ring *LuringState, file *os.File, iov []iovec, offset uint64) (uint64, error) {
+	return file_preadv(file, iov, offset, luring_rwv(ring, IORING_OP_READV, 0))
+}
+
+// fua writes are made durable by RWF_DSYNC
+func luring_pwritev(ring *LuringState, file *os.File, iov []iovec, offset uint64, fua bool) (uint64, error) {
+	rwFlags := uint32(0)
+	if fua {
+		rwFlags = RWF_DSYNC
+	}
+	return file_rwv(file, iov, offset, true, luring_rwv(ring, IORING_OP_WRITEV, rwFlags))
+}
+
+// run a request on the descriptor of file which transfers no data
+func luring_file_op(ring *LuringState, file *os.File, prep func(sqe *io_uring_sqe)) error {
+
+	var res int32
+	rc, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err = rc.Control(func(fd uintptr) {
+		res = luring_do(ring, func(sqe *io_uring_sqe) {
+			prep(sqe)
+			sqe.fd = int32(fd)
+		})
+	}); err != nil {
+		return err
+	}
+	if res < 0 {
+		return syscall.Errno(-res)
+	}
+	return nil
+}
+
+func luring_fsync(ring *LuringState, file *os.File, datasync bool) error {
+	return luring_file_op(ring, file, func(sqe *io_uring_sqe) {
+		sqe.opcode = IORING_OP_FSYNC
+		if datasync {
+			sqe.rwFlags = IORING_FSYNC_DATASYNC
+		}
+	})
+}
+
+// the length goes in addr and the mode in len, as fallocate(2) has no buffer
+func luring_fallocate(ring *LuringState, file *os.File, mode uint32, offset uint64, bytes uint64) error {
+	return luring_file_op(ring, file, func(sqe *io_uring_sqe) {
+		sqe.opcode = IORING_OP_FALLOCATE
+		sqe.off = offset
+		sqe.addr = bytes
+		sqe.len = mode
+	})
+}
@@ -0,0 +1,50 @@
+//go:build !linux
+
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import "os"
+
+// io_uring is linux only, the requests take the synchronous path elsewhere
+type LuringState struct{}
+
+func luring_init(entries uint32) (*LuringState, error) {
+	return nil, ERR_ENOSYS
+}
+
+func luring_cleanup(ring *LuringState) {
+}
+
+func luring_preadv(ring *LuringState, file *os.File, iov []iovec, offset uint64) (uint64, error) {
+	return 0, ERR_ENOSYS
+}
+
+func luring_pwritev(ring *LuringState, file *os.File, iov []iovec, offset uint64, fua bool) (uint64, error) {
+	return 0, ERR_ENOSYS
+}
+
+func luring_fsync(ring *LuringState, file *os.File, datasync bool) error {
+	return ERR_ENOSYS
+}
+
+func luring_fallocate(ring *LuringState, file *os.File, mode uint32, offset uint64, bytes uint64) error {
+	return ERR_ENOSYS
+}
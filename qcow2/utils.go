@@ -103,6 +103,10 @@ func round_up[V uint64 | uint32 | int | int32 | int64](n, m V) V {
 	return (n-1)/m*m + m
 }
 
+func div_round_up[V uint64 | uint32 | int | int32 | int64](n, d V) V {
+	return (n + d - 1) / d
+}
+
 func round_down[V uint64 | uint32 | int | int32 | int64](n, m V) V {
 	if n == 0 || m == 0 {
 		return 0
@@ -136,6 +140,17 @@ func min[V uint64 | uint32 | int | int32 | int64](vars ...V) V {
 	return min
 }
 
+// allocate a buffer whose address is aligned to align
+func qemu_memalign(align uint64, size uint64) []byte {
+	if align <= 1 || size == 0 {
+		return make([]byte, size)
+	}
+	buf := make([]byte, size+align)
+	addr := uint64(uintptr(unsafe.Pointer(&buf[0])))
+	start := align_up(addr, align) - addr
+	return buf[start : start+size : start+size]
+}
+
 /*
  * Checks if a buffer is all zeroes
  */
@@ -145,7 +160,14 @@ func buffer_is_zero(buf []byte, length uint64) bool {
 		return true
 	}
 
-	for i := uint64(0); i < length; i++ {
+	//compare a word at a time, then the remaining bytes
+	i := uint64(0)
+	for ; i+SIZE_UINT64 <= length; i += SIZE_UINT64 {
+		if *(*uint64)(unsafe.Pointer(&buf[i])) != 0 {
+			return false
+		}
+	}
+	for ; i < length; i++ {
 		if buf[i] != 0 {
 			return false
 		}
@@ -180,3 +202,15 @@ func interface2uint64(i interface{}) uint64 {
 	}
 	return 0
 }
+
+// a copy of the options without the keys
+func options_without(opts map[string]any, keys ...string) map[string]any {
+	copied := make(map[string]any, len(opts))
+	for k, v := range opts {
+		copied[k] = v
+	}
+	for _, k := range keys {
+		delete(copied, k)
+	}
+	return copied
+}
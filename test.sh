@@ -29,10 +29,7 @@ sleep 1
 time bin/qcow2util dd -o $DST_FILE -i $QCOW2_FILE -O raw -f qcow2
 sleep 1
 
-CK_SRC=`cksum $SRC_FILE | awk '{print $1}'`
-CK_DST=`cksum $DST_FILE | awk '{print $1}'`
-
-if [ $CK_SRC = $CK_DST ]; then 
+if bin/qcow2util compare $SRC_FILE $DST_FILE; then 
    echo "check successfully"
 else 
    echo "check failed"
@@ -43,10 +40,7 @@ echo "======== Test qcow2qcow  ==========="
 time bin/qcow2util dd -i $QCOW2_FILE -o $QCOW2_MIRROR_FILE  -O qcow2
 sleep 1
 
-CK_SRC=`cksum $QCOW2_FILE | awk '{print $1}'`
-CK_DST=`cksum $QCOW2_MIRROR_FILE | awk '{print $1}'`
-
-if [ $CK_SRC = $CK_DST ]; then
+if bin/qcow2util compare $QCOW2_FILE $QCOW2_MIRROR_FILE; then
    echo "check successfully"
 else 
    echo "check failed"
@@ -57,10 +51,7 @@ echo "======== Test raw2raw  ==========="
 time bin/qcow2util dd -i $SRC_FILE -o $SRC_MIRROR_FILE  -O raw
 sleep 1
 
-CK_SRC=`cksum $SRC_FILE | awk '{print $1}'`
-CK_DST=`cksum $SRC_MIRROR_FILE | awk '{print $1}'`
-
-if [ $CK_SRC = $CK_DST ]; then
+if bin/qcow2util compare $SRC_FILE $SRC_MIRROR_FILE; then
    echo "check successfully"
 else 
    echo "check failed"